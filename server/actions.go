@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Interactive buttons on roll, contest and roll request posts, calling back into
+// ServeHTTP at /actions/<action>.
+
+const (
+	// Post prop holding the expression of a roll post.
+	rollExpressionProp = "dice_expression"
+
+	actionReroll    = "reroll"
+	actionAnalyze   = "analyze"
+	actionAdvantage = "advantage"
+	actionContest   = "contest"
+)
+
+var (
+	// A lone d20, e.g. in "d20+5 to hit".
+	loneD20Regex = regexp.MustCompile(`(?i)(^|[^\w@$])(1?d20)($|[^\w])`)
+	// Any dice, to check that the d20 is alone.
+	anyDiceRegex = regexp.MustCompile(`(?i)d(\d|%)|\bdf\b`)
+)
+
+// Return the expression rolled with advantage, if it has exactly one die, a d20.
+func advantageExpression(expression string) (string, bool) {
+	if len(loneD20Regex.FindAllString(expression, -1)) != 1 || anyDiceRegex.MatchString(loneD20Regex.ReplaceAllString(expression, "$1$3")) {
+		return "", false
+	}
+	return loneD20Regex.ReplaceAllString(expression, "${1}d20a$3"), true
+}
+
+// Return a button calling back the plugin with an action.
+func newPostAction(id, name string) *model.PostAction {
+	return &model.PostAction{
+		Id:   id,
+		Type: model.PostActionTypeButton,
+		Name: name,
+		Integration: &model.PostActionIntegration{
+			URL: fmt.Sprintf("/plugins/%s/actions/%s", manifest.Id, id),
+		},
+	}
+}
+
+// addRollActions stores the expression of a roll post in its props, and adds the
+// buttons to roll it again.
+func addRollActions(post *model.Post, expression string, conf configuration) {
+	post.AddProp(rollExpressionProp, expression)
+	actions := []*model.PostAction{newPostAction(actionReroll, "Reroll"), newPostAction(actionAnalyze, "Analyze")}
+	if _, ok := advantageExpression(expression); ok && conf.EnableDnd5e {
+		actions = append(actions, newPostAction(actionAdvantage, "Advantage"))
+	}
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{{Actions: actions}})
+}
+
+// handleRollAction handles a click on a button of a roll, contest or roll request post.
+// Errors are shown to the user as ephemeral text.
+func (p *Plugin) handleRollAction(w http.ResponseWriter, r *http.Request, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+	request := &model.PostActionIntegrationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var appErr *model.AppError
+	switch action {
+	case actionContest:
+		appErr = p.executeContestAction(userID, request.PostId)
+	case actionRequestRoll, actionRequestClose:
+		appErr = p.executeRequestAction(userID, request.PostId, action)
+	default:
+		appErr = p.executeRollAction(userID, request.PostId, action)
+	}
+	response := &model.PostActionIntegrationResponse{}
+	if appErr != nil {
+		response.EphemeralText = appErr.Message
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func (p *Plugin) executeRollAction(userID, postID, action string) *model.AppError {
+	rollPost, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		return appError("Cannot find the roll.", appErr)
+	}
+	expression, ok := rollPost.GetProp(rollExpressionProp).(string)
+	if !ok || expression == "" || rollPost.UserId != p.diceBotID {
+		return appError("This post has no roll to repeat.", nil)
+	}
+	if !p.API.HasPermissionToChannel(userID, rollPost.ChannelId, model.PermissionCreatePost) {
+		return appError("You cannot post in this channel.", nil)
+	}
+	conf, err := p.getEffectiveConfiguration(rollPost.ChannelId)
+	if err != nil {
+		return appError("Cannot load the channel configuration.", err)
+	}
+
+	switch action {
+	case actionAnalyze:
+		post, appErr := p.generateDiceAnalyzePost(expression, userID, rollPost.ChannelId, rollPost.RootId, conf)
+		if appErr != nil {
+			return appErr
+		}
+		_, appErr = p.API.CreatePost(post)
+		return appErr
+	case actionAdvantage:
+		if expression, ok = advantageExpression(expression); !ok || !conf.EnableDnd5e {
+			return appError("This roll cannot be rolled with advantage.", nil)
+		}
+	}
+	roller, proof, err := p.publicRoller(conf, userID, rollPost.ChannelId, "")
+	if err != nil {
+		return appError("Cannot load the server seed.", err)
+	}
+	post, rolled, appErr := p.generateDiceRoll(expression, userID, rollPost.ChannelId, rollPost.RootId, roller, conf)
+	if appErr != nil {
+		return appErr
+	}
+	proof.addToPost(post)
+	addRollActions(post, expression, conf)
+	_, appErr = p.createRollPost(post, rolled, expression, userID)
+	return appErr
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAdvantageExpression(t *testing.T) {
+	testCases := []struct {
+		expression string
+		expected   string
+		ok         bool
+	}{
+		{expression: "d20", expected: "d20a", ok: true},
+		{expression: "1D20+5 to hit", expected: "d20a+5 to hit", ok: true},
+		{expression: "3+d20", expected: "3+d20a", ok: true},
+		{expression: "d20+$dex", expected: "d20a+$dex", ok: true},
+		{expression: "2d20"},
+		{expression: "d20a"},
+		{expression: "d20k1"},
+		{expression: "d20+d4"},
+		{expression: "d20, d20"},
+		{expression: "d200"},
+		{expression: "@attack"},
+		{expression: "d6"},
+	}
+	for _, testCase := range testCases {
+		expression, ok := advantageExpression(testCase.expression)
+		assert.Equal(t, testCase.ok, ok, testCase.expression)
+		assert.Equal(t, testCase.expected, expression, testCase.expression)
+	}
+}
+
+func TestRollActions(t *testing.T) {
+	p, api := initTestPlugin()
+	p.diceBotID = "botid"
+	store := mockPostStore(api)
+	api.On("HasPermissionToChannel", "readonly", "channel1", model.PermissionCreatePost).Return(false)
+	api.On("HasPermissionToChannel", mock.Anything, "channel1", model.PermissionCreatePost).Return(true)
+	assert.Nil(t, p.OnActivate())
+
+	actionNames := func(post *model.Post) []string {
+		names := []string{}
+		for _, attachment := range post.Attachments() {
+			for _, action := range attachment.Actions {
+				names = append(names, action.Name)
+				assert.Equal(t, "/plugins/"+manifest.Id+"/actions/"+action.Id, action.Integration.URL)
+			}
+		}
+		return names
+	}
+	click := func(method, path, userID, postID string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(&model.PostActionIntegrationRequest{PostId: postID, UserId: "spoofed"})
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if userID != "" {
+			r.Header.Set("Mattermost-User-Id", userID)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(&plugin.Context{}, w, r)
+		return w
+	}
+	ephemeralText := func(w *httptest.ResponseRecorder) string {
+		response := &model.PostActionIntegrationResponse{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(response))
+		return response.EphemeralText
+	}
+
+	_, appErr := p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: "/roll 2d6+1", UserId: "userid", ChannelId: "channel1"})
+	assert.Nil(t, appErr)
+	_, appErr = p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: "/roll d20+5 to hit", UserId: "userid", ChannelId: "channel1", RootId: "rootid"})
+	assert.Nil(t, appErr)
+	if !assert.Len(t, store.posts, 2) {
+		return
+	}
+	assert.Equal(t, "2d6+1", store.posts[0].GetProp(rollExpressionProp))
+	assert.Equal(t, []string{"Reroll", "Analyze"}, actionNames(store.posts[0]))
+	assert.Equal(t, "d20+5 to hit", store.posts[1].GetProp(rollExpressionProp))
+	assert.Equal(t, []string{"Reroll", "Analyze", "Advantage"}, actionNames(store.posts[1]))
+	rollPostID := store.posts[1].Id
+
+	w := click(http.MethodPost, "/actions/reroll", "otherid", rollPostID)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", ephemeralText(w))
+	if assert.Len(t, store.posts, 3) {
+		assert.Equal(t, "d20+5 to hit", store.posts[2].GetProp(rollExpressionProp))
+		assert.Equal(t, "rootid", store.posts[2].RootId)
+		assert.Equal(t, "channel1", store.posts[2].ChannelId)
+		assert.True(t, strings.HasPrefix(store.posts[2].Message, "**User** rolls "), store.posts[2].Message)
+	}
+	records, err := p.getRollHistory("channel1")
+	assert.Nil(t, err)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, "otherid", records[2].UserID)
+	}
+
+	w = click(http.MethodPost, "/actions/analyze", "otherid", rollPostID)
+	assert.Equal(t, "", ephemeralText(w))
+	if assert.Len(t, store.posts, 4) {
+		assert.True(t, strings.HasPrefix(store.posts[3].Message, "**User** analyzed roll `d20+5 to hit`:"), store.posts[3].Message)
+	}
+
+	w = click(http.MethodPost, "/actions/advantage", "otherid", rollPostID)
+	assert.Equal(t, "", ephemeralText(w))
+	if assert.Len(t, store.posts, 5) {
+		assert.Equal(t, "d20a+5 to hit", store.posts[4].GetProp(rollExpressionProp))
+		assert.Regexp(t, `^\*\*User\*\* rolls d20a\+5 = \*\*\d+\*\* to hit`, store.posts[4].Message)
+		assert.Equal(t, []string{"Reroll", "Analyze"}, actionNames(store.posts[4]))
+	}
+
+	w = click(http.MethodPost, "/actions/advantage", "otherid", store.posts[0].Id)
+	assert.Equal(t, "This roll cannot be rolled with advantage.", ephemeralText(w))
+	w = click(http.MethodPost, "/actions/reroll", "otherid", "unknown")
+	assert.Equal(t, "Cannot find the roll.", ephemeralText(w))
+	assert.Len(t, store.posts, 5)
+
+	// The clicker must be able to post, and the roll must be posted by the bot.
+	w = click(http.MethodPost, "/actions/reroll", "readonly", rollPostID)
+	assert.Equal(t, "You cannot post in this channel.", ephemeralText(w))
+	forged := &model.Post{Id: model.NewId(), UserId: "otherid", ChannelId: "channel1", Message: "Fake roll"}
+	forged.AddProp(rollExpressionProp, "d20")
+	store.all = append(store.all, forged)
+	w = click(http.MethodPost, "/actions/reroll", "otherid", forged.Id)
+	assert.Equal(t, "This post has no roll to repeat.", ephemeralText(w))
+	assert.Len(t, store.posts, 5)
+
+	assert.Equal(t, http.StatusUnauthorized, click(http.MethodPost, "/actions/reroll", "", rollPostID).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, click(http.MethodGet, "/actions/reroll", "otherid", rollPostID).Code)
+	assert.Equal(t, http.StatusNotFound, click(http.MethodPost, "/actions/unknown", "otherid", rollPostID).Code)
+	assert.Len(t, store.posts, 5)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/client"
+)
+
+// REST API: `POST /plugins/<plugin id>/api/v1/roll` and `.../api/v1/analyze`, for
+// authenticated Mattermost users, and for other plugins through inter-plugin
+// requests. The request and response types are in the client package.
+
+const maxAPIRequestSize = 1 << 16
+
+// Return the parse tree of a node. Sums, products and lists of a single term are
+// left out, as in renders.
+func newAPINode(n Node, rolled bool) client.Node {
+	switch n.sp.(type) {
+	case Sum, Prod, CommaList:
+		if len(n.child) == 1 {
+			return newAPINode(n.child[0], rolled)
+		}
+	}
+	ret := client.Node{
+		Type:  strings.TrimPrefix(fmt.Sprintf("%T", n.sp), "main."),
+		Token: n.token,
+	}
+	if rolled {
+		if _, ok := n.sp.(CommaList); !ok {
+			ret.Value = n.value().String()
+		}
+		if reporter, ok := n.sp.(diceReporter); ok {
+			dice := newAPIDice(reporter.rolledDice())
+			ret.Dice = &dice
+		}
+	}
+	for _, c := range n.child {
+		ret.Children = append(ret.Children, newAPINode(c, rolled))
+	}
+	return ret
+}
+
+func newAPIDice(r diceRecord) client.Dice {
+	return client.Dice{Dice: r.Dice, Results: r.Results}
+}
+
+func newAPIProbabilities(prob PD) []client.Probability {
+	ret := []client.Probability{}
+	atLeast := one
+	for _, outcome := range prob.Outcomes() {
+		p := prob.Get(outcome)
+		if p.Equals(zero) {
+			continue
+		}
+		ret = append(ret, client.Probability{Outcome: outcome.String(), Probability: p.String(), AtLeast: atLeast.String()})
+		atLeast = atLeast.Minus(p)
+	}
+	return ret
+}
+
+// ServeHTTP handles the HTTP requests to the plugin.
+func (p *Plugin) ServeHTTP(_ *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	switch path := r.URL.Path; path {
+	case "/actions/" + actionReroll, "/actions/" + actionAnalyze, "/actions/" + actionAdvantage, "/actions/" + actionContest,
+		"/actions/" + actionRequestRoll, "/actions/" + actionRequestClose:
+		p.handleRollAction(w, r, strings.TrimPrefix(path, "/actions/"))
+	case "/api/v1/roll":
+		p.handleAPI(w, r, p.apiRoll)
+	case "/api/v1/analyze":
+		p.handleAPI(w, r, p.apiAnalyze)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, client.ErrorResponse{Error: message})
+}
+
+// handleAPI checks and decodes a request to the REST API, then answers it with the
+// given handler. Requests from other plugins roll as the user they give, and every
+// request is checked against the channel permissions of its user.
+func (p *Plugin) handleAPI(w http.ResponseWriter, r *http.Request, handle func(userID string, request *client.Request, conf configuration) (interface{}, *model.AppError)) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+	// Mattermost sets Mattermost-User-Id on the requests of logged in users, and
+	// Mattermost-Plugin-ID on inter-plugin requests, which have no user. A request of a
+	// user with both is always the user's own.
+	userID := r.Header.Get("Mattermost-User-Id")
+	fromPlugin := r.Header.Get("Mattermost-Plugin-ID") != "" && userID == ""
+	if userID == "" && !fromPlugin {
+		writeAPIError(w, http.StatusUnauthorized, "Not authorized.")
+		return
+	}
+	request := &client.Request{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize)).Decode(request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Expected a JSON object like {\"expression\": \"1d20+5\"}.")
+		return
+	}
+	if fromPlugin {
+		if request.UserID == "" {
+			writeAPIError(w, http.StatusBadRequest, "Missing user_id.")
+			return
+		}
+		user, appErr := p.API.GetUser(request.UserID)
+		if appErr != nil || user.DeleteAt != 0 {
+			writeAPIError(w, http.StatusBadRequest, "Unknown user_id.")
+			return
+		}
+		userID = request.UserID
+	}
+	if strings.TrimSpace(request.Expression) == "" {
+		writeAPIError(w, http.StatusBadRequest, "Missing expression.")
+		return
+	}
+	if request.Post && request.ChannelID == "" {
+		writeAPIError(w, http.StatusBadRequest, "Missing channel_id to post to.")
+		return
+	}
+	if request.ChannelID != "" {
+		permission := model.PermissionReadChannel
+		if request.Post {
+			permission = model.PermissionCreatePost
+		}
+		if !p.API.HasPermissionToChannel(userID, request.ChannelID, permission) {
+			writeAPIError(w, http.StatusForbidden, "You do not have access to this channel.")
+			return
+		}
+	}
+	conf, err := p.getEffectiveConfiguration(request.ChannelID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Cannot load the channel configuration.")
+		return
+	}
+
+	response, appErr := handle(userID, request, conf)
+	if appErr != nil {
+		writeAPIError(w, appErr.StatusCode, appErr.Message)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (p *Plugin) apiRoll(userID string, request *client.Request, conf configuration) (interface{}, *model.AppError) {
+	// Only posted rolls are public, and fair in channels with fair rolls.
+	roller, proof := p.newRoller(), (*fairRoll)(nil)
+	if request.Post {
+		var err error
+		if roller, proof, err = p.publicRoller(conf, userID, request.ChannelID, ""); err != nil {
+			return nil, appError("Cannot load the server seed.", err)
+		}
+	}
+	post, rolled, appErr := p.generateDiceRoll(request.Expression, userID, request.ChannelID, request.RootID, roller, conf)
+	if appErr != nil {
+		return nil, appErr
+	}
+	proof.addToPost(post)
+	response := &client.Roll{
+		Expression: request.Expression,
+		Tree:       newAPINode(*rolled, true),
+		Dice:       []client.Dice{},
+		Totals:     collectTotals(*rolled),
+		Text:       post.Message,
+	}
+	for _, dice := range collectDice(*rolled) {
+		response.Dice = append(response.Dice, newAPIDice(dice))
+	}
+	if request.Post {
+		addRollActions(post, request.Expression, conf)
+		created, appErr := p.createRollPost(post, rolled, request.Expression, userID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		response.PostID = created.Id
+	}
+	return response, nil
+}
+
+func (p *Plugin) apiAnalyze(userID string, request *client.Request, conf configuration) (interface{}, *model.AppError) {
+	post, parsed, appErr := p.generateDiceAnalysis(request.Expression, userID, request.ChannelID, request.RootID, conf)
+	if appErr != nil {
+		return nil, appErr
+	}
+	prob := parsed.prob()
+	response := &client.Analysis{
+		Expression:    request.Expression,
+		Tree:          newAPINode(*parsed, false),
+		ExpectedValue: prob.ExpectedValue().String(),
+		Probabilities: newAPIProbabilities(prob),
+		Text:          post.Message,
+	}
+	if request.Post {
+		created, appErr := p.API.CreatePost(post)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if created != nil {
+			response.PostID = created.Id
+		}
+	}
+	return response, nil
+}
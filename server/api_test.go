@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/client"
+)
+
+func TestRestAPI(t *testing.T) {
+	p, api := initTestPlugin()
+	p.diceBotID = "botid"
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		post.Id = model.NewId()
+		posts = append(posts, post)
+		return post
+	}, nil)
+	api.On("HasPermissionToChannel", "userid", "channel1", mock.Anything).Return(true)
+	api.On("HasPermissionToChannel", "userid", "private", mock.Anything).Return(false)
+	assert.Nil(t, p.OnActivate())
+
+	call := func(method, path, userID, body string, response interface{}) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if userID != "" {
+			r.Header.Set("Mattermost-User-Id", userID)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(&plugin.Context{}, w, r)
+		if response != nil {
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(response), body)
+		}
+		return w.Code
+	}
+
+	roll := &client.Roll{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/roll", "userid", `{"expression": "2+3*4"}`, roll))
+	assert.Equal(t, &client.Roll{
+		Expression: "2+3*4",
+		Tree: client.Node{Type: "Sum", Token: "2+3*4", Value: "14", Children: []client.Node{
+			{Type: "Natural", Token: "2", Value: "2"},
+			{Type: "Prod", Token: "3*4", Value: "12", Children: []client.Node{
+				{Type: "Natural", Token: "3", Value: "3"},
+				{Type: "Natural", Token: "4", Value: "4"},
+			}},
+		}},
+		Dice:   []client.Dice{},
+		Totals: []string{"14"},
+		Text:   "**User** rolls 2+3×4 = **14**",
+	}, roll)
+
+	roll = &client.Roll{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/roll", "userid", `{"expression": "3d6, 1//2"}`, roll))
+	if assert.Len(t, roll.Dice, 1) {
+		assert.Equal(t, "d6", roll.Dice[0].Dice)
+		assert.Len(t, roll.Dice[0].Results, 3)
+		assert.Equal(t, &roll.Dice[0], roll.Tree.Children[0].Dice)
+	}
+	assert.Equal(t, "1/2", roll.Totals[1])
+	assert.Equal(t, "", roll.Tree.Value)
+	assert.Len(t, posts, 0)
+
+	analysis := &client.Analysis{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/analyze", "userid", `{"expression": "d4"}`, analysis))
+	assert.Equal(t, "5/2", analysis.ExpectedValue)
+	assert.Equal(t, client.Node{Type: "Dice", Token: "d4"}, analysis.Tree)
+	assert.Equal(t, []client.Probability{
+		{Outcome: "1", Probability: "1/4", AtLeast: "1"},
+		{Outcome: "2", Probability: "1/4", AtLeast: "3/4"},
+		{Outcome: "3", Probability: "1/4", AtLeast: "1/2"},
+		{Outcome: "4", Probability: "1/4", AtLeast: "1/4"},
+	}, analysis.Probabilities)
+	assert.True(t, strings.HasPrefix(analysis.Text, "**User** analyzed roll `d4`:"), analysis.Text)
+	assert.Equal(t, "", analysis.PostID)
+
+	// Posting on behalf of the user
+	roll = &client.Roll{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/roll", "userid", `{"expression": "d20+5", "channel_id": "channel1", "post": true, "root_id": "rootid"}`, roll))
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, posts[0].Id, roll.PostID)
+		assert.Equal(t, "channel1", posts[0].ChannelId)
+		assert.Equal(t, "rootid", posts[0].RootId)
+		assert.Equal(t, roll.Text, posts[0].Message)
+		assert.Equal(t, "d20+5", posts[0].GetProp(rollExpressionProp))
+	}
+	records, err := p.getRollHistory("channel1")
+	assert.Nil(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, roll.PostID, records[0].PostID)
+	}
+	assert.Nil(t, posts[0].GetProp(fairRollProp))
+
+	// In channels with fair rolls, posted rolls are fair.
+	p.configuration.EnableFairRolls = true
+	roll = &client.Roll{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/roll", "userid", `{"expression": "d20", "channel_id": "channel1", "post": true}`, roll))
+	if assert.Len(t, posts, 2) {
+		assert.NotNil(t, posts[1].GetProp(fairRollProp))
+		assert.Equal(t, roll.Text, posts[1].Message)
+	}
+	p.configuration.EnableFairRolls = false
+	posts = posts[:1]
+	analysis = &client.Analysis{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/analyze", "userid", `{"expression": "d20+5", "channel_id": "channel1", "post": true}`, analysis))
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, posts[1].Id, analysis.PostID)
+		assert.Equal(t, analysis.Text, posts[1].Message)
+	}
+
+	// Errors
+	testCases := []struct {
+		method string
+		path   string
+		userID string
+		body   string
+		status int
+		error  string
+	}{
+		{http.MethodGet, "/api/v1/roll", "userid", `{"expression": "d20"}`, http.StatusMethodNotAllowed, "Method not allowed."},
+		{http.MethodPost, "/api/v1/roll", "", `{"expression": "d20"}`, http.StatusUnauthorized, "Not authorized."},
+		{http.MethodPost, "/api/v1/roll", "userid", `d20`, http.StatusBadRequest, "Expected a JSON object like {\"expression\": \"1d20+5\"}."},
+		{http.MethodPost, "/api/v1/analyze", "userid", `{"expression": " "}`, http.StatusBadRequest, "Missing expression."},
+		{http.MethodPost, "/api/v1/roll", "userid", `{"expression": "d20", "post": true}`, http.StatusBadRequest, "Missing channel_id to post to."},
+		{http.MethodPost, "/api/v1/roll", "userid", `{"expression": "d20", "channel_id": "private"}`, http.StatusForbidden, "You do not have access to this channel."},
+		{http.MethodPost, "/api/v1/roll", "userid", `{"expression": "d0"}`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/api/v1/analyze", "userid", `{"expression": "hahaha"}`, http.StatusBadRequest, ""},
+	}
+	for _, testCase := range testCases {
+		response := &client.ErrorResponse{}
+		assert.Equal(t, testCase.status, call(testCase.method, testCase.path, testCase.userID, testCase.body, response), testCase.body)
+		if testCase.error != "" {
+			assert.Equal(t, testCase.error, response.Error, testCase.body)
+		} else {
+			assert.Contains(t, response.Error, "See `/roll help` for examples.", testCase.body)
+		}
+	}
+	assert.Equal(t, http.StatusNotFound, call(http.MethodPost, "/api/v1/unknown", "userid", `{"expression": "d20"}`, nil))
+	assert.Len(t, posts, 2)
+}
+
+// pluginHTTP sends inter-plugin requests to a plugin, as the Mattermost server does.
+type pluginHTTP struct {
+	p        *Plugin
+	pluginID string
+}
+
+func (h pluginHTTP) PluginHTTP(r *http.Request) *http.Response {
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/"+client.PluginID)
+	r.Header.Set("Mattermost-Plugin-ID", h.pluginID)
+	w := httptest.NewRecorder()
+	h.p.ServeHTTP(&plugin.Context{}, w, r)
+	return w.Result()
+}
+
+func TestInterPluginAPI(t *testing.T) {
+	p, api := initTestPlugin()
+	p.diceBotID = "botid"
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		post.Id = model.NewId()
+		posts = append(posts, post)
+		return post
+	}, nil)
+	api.On("HasPermissionToChannel", "userid", "channel1", mock.Anything).Return(true)
+	api.On("HasPermissionToChannel", mock.Anything, mock.Anything, mock.Anything).Return(false)
+	assert.Nil(t, p.OnActivate())
+	c := client.NewClient(pluginHTTP{p: p, pluginID: "com.example.game"})
+
+	// Other plugins roll as any user, in the channels of that user.
+	roll, err := c.Roll(client.Request{Expression: "2d6+3", UserID: "userid", ChannelID: "channel1", Post: true})
+	assert.Nil(t, err)
+	if assert.NotNil(t, roll) && assert.Len(t, posts, 1) {
+		assert.Equal(t, "2d6+3", roll.Expression)
+		assert.Len(t, roll.Dice, 1)
+		assert.Equal(t, posts[0].Id, roll.PostID)
+		assert.Equal(t, "botid", posts[0].UserId)
+		assert.Equal(t, roll.Text, posts[0].Message)
+		assert.True(t, strings.HasPrefix(roll.Text, "**User** rolls 2d6+3 = **"), roll.Text)
+	}
+
+	analysis, err := c.Analyze(client.Request{Expression: "d6", UserID: "userid"})
+	assert.Nil(t, err)
+	if assert.NotNil(t, analysis) {
+		assert.Equal(t, "7/2", analysis.ExpectedValue)
+		assert.Len(t, analysis.Probabilities, 6)
+	}
+
+	_, err = c.Roll(client.Request{Expression: "d20"})
+	assert.EqualError(t, err, "dice roller request failed: Missing user_id.")
+	_, err = c.Roll(client.Request{Expression: "hahaha", UserID: "userid"})
+	assert.ErrorContains(t, err, "dice roller request failed: ")
+	_, err = c.Roll(client.Request{Expression: "d20", UserID: "userid", ChannelID: "private", Post: true})
+	assert.EqualError(t, err, "dice roller request failed: You do not have access to this channel.")
+	assert.Len(t, posts, 1)
+
+	// A user cannot pass for a plugin to roll as someone else.
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/roll", strings.NewReader(`{"expression": "d20", "user_id": "otheruser", "channel_id": "channel1", "post": true}`))
+	r.Header.Set("Mattermost-User-Id", "intruder")
+	r.Header.Set("Mattermost-Plugin-ID", "com.example.game")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(&plugin.Context{}, w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Len(t, posts, 1)
+}
@@ -2,6 +2,7 @@ package br
 
 import (
 	"fmt"
+	"math"
 	"math/big"
 	"regexp"
 )
@@ -292,6 +293,15 @@ func (r1 BR) String() string {
 	return fmt.Sprintf("%s/%s", r1.num.String(), r1.den.String())
 }
 
+// Return the float64 nearest to the rational number, or NaN.
+func (r1 BR) Float64() float64 {
+	if r1.IsNaN() {
+		return math.NaN()
+	}
+	f, _ := new(big.Rat).SetFrac(r1.num, r1.den).Float64()
+	return f
+}
+
 // Return the rational number represented by the string argument, or NaN.
 // Intended as an inverse of BR.String().
 func FromString(s string) BR {
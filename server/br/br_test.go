@@ -1,6 +1,7 @@
 package br_test
 
 import (
+	"math"
 	"strconv"
 	"testing"
 
@@ -120,6 +121,11 @@ func TestBigRat(t *testing.T) {
 	assert.Equal(t, "0", zero.Pow(one).String())
 	assert.Equal(t, "0", zero.Pow(two).String())
 
+	// Test Float64
+	assert.Equal(t, 0.5, br.FromString("1/2").Float64())
+	assert.Equal(t, -2.345, br.FromString("-2345/1000").Float64())
+	assert.True(t, math.IsNaN(br.Nan.Float64()))
+
 	// Test Binomial
 	assert.Equal(t, "1", zero.Binomial(zero).String())
 	assert.Equal(t, "1", one.Binomial(zero).String())
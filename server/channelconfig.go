@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// channelConfig captures the settings of one channel that override the global plugin
+// configuration. It is stored as JSON in the plugin KV store.
+type channelConfig struct {
+	// Overrides of boolean settings, by key as listed in channelSettings.
+	Overrides map[string]bool `json:"overrides,omitempty"`
+	// The user receiving `/roll gm` rolls, if any.
+	GMUserID string `json:"gm_user_id,omitempty"`
+}
+
+// A boolean setting that can be overridden per channel.
+type channelSetting struct {
+	key   string
+	name  string
+	field func(c *configuration) *bool
+}
+
+// Return the settings that can be overridden per channel: every game system,
+// followed by the general options.
+func channelSettings() []channelSetting {
+	ret := []channelSetting{}
+	for _, gs := range gameSystems {
+		ret = append(ret, channelSetting{key: gs.id, name: gs.name, field: gs.enabled})
+	}
+	return append(ret,
+		channelSetting{key: "latex", name: "LaTeX", field: func(c *configuration) *bool { return &c.EnableLatex }},
+		channelSetting{key: "crits", name: "Crit messages", field: func(c *configuration) *bool { return &c.EnableCritMessages }},
+		channelSetting{key: "fair", name: "Provably fair rolls", field: func(c *configuration) *bool { return &c.EnableFairRolls }},
+	)
+}
+
+func findChannelSetting(key string) (channelSetting, bool) {
+	for _, s := range channelSettings() {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return channelSetting{}, false
+}
+
+// Return a copy of the configuration with the channel's overrides applied.
+func (c configuration) withChannelConfig(cc *channelConfig) configuration {
+	for _, s := range channelSettings() {
+		if v, ok := cc.Overrides[s.key]; ok {
+			*s.field(&c) = v
+		}
+	}
+	return c
+}
+
+func channelConfigKey(channelID string) string {
+	return "channelconfig_" + channelID
+}
+
+// getChannelConfig loads the channel's settings from the KV store. A channel without
+// stored settings gets an empty channelConfig.
+func (p *Plugin) getChannelConfig(channelID string) (*channelConfig, error) {
+	cc := &channelConfig{}
+	data, appErr := p.API.KVGet(channelConfigKey(channelID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load channel configuration")
+	}
+	if data == nil {
+		return cc, nil
+	}
+	if err := json.Unmarshal(data, cc); err != nil {
+		return nil, errors.Wrap(err, "failed to decode channel configuration")
+	}
+	return cc, nil
+}
+
+func (p *Plugin) setChannelConfig(channelID string, cc *channelConfig) error {
+	data, err := json.Marshal(cc)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode channel configuration")
+	}
+	if appErr := p.API.KVSet(channelConfigKey(channelID), data); appErr != nil {
+		return errors.Wrap(appErr, "failed to save channel configuration")
+	}
+	return nil
+}
+
+// getEffectiveConfiguration returns the global configuration merged with the channel's
+// overrides.
+func (p *Plugin) getEffectiveConfiguration(channelID string) (configuration, error) {
+	cc, err := p.getChannelConfig(channelID)
+	if err != nil {
+		return configuration{}, err
+	}
+	return p.getConfiguration().withChannelConfig(cc), nil
+}
+
+// isChannelGM returns whether a user is the GM of a channel: the GM set with `/roll
+// config gm`, or the channel admins if there is none.
+func (p *Plugin) isChannelGM(userID, channelID string) (bool, error) {
+	cc, err := p.getChannelConfig(channelID)
+	if err != nil {
+		return false, err
+	}
+	if cc.GMUserID != "" {
+		return cc.GMUserID == userID, nil
+	}
+	return p.API.HasPermissionToChannel(userID, channelID, model.PermissionManageChannelRoles), nil
+}
+
+// executeConfigCommand handles `/roll config [show|reset|gm @user|gm none|<setting> on|off|default]`.
+func (p *Plugin) executeConfigCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	cc, err := p.getChannelConfig(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the channel configuration.", err)
+	}
+
+	fields := strings.Fields(strings.ToLower(query))
+	if len(fields) == 0 || (len(fields) == 1 && fields[0] == "show") {
+		return ephemeralResponse(p.renderChannelConfig(cc)), nil
+	}
+
+	if !p.API.HasPermissionToChannel(args.UserId, args.ChannelId, model.PermissionManageChannelRoles) {
+		return nil, appError("Only channel admins can change the dice roller configuration of a channel.", nil)
+	}
+	switch {
+	case len(fields) == 1 && fields[0] == "reset":
+		cc.Overrides = nil
+		cc.GMUserID = ""
+	case len(fields) == 2 && fields[0] == "gm":
+		if fields[1] == "none" {
+			cc.GMUserID = ""
+			break
+		}
+		user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(fields[1], "@"))
+		if appErr != nil {
+			return nil, appError(fmt.Sprintf("Cannot find user `%s`.", fields[1]), appErr)
+		}
+		cc.GMUserID = user.Id
+	case len(fields) == 2:
+		setting, ok := findChannelSetting(fields[0])
+		if !ok {
+			return nil, appError(fmt.Sprintf("Unknown setting `%s`: See `/roll config` for the list of settings.", fields[0]), nil)
+		}
+		switch fields[1] {
+		case "on", "off":
+			if cc.Overrides == nil {
+				cc.Overrides = map[string]bool{}
+			}
+			cc.Overrides[setting.key] = fields[1] == "on"
+		case "default":
+			delete(cc.Overrides, setting.key)
+		default:
+			return nil, appError(fmt.Sprintf("Expected `on`, `off` or `default` but got `%s`.", fields[1]), nil)
+		}
+	default:
+		return nil, appError("Usage: `/roll config [show|reset|gm @user|gm none|<setting> on|off|default]`.", nil)
+	}
+
+	if err := p.setChannelConfig(args.ChannelId, cc); err != nil {
+		return nil, appError("Cannot save the channel configuration.", err)
+	}
+	return ephemeralResponse(p.renderChannelConfig(cc)), nil
+}
+
+func (p *Plugin) renderChannelConfig(cc *channelConfig) string {
+	global := p.getConfiguration()
+	effective := global.withChannelConfig(cc)
+	text := "Dice roller configuration for this channel:\n\n|Setting|Key|Value|Source|\n|-|-|-|-|"
+	for _, s := range channelSettings() {
+		source := "global"
+		if _, ok := cc.Overrides[s.key]; ok {
+			source = "channel"
+		}
+		text += fmt.Sprintf("\n|%s|`%s`|%s|%s|", s.name, s.key, ternaryStr(*s.field(&effective), "on", "off"), source)
+	}
+	gm := "none"
+	if cc.GMUserID != "" {
+		gm = "unknown user"
+		if user, appErr := p.API.GetUser(cc.GMUserID); appErr == nil {
+			gm = "@" + user.Username
+		}
+	}
+	text += fmt.Sprintf("\n|GM for `/roll gm`|`gm`|%s|channel|", gm)
+	text += "\n\nChannel admins can change a setting with `/roll config <key> on|off|default`, set the GM with `/roll config gm @user|none`, or use `/roll config reset` to use the global configuration."
+	return text
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestChannelConfigMerge(t *testing.T) {
+	global := configuration{EnableDnd5e: true, EnableLatex: true, EnableCritMessages: true}
+	cc := &channelConfig{Overrides: map[string]bool{"dnd5e": false, "fate": true, "crits": false}}
+	assert.Equal(t, configuration{EnableFate: true, EnableLatex: true}, global.withChannelConfig(cc))
+	assert.Equal(t, global, global.withChannelConfig(&channelConfig{}))
+}
+
+func TestChannelConfigCommand(t *testing.T) {
+	p, api := initTestPlugin()
+	api.On("HasPermissionToChannel", "admin", "channel1", model.PermissionManageChannelRoles).Return(true)
+	api.On("HasPermissionToChannel", "player", "channel1", model.PermissionManageChannelRoles).Return(false)
+	var post *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil).Run(func(args mock.Arguments) {
+		post = args.Get(0).(*model.Post)
+	})
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, channelID, command string) (*model.CommandResponse, *model.AppError) {
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    userID,
+			ChannelId: channelID,
+		})
+	}
+
+	// Fate is disabled globally.
+	_, err := run("player", "channel1", "/roll fate +1")
+	assert.NotNil(t, err)
+
+	// Only channel admins can change the configuration.
+	_, err = run("player", "channel1", "/roll config fate on")
+	assert.NotNil(t, err)
+	response, err := run("player", "channel1", "/roll config")
+	assert.Nil(t, err)
+	assert.Equal(t, model.CommandResponseTypeEphemeral, response.ResponseType)
+	assert.Contains(t, response.Text, "|Fate Core|`fate`|off|global|")
+
+	response, err = run("admin", "channel1", "/roll config fate on")
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, "|Fate Core|`fate`|on|channel|")
+	response, err = run("admin", "channel1", "/roll config DND5E off")
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, "|DnD 5e|`dnd5e`|off|channel|")
+
+	_, err = run("player", "channel1", "/roll fate +1")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(post.Message, "**User** rolls Fate +1 and gets"), post.Message)
+	_, err = run("player", "channel1", "/roll d20a")
+	assert.NotNil(t, err)
+
+	// Other channels use the global configuration.
+	_, err = run("player", "channel2", "/roll fate +1")
+	assert.NotNil(t, err)
+	_, err = run("player", "channel2", "/roll d20a")
+	assert.Nil(t, err)
+
+	_, err = run("admin", "channel1", "/roll config fate maybe")
+	assert.NotNil(t, err)
+	_, err = run("admin", "channel1", "/roll config dice on")
+	assert.NotNil(t, err)
+
+	response, err = run("admin", "channel1", "/roll config fate default")
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, "|Fate Core|`fate`|off|global|")
+	response, err = run("admin", "channel1", "/roll config reset")
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, "|DnD 5e|`dnd5e`|on|global|")
+}
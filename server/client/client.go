@@ -0,0 +1,148 @@
+// Package client lets other Mattermost plugins roll dice through the dice roller
+// plugin, using inter-plugin requests.
+//
+//	c := client.NewClient(p.API)
+//	roll, err := c.Roll(client.Request{
+//		Expression: "1d20+5 to hit",
+//		UserID:     userID,
+//		ChannelID:  channelID,
+//		Post:       true,
+//	})
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// PluginID is the ID of the dice roller plugin.
+const PluginID = "com.github.moussetc.mattermost.plugin.diceroller"
+
+// PluginAPI is the part of the Mattermost plugin API used by the client.
+type PluginAPI interface {
+	PluginHTTP(request *http.Request) *http.Response
+}
+
+// Request is a roll or analysis request.
+type Request struct {
+	Expression string `json:"expression"`
+	// User rolling, whose name, macros and character sheet are used. Required from
+	// other plugins, and ignored from Mattermost users.
+	UserID string `json:"user_id,omitempty"`
+	// Channel whose configuration and macros are used. Required to post.
+	ChannelID string `json:"channel_id,omitempty"`
+	// Post the result in the channel, as the dice roller bot.
+	Post   bool   `json:"post,omitempty"`
+	RootID string `json:"root_id,omitempty"`
+}
+
+// Node is a node of the parse tree of an expression.
+type Node struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+	// Result of a rolled node, as a rational number string like "7/2".
+	Value    string `json:"value,omitempty"`
+	Dice     *Dice  `json:"dice,omitempty"`
+	Children []Node `json:"children,omitempty"`
+}
+
+// Dice are dice of the same kind, e.g. "d20" or "dF", and their results.
+type Dice struct {
+	Dice    string `json:"dice"`
+	Results []int  `json:"results"`
+}
+
+// Roll is the result of a roll.
+type Roll struct {
+	Expression string `json:"expression"`
+	Tree       Node   `json:"tree"`
+	Dice       []Dice `json:"dice"`
+	// Result of each comma separated expression, as rational number strings.
+	Totals []string `json:"totals"`
+	// The result as shown in a roll post, in Markdown.
+	Text   string `json:"text"`
+	PostID string `json:"post_id,omitempty"`
+}
+
+// Analysis is the probability distribution of an expression.
+type Analysis struct {
+	Expression    string        `json:"expression"`
+	Tree          Node          `json:"tree"`
+	ExpectedValue string        `json:"expected_value"`
+	Probabilities []Probability `json:"probabilities"`
+	// The analysis as shown in an analysis post, in Markdown.
+	Text   string `json:"text"`
+	PostID string `json:"post_id,omitempty"`
+}
+
+// Probability is the chance of an outcome, and of at least that outcome, as rational
+// number strings.
+type Probability struct {
+	Outcome     string `json:"outcome"`
+	Probability string `json:"probability"`
+	AtLeast     string `json:"at_least"`
+}
+
+// ErrorResponse is the body of a failed request.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Client sends requests to the dice roller plugin.
+type Client struct {
+	api PluginAPI
+}
+
+// NewClient returns a client using the given plugin API.
+func NewClient(api PluginAPI) *Client {
+	return &Client{api: api}
+}
+
+// Roll rolls an expression.
+func (c *Client) Roll(request Request) (*Roll, error) {
+	roll := &Roll{}
+	if err := c.call("/api/v1/roll", request, roll); err != nil {
+		return nil, err
+	}
+	return roll, nil
+}
+
+// Analyze returns the probability distribution of an expression.
+func (c *Client) Analyze(request Request) (*Analysis, error) {
+	analysis := &Analysis{}
+	if err := c.call("/api/v1/analyze", request, analysis); err != nil {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+func (c *Client) call(path string, request Request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode dice roller request")
+	}
+	r, err := http.NewRequest(http.MethodPost, "/"+PluginID+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create dice roller request")
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp := c.api.PluginHTTP(r)
+	if resp == nil {
+		return errors.New("dice roller plugin unavailable")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errorResponse := &ErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(errorResponse); err != nil || errorResponse.Error == "" {
+			return errors.Errorf("dice roller request failed with status %d", resp.StatusCode)
+		}
+		return errors.Errorf("dice roller request failed: %s", errorResponse.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return errors.Wrap(err, "failed to decode dice roller response")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package client_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/client"
+)
+
+type fakeAPI struct {
+	requests []*http.Request
+	bodies   []string
+	status   int
+	response string
+}
+
+func (f *fakeAPI) PluginHTTP(r *http.Request) *http.Response {
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, string(body))
+	w := httptest.NewRecorder()
+	w.WriteHeader(f.status)
+	_, _ = w.WriteString(f.response)
+	return w.Result()
+}
+
+func TestRoll(t *testing.T) {
+	api := &fakeAPI{status: http.StatusOK, response: `{"expression": "d20", "tree": {"type": "Dice", "token": "d20", "value": "17", "dice": {"dice": "d20", "results": [17]}}, "dice": [{"dice": "d20", "results": [17]}], "totals": ["17"], "text": "**User** rolls d20 = **17**", "post_id": "postid"}`}
+	c := client.NewClient(api)
+
+	roll, err := c.Roll(client.Request{Expression: "d20", UserID: "userid", ChannelID: "channelid", Post: true})
+	assert.Nil(t, err)
+	dice := client.Dice{Dice: "d20", Results: []int{17}}
+	assert.Equal(t, &client.Roll{
+		Expression: "d20",
+		Tree:       client.Node{Type: "Dice", Token: "d20", Value: "17", Dice: &dice},
+		Dice:       []client.Dice{dice},
+		Totals:     []string{"17"},
+		Text:       "**User** rolls d20 = **17**",
+		PostID:     "postid",
+	}, roll)
+	if assert.Len(t, api.requests, 1) {
+		assert.Equal(t, http.MethodPost, api.requests[0].Method)
+		assert.Equal(t, "/"+client.PluginID+"/api/v1/roll", api.requests[0].URL.Path)
+		request := client.Request{}
+		assert.Nil(t, json.Unmarshal([]byte(api.bodies[0]), &request))
+		assert.Equal(t, client.Request{Expression: "d20", UserID: "userid", ChannelID: "channelid", Post: true}, request)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	api := &fakeAPI{status: http.StatusOK, response: `{"expression": "d2", "tree": {"type": "Dice", "token": "d2"}, "expected_value": "3/2", "probabilities": [{"outcome": "1", "probability": "1/2", "at_least": "1"}, {"outcome": "2", "probability": "1/2", "at_least": "1/2"}], "text": "analysis"}`}
+	analysis, err := client.NewClient(api).Analyze(client.Request{Expression: "d2", UserID: "userid"})
+	assert.Nil(t, err)
+	assert.Equal(t, "3/2", analysis.ExpectedValue)
+	assert.Equal(t, []client.Probability{{Outcome: "1", Probability: "1/2", AtLeast: "1"}, {Outcome: "2", Probability: "1/2", AtLeast: "1/2"}}, analysis.Probabilities)
+	if assert.Len(t, api.requests, 1) {
+		assert.True(t, strings.HasSuffix(api.requests[0].URL.Path, "/api/v1/analyze"))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	api := &fakeAPI{status: http.StatusBadRequest, response: `{"error": "Missing expression."}`}
+	c := client.NewClient(api)
+	_, err := c.Roll(client.Request{UserID: "userid"})
+	assert.EqualError(t, err, "dice roller request failed: Missing expression.")
+
+	api.status, api.response = http.StatusNotFound, "404 page not found"
+	_, err = c.Analyze(client.Request{Expression: "d20", UserID: "userid"})
+	assert.EqualError(t, err, "dice roller request failed with status 404")
+
+	api.status, api.response = http.StatusOK, "not json"
+	_, err = c.Roll(client.Request{Expression: "d20", UserID: "userid"})
+	assert.ErrorContains(t, err, "failed to decode dice roller response")
+}
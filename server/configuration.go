@@ -22,8 +22,21 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
-	EnableDnd5e bool `json:"enable_dnd5e"`
-	EnableLatex bool `json:"enable_latex"`
+	EnableDnd5e        bool `json:"enable_dnd5e"`
+	EnableFate         bool `json:"enable_fate"`
+	EnableExalted      bool `json:"enable_exalted"`
+	EnableLatex        bool `json:"enable_latex"`
+	EnableCritMessages bool `json:"enable_crit_messages"`
+	EnableFairRolls    bool `json:"enable_fair_rolls"`
+
+	// Random number generator of rolls: "pcg" (the default) or "crypto".
+	RNG string `json:"rng"`
+
+	// Outgoing webhooks for public rolls: one URL per line, optionally preceded by a
+	// channel ID to only send the rolls of that channel.
+	WebhookURLs string `json:"webhook_urls"`
+	// Secret used to sign webhook payloads.
+	WebhookSecret string `json:"webhook_secret"`
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -42,8 +55,11 @@ func (p *Plugin) getConfiguration() *configuration {
 
 	if p.configuration == nil {
 		return &configuration{
-			EnableDnd5e: true,
-			EnableLatex: true,
+			EnableDnd5e:        true,
+			EnableFate:         true,
+			EnableExalted:      true,
+			EnableLatex:        true,
+			EnableCritMessages: true,
 		}
 	}
 
@@ -86,8 +102,11 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	for _, err := range configuration.validateWebhookURLs() {
+		p.API.LogWarn("Ignoring an invalid roll webhook.", "error", err.Error())
+	}
+
 	p.setConfiguration(configuration)
-	p.parser = GetParser(*configuration)
 
 	return p.defineBot()
 }
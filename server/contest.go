@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/br"
+)
+
+// Contests: opposed rolls between two users, e.g. for grapples. The challenger rolls
+// first, then the opponent responds with a button or `/roll respond`, and the higher
+// total wins.
+
+// contest is a pending contest, stored as JSON in the plugin KV store until the
+// opponent responds or it expires. Each user has at most one pending contest per
+// channel.
+type contest struct {
+	ChallengerID string `json:"challenger_id"`
+	OpponentID   string `json:"opponent_id"`
+	Skill        string `json:"skill"`
+	// The challenger's expression and total, as a rational number string.
+	Expression string `json:"expression"`
+	Total      string `json:"total"`
+	// The challenge post, and its thread if any.
+	PostID string `json:"post_id"`
+	RootID string `json:"root_id,omitempty"`
+}
+
+const (
+	// Contests expire after an hour without response.
+	contestExpirySeconds = 60 * 60
+	maxContestSkillSize  = 32
+)
+
+var contestSkillRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func contestKey(channelID, opponentID string) string {
+	return "contest_" + channelID + "_" + opponentID
+}
+
+// Return the skill of a contest as displayed, e.g. "sleight of hand".
+func (c *contest) skillName() string {
+	return strings.ReplaceAll(c.Skill, "_", " ")
+}
+
+func (p *Plugin) getContest(channelID, opponentID string) (*contest, error) {
+	data, appErr := p.API.KVGet(contestKey(channelID, opponentID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load contest")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	c := &contest{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Wrap(err, "failed to decode contest")
+	}
+	return c, nil
+}
+
+func (p *Plugin) setContest(channelID string, c *contest) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode contest")
+	}
+	if appErr := p.API.KVSetWithExpiry(contestKey(channelID, c.OpponentID), data, contestExpirySeconds); appErr != nil {
+		return errors.Wrap(appErr, "failed to save contest")
+	}
+	return nil
+}
+
+// contestExpression returns the expression rolled by a user in a contest when none is
+// given: the check of the skill with the user's character sheet if a game system has
+// checks, or else the challenger's expression, and whether it is the challenger's.
+func (p *Plugin) contestExpression(userID, skill, challengerExpr string, conf configuration) (string, bool, error) {
+	if command, ok := conf.gameSystemCommand("check"); ok {
+		sheets, err := p.getCharacterSheets(userID)
+		if err != nil {
+			return "", false, err
+		}
+		expr, err := command(skill, sheets.active())
+		if err == nil {
+			return expr, false, nil
+		}
+		// Rolling the challenger's expression would give a wrong result.
+		if challengerExpr != "" {
+			return "", false, fmt.Errorf("%s. Respond with an expression to roll for %s instead, like `/roll respond 1d20+3`", err.Error(), strings.ReplaceAll(skill, "_", " "))
+		}
+	}
+	if challengerExpr == "" {
+		return "", false, fmt.Errorf("expected an expression to roll for %s", strings.ReplaceAll(skill, "_", " "))
+	}
+	return challengerExpr, true, nil
+}
+
+// executeContestCommand handles `/roll contest @user <skill> [expression]`: it rolls the
+// challenger's side and posts the challenge.
+func (p *Plugin) executeContestCommand(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	username, rest := splitFirstWord(query)
+	skill, expr := splitFirstWord(rest)
+	if !strings.HasPrefix(username, "@") || skill == "" {
+		return nil, appError("Usage: `/roll contest @user <skill> [expression]`, e.g. `/roll contest @bob athletics 1d20+5`.", nil)
+	}
+	if !contestSkillRegex.MatchString(skill) || len(skill) > maxContestSkillSize {
+		return nil, appError(fmt.Sprintf("Invalid skill `%s`: Use up to %d letters, digits and underscores.", skill, maxContestSkillSize), nil)
+	}
+	opponent, appErr := p.API.GetUserByUsername(strings.TrimPrefix(username, "@"))
+	if appErr != nil {
+		return nil, appError(fmt.Sprintf("Cannot find user `%s`.", username), appErr)
+	}
+	if opponent.Id == args.UserId || opponent.IsBot {
+		return nil, appError("You can only challenge another user.", nil)
+	}
+	if !p.API.HasPermissionToChannel(opponent.Id, args.ChannelId, model.PermissionCreatePost) {
+		return nil, appError(fmt.Sprintf("%s cannot post in this channel.", username), nil)
+	}
+	if expr == "" {
+		var err error
+		if expr, _, err = p.contestExpression(args.UserId, skill, "", conf); err != nil {
+			return nil, appError(fmt.Sprintf("%s.", err.Error()), err)
+		}
+	}
+
+	p.contestLock.Lock()
+	defer p.contestLock.Unlock()
+	pending, err := p.getContest(args.ChannelId, opponent.Id)
+	if err != nil {
+		return nil, appError("Cannot load the contest.", err)
+	}
+	if pending != nil {
+		return nil, appError(fmt.Sprintf("%s already has a pending contest in this channel: Wait for it to be resolved or to expire.", username), nil)
+	}
+
+	post, rolled, total, appErr := p.rollTotal(args.UserId, args.ChannelId, args.RootId, expr, "Contests", conf)
+	if appErr != nil {
+		return nil, appErr
+	}
+	c := &contest{
+		ChallengerID: args.UserId,
+		OpponentID:   opponent.Id,
+		Skill:        skill,
+		Expression:   expr,
+		Total:        total.String(),
+		RootID:       args.RootId,
+	}
+	post.Message = fmt.Sprintf("%s\n@%s, you are challenged to a contest of **%s**! Respond with the button below or with `/roll respond [expression]` within an hour.", post.Message, opponent.Username, c.skillName())
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{{Actions: []*model.PostAction{newPostAction(actionContest, "Respond")}}})
+	created, appErr := p.createRollPost(post, rolled, expr, args.UserId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	c.PostID = created.Id
+	if err := p.setContest(args.ChannelId, c); err != nil {
+		// Nobody can respond: remove the button.
+		created.DelProp("attachments")
+		if _, appErr := p.API.UpdatePost(created); appErr != nil {
+			p.API.LogWarn("Cannot close a contest.", "error", appErr.Error())
+		}
+		return nil, appError("Cannot save the contest.", err)
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// executeRespondCommand handles `/roll respond [expression]`: it resolves the pending
+// contest of the caller in the channel.
+func (p *Plugin) executeRespondCommand(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	p.contestLock.Lock()
+	defer p.contestLock.Unlock()
+
+	c, err := p.getContest(args.ChannelId, args.UserId)
+	if err != nil {
+		return nil, appError("Cannot load the contest.", err)
+	}
+	if c == nil {
+		return nil, appError("Nobody challenged you to a contest in this channel, or the contest expired.", nil)
+	}
+	if appErr := p.resolveContest(args.UserId, args.ChannelId, c, query, conf); appErr != nil {
+		return nil, appErr
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// executeContestAction handles a click on the button of a challenge post.
+func (p *Plugin) executeContestAction(userID, postID string) *model.AppError {
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		return appError("Cannot find the contest.", appErr)
+	}
+
+	p.contestLock.Lock()
+	defer p.contestLock.Unlock()
+
+	c, err := p.getContest(post.ChannelId, userID)
+	if err != nil {
+		return appError("Cannot load the contest.", err)
+	}
+	if c == nil || c.PostID != postID {
+		return appError("This contest is not yours to respond to, or it expired.", nil)
+	}
+	conf, err := p.getEffectiveConfiguration(post.ChannelId)
+	if err != nil {
+		return appError("Cannot load the channel configuration.", err)
+	}
+	return p.resolveContest(userID, post.ChannelId, c, "", conf)
+}
+
+// resolveContest rolls the opponent's side of a contest, and posts the result in the
+// thread of the challenge.
+func (p *Plugin) resolveContest(userID, channelID string, c *contest, expr string, conf configuration) *model.AppError {
+	sameExpression := false
+	if expr == "" {
+		var err error
+		if expr, sameExpression, err = p.contestExpression(userID, c.Skill, c.Expression, conf); err != nil {
+			return appError(fmt.Sprintf("%s.", err.Error()), err)
+		}
+	}
+	rootID := c.RootID
+	if rootID == "" {
+		rootID = c.PostID
+	}
+	post, rolled, total, appErr := p.rollTotal(userID, channelID, rootID, expr, "Contests", conf)
+	if appErr != nil {
+		return appErr
+	}
+
+	challenger, appErr := p.getDisplayName(c.ChallengerID)
+	if appErr != nil {
+		return appErr
+	}
+	opponent, appErr := p.getDisplayName(userID)
+	if appErr != nil {
+		return appErr
+	}
+	challengerTotal := br.FromString(c.Total)
+	var result string
+	switch {
+	case total.LessThan(challengerTotal):
+		result = fmt.Sprintf("**%s** wins by %s.", challenger, challengerTotal.Minus(total).Render(""))
+	case challengerTotal.LessThan(total):
+		result = fmt.Sprintf("**%s** wins by %s.", opponent, total.Minus(challengerTotal).Render(""))
+	default:
+		result = "It's a tie."
+	}
+	post.Message += fmt.Sprintf("\n**Contest of %s**: %s %s vs %s %s: %s", c.skillName(), challenger, challengerTotal.Render(""), opponent, total.Render(""), result)
+	if sameExpression {
+		post.Message += fmt.Sprintf("\n*%s rolled the expression of %s.*", opponent, challenger)
+	}
+	if _, appErr = p.createRollPost(post, rolled, expr, userID); appErr != nil {
+		return appErr
+	}
+	if appErr = p.API.KVDelete(contestKey(channelID, c.OpponentID)); appErr != nil {
+		return appError("Cannot delete the contest.", appErr)
+	}
+
+	// Close the challenge.
+	if challenge, appErr := p.API.GetPost(c.PostID); appErr == nil {
+		challenge.DelProp("attachments")
+		challenge.Message += "\n*Resolved: " + result + "*"
+		if _, appErr = p.API.UpdatePost(challenge); appErr != nil {
+			p.API.LogWarn("Cannot close a contest.", "error", appErr.Error())
+		}
+	}
+	return nil
+}
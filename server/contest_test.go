@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestContests(t *testing.T) {
+	p, api := initTestPlugin()
+	store := mockPostStore(api)
+	api.On("GetUserByUsername", "bob").Return(&model.User{Id: "bobid", Username: "bob"}, nil)
+	api.On("GetUserByUsername", "user").Return(&model.User{Id: "userid", Username: "user"}, nil)
+	api.On("GetUserByUsername", "nobody").Return(nil, model.NewAppError("GetUserByUsername", "not found", nil, "", http.StatusNotFound))
+	api.On("HasPermissionToChannel", mock.Anything, "channel1", model.PermissionCreatePost).Return(true)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, command string) (*model.CommandResponse, *model.AppError) {
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: command, UserId: userID, ChannelId: "channel1"})
+	}
+	click := func(userID, postID string) string {
+		body, _ := json.Marshal(&model.PostActionIntegrationRequest{PostId: postID})
+		r := httptest.NewRequest(http.MethodPost, "/actions/"+actionContest, bytes.NewReader(body))
+		r.Header.Set("Mattermost-User-Id", userID)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(&plugin.Context{}, w, r)
+		response := &model.PostActionIntegrationResponse{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(response))
+		return response.EphemeralText
+	}
+
+	_, err := run("userid", "/roll contest @bob sleight_of_hand 15")
+	assert.Nil(t, err)
+	if !assert.Len(t, store.posts, 1) {
+		return
+	}
+	challenge := store.posts[0]
+	assert.Equal(t, "**User** rolls 15 = **15**\n@bob, you are challenged to a contest of **sleight of hand**! Respond with the button below or with `/roll respond [expression]` within an hour.", challenge.Message)
+	if assert.Len(t, challenge.Attachments(), 1) {
+		assert.Equal(t, "Respond", challenge.Attachments()[0].Actions[0].Name)
+	}
+
+	// A pending contest is not replaced.
+	_, err = run("userid", "/roll contest @bob athletics 3")
+	assert.NotNil(t, err)
+	assert.Len(t, store.posts, 1)
+
+	// Only the opponent can respond.
+	assert.Equal(t, "This contest is not yours to respond to, or it expired.", click("userid", challenge.Id))
+	_, err = run("userid", "/roll respond 3")
+	assert.NotNil(t, err)
+
+	_, err = run("bobid", "/roll respond 12")
+	assert.Nil(t, err)
+	if assert.Len(t, store.posts, 2) {
+		assert.Equal(t, "**User** rolls 12 = **12**\n**Contest of sleight of hand**: User 15 vs User 12: **User** wins by 3.", store.posts[1].Message)
+		assert.Equal(t, challenge.Id, store.posts[1].RootId)
+	}
+	if assert.NotNil(t, store.updated) {
+		assert.Empty(t, store.updated.Attachments())
+		assert.Contains(t, store.updated.Message, "\n*Resolved: **User** wins by 3.*")
+	}
+	records, _ := p.getRollHistory("channel1")
+	assert.Len(t, records, 2)
+
+	// A contest is resolved once.
+	_, err = run("bobid", "/roll respond 12")
+	assert.NotNil(t, err)
+	assert.Equal(t, "This contest is not yours to respond to, or it expired.", click("bobid", challenge.Id))
+
+	// Without a sheet, the button rolls the challenger's expression.
+	// The check of the opponent is rolled rather than the challenger's expression, and
+	// the opponent is asked for an expression when it cannot be.
+	store.posts = nil
+	_, err = run("userid", "/roll contest @bob athletics 10")
+	assert.Nil(t, err)
+	assert.Equal(t, "no character sheet: Use `/roll sheet set <name> <value>` to create one. Respond with an expression to roll for athletics instead, like `/roll respond 1d20+3`.", click("bobid", store.posts[0].Id))
+	assert.Len(t, store.posts, 1)
+	_, err = run("bobid", "/roll respond 10")
+	assert.Nil(t, err)
+	if assert.Len(t, store.posts, 2) {
+		assert.Equal(t, "**User** rolls 10 = **10**\n**Contest of athletics**: User 10 vs User 10: It's a tie.", store.posts[1].Message)
+	}
+
+	// Without checks, the opponent rolls the challenger's expression, as the result says.
+	p.configuration.EnableDnd5e = false
+	store.posts = nil
+	_, err = run("userid", "/roll contest @bob athletics 10")
+	assert.Nil(t, err)
+	assert.Equal(t, "", click("bobid", store.posts[0].Id))
+	if assert.Len(t, store.posts, 2) {
+		assert.Equal(t, "**User** rolls 10 = **10**\n**Contest of athletics**: User 10 vs User 10: It's a tie.\n*User rolled the expression of User.*", store.posts[1].Message)
+	}
+	p.configuration.EnableDnd5e = true
+
+	// With a sheet, the button rolls the opponent's check.
+	store.posts = nil
+	_, err = run("bobid", "/roll sheet set str 4")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll contest @bob athletics 1")
+	assert.Nil(t, err)
+	assert.Equal(t, "", click("bobid", store.posts[0].Id))
+	if assert.Len(t, store.posts, 2) {
+		assert.Contains(t, store.posts[1].Message, "**User** wins by ")
+		assert.Contains(t, store.posts[1].Message, "d20+str(4)")
+	}
+
+	for _, command := range []string{
+		"/roll contest bob athletics 1d20",
+		"/roll contest @bob",
+		"/roll contest @bob Bad-Skill 1d20",
+		"/roll contest @nobody athletics 1d20",
+		"/roll contest @user athletics 1d20",
+		"/roll contest @bob athletics",
+		"/roll contest @bob athletics 1, 2",
+	} {
+		_, err = run("userid", command)
+		assert.NotNil(t, err, command)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const triggerDeck string = "deck"
+
+// deck is the deck of cards of a channel, stored as JSON in the plugin KV store.
+type deck struct {
+	// The kind of deck, e.g. "standard52" or "custom".
+	Kind string `json:"kind"`
+	// Cards left to draw, the top card first.
+	Pile []string `json:"pile"`
+	// Cards drawn and not discarded yet.
+	InPlay []string `json:"in_play"`
+	// Discarded cards, the last discarded first.
+	Discard []string `json:"discard"`
+}
+
+const (
+	maxDeckDraw       = 20
+	maxCustomDeckSize = 200
+	maxCardLength     = 64
+)
+
+var (
+	cardRanks  = []string{"A", "2", "3", "4", "5", "6", "7", "8", "9", "10", "J", "Q", "K"}
+	cardSuits  = []string{"♠️", "♥️", "♦️", "♣️"}
+	tarotRanks = []string{"Ace", "Two", "Three", "Four", "Five", "Six", "Seven", "Eight", "Nine", "Ten", "Page", "Knight", "Queen", "King"}
+	tarotSuits = []string{"🏆 Cups", "🪄 Wands", "⚔️ Swords", "🪙 Pentacles"}
+	tarotMajor = []string{
+		"The Fool", "The Magician", "The High Priestess", "The Empress", "The Emperor", "The Hierophant",
+		"The Lovers", "The Chariot", "Strength", "The Hermit", "Wheel of Fortune", "Justice",
+		"The Hanged Man", "Death", "Temperance", "The Devil", "The Tower", "The Star", "The Moon",
+		"The Sun", "Judgement", "The World",
+	}
+)
+
+// Return the cards of a kind of deck. Custom decks are given as a comma separated list.
+func newDeckCards(kind, custom string) ([]string, error) {
+	cards := []string{}
+	switch kind {
+	case "standard52", "standard54":
+		for _, suit := range cardSuits {
+			for _, rank := range cardRanks {
+				cards = append(cards, rank+suit)
+			}
+		}
+		if kind == "standard54" {
+			cards = append(cards, "🃏 Red Joker", "🃏 Black Joker")
+		}
+	case "tarot":
+		for i, name := range tarotMajor {
+			cards = append(cards, fmt.Sprintf("🔮 %s (%d)", name, i))
+		}
+		for _, suit := range tarotSuits {
+			for _, rank := range tarotRanks {
+				cards = append(cards, rank+" of "+suit)
+			}
+		}
+	case "custom":
+		for _, card := range strings.Split(custom, ",") {
+			if card = strings.TrimSpace(card); card == "" {
+				continue
+			}
+			if len(card) > maxCardLength {
+				return nil, fmt.Errorf("a card can be at most %d characters long", maxCardLength)
+			}
+			cards = append(cards, card)
+		}
+		if len(cards) == 0 {
+			return nil, errors.New("expected a comma separated list of cards, like `/deck new custom Sun, Moon, Star`")
+		}
+		if len(cards) > maxCustomDeckSize {
+			return nil, fmt.Errorf("a deck can have at most %d cards", maxCustomDeckSize)
+		}
+	default:
+		return nil, fmt.Errorf("unknown deck `%s`: expected `standard52`, `standard54`, `tarot` or `custom`", kind)
+	}
+	return cards, nil
+}
+
+// Shuffle cards in place, with the Fisher-Yates shuffle.
+func shuffleCards(cards []string, roller Roller) {
+	for i := len(cards) - 1; i > 0; i-- {
+		j := roller(i+1) - 1
+		cards[i], cards[j] = cards[j], cards[i]
+	}
+}
+
+// Shuffle the discarded cards back into the pile, or every card if all is set.
+func (d *deck) shuffle(all bool, roller Roller) {
+	d.Pile = append(d.Pile, d.Discard...)
+	d.Discard = []string{}
+	if all {
+		d.Pile = append(d.Pile, d.InPlay...)
+		d.InPlay = []string{}
+	}
+	shuffleCards(d.Pile, roller)
+}
+
+// Draw cards from the top of the pile, putting them in play.
+func (d *deck) draw(n int) ([]string, error) {
+	if n > len(d.Pile) {
+		return nil, fmt.Errorf("only %d cards are left: Use `/deck shuffle` to shuffle the discarded cards back", len(d.Pile))
+	}
+	drawn := append([]string{}, d.Pile[:n]...)
+	d.Pile = d.Pile[n:]
+	d.InPlay = append(d.InPlay, drawn...)
+	return drawn, nil
+}
+
+// Put the cards in play on the discard pile.
+func (d *deck) discard() int {
+	n := len(d.InPlay)
+	for _, card := range d.InPlay {
+		d.Discard = append([]string{card}, d.Discard...)
+	}
+	d.InPlay = []string{}
+	return n
+}
+
+func (d *deck) render() string {
+	text := fmt.Sprintf("**Deck** (%s): %d cards to draw, %d discarded.", d.Kind, len(d.Pile), len(d.Discard))
+	if len(d.InPlay) > 0 {
+		text += "\nIn play: " + strings.Join(d.InPlay, ", ")
+	}
+	return text
+}
+
+func deckKey(channelID string) string {
+	return "deck_" + channelID
+}
+
+// getDeck loads the deck of a channel, or returns nil if the channel has none.
+func (p *Plugin) getDeck(channelID string) (*deck, error) {
+	data, appErr := p.API.KVGet(deckKey(channelID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load deck")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	d := &deck{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, errors.Wrap(err, "failed to decode deck")
+	}
+	return d, nil
+}
+
+func (p *Plugin) setDeck(channelID string, d *deck) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode deck")
+	}
+	if appErr := p.API.KVSet(deckKey(channelID), data); appErr != nil {
+		return errors.Wrap(appErr, "failed to save deck")
+	}
+	return nil
+}
+
+// executeDeckCommand handles the `/deck` command.
+func (p *Plugin) executeDeckCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	subcommand, rest := splitFirstWord(query)
+	if subcommand == "" || subcommand == "help" {
+		return ephemeralResponse(deckHelpText), nil
+	}
+
+	p.deckLock.Lock()
+	defer p.deckLock.Unlock()
+
+	d, err := p.getDeck(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the deck of this channel.", err)
+	}
+	if d == nil && subcommand != "new" {
+		return nil, appError("There is no deck in this channel: Use `/deck new standard52|standard54|tarot|custom` first.", nil)
+	}
+
+	var message string
+	switch subcommand {
+	case "new":
+		kind, custom := splitFirstWord(rest)
+		cards, err := newDeckCards(kind, custom)
+		if err != nil {
+			return nil, appError(fmt.Sprintf("%s.", err.Error()), err)
+		}
+		d = &deck{Kind: kind, Pile: cards, InPlay: []string{}, Discard: []string{}}
+		d.shuffle(true, p.newRoller())
+		message = fmt.Sprintf("takes a new shuffled %s deck of %d cards.", kind, len(cards))
+	case "shuffle":
+		all := strings.ToLower(rest) == "all"
+		if rest != "" && !all {
+			return nil, appError("Usage: `/deck shuffle [all]`.", nil)
+		}
+		d.shuffle(all, p.newRoller())
+		message = fmt.Sprintf("shuffles the %s back into the deck: %d cards to draw.", ternaryStr(all, "cards", "discarded cards"), len(d.Pile))
+	case "draw":
+		n, err := parseCardCount(rest)
+		if err != nil {
+			return nil, appError(fmt.Sprintf("%s.", err.Error()), err)
+		}
+		drawn, err := d.draw(n)
+		if err != nil {
+			return nil, appError(fmt.Sprintf("%s.", err.Error()), err)
+		}
+		message = fmt.Sprintf("draws %s (%d left).", strings.Join(drawn, ", "), len(d.Pile))
+	case "discard":
+		message = fmt.Sprintf("discards %d cards.", d.discard())
+	case "peek":
+		n, err := parseCardCount(rest)
+		if err != nil {
+			return nil, appError(fmt.Sprintf("%s.", err.Error()), err)
+		}
+		isGM, err := p.isChannelGM(args.UserId, args.ChannelId)
+		if err != nil {
+			return nil, appError("Cannot load the channel configuration.", err)
+		}
+		if !isGM {
+			return nil, appError("Only the GM of the channel can peek at the deck.", nil)
+		}
+		n = min(n, len(d.Pile))
+		return ephemeralResponse(fmt.Sprintf("The top %d cards of the deck are: %s", n, strings.Join(d.Pile[:n], ", "))), nil
+	case "show":
+		return ephemeralResponse(d.render()), nil
+	default:
+		return nil, appError("Usage: `/deck [new <deck>|shuffle [all]|draw [n]|discard|peek [n]|show]`.", nil)
+	}
+
+	if err = p.setDeck(args.ChannelId, d); err != nil {
+		return nil, appError("Cannot save the deck.", err)
+	}
+	displayName, appErr := p.getDisplayName(args.UserId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if _, appErr = p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: args.ChannelId,
+		RootId:    args.RootId,
+		Message:   fmt.Sprintf("**%s** %s", displayName, message),
+	}); appErr != nil {
+		return nil, appErr
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// Parse the number of cards to draw or peek at, 1 by default.
+func parseCardCount(s string) (int, error) {
+	if s == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxDeckDraw {
+		return 0, fmt.Errorf("expected a number of cards between 1 and %d but got `%s`", maxDeckDraw, s)
+	}
+	return n, nil
+}
+
+const deckHelpText = "Use `/deck` to play with a deck of cards in this channel:\n" +
+	"- `/deck new standard52|standard54|tarot` takes a new shuffled deck: 52 playing cards, 54 with jokers, or the 78 tarot cards.\n" +
+	"- `/deck new custom <card>, <card>, ...` takes a deck of your own cards, e.g. `/deck new custom Sun, Moon, Star, Comet`.\n" +
+	"- `/deck draw [n]` draws the top card, or the top n cards.\n" +
+	"- `/deck discard` puts the cards in play on the discard pile.\n" +
+	"- `/deck shuffle` shuffles the discarded cards back into the deck, and `/deck shuffle all` the cards in play too.\n" +
+	"- `/deck peek [n]` shows the top cards to the GM of the channel only.\n" +
+	"- `/deck show` shows how many cards are left and which are in play."
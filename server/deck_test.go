@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDeckCards(t *testing.T) {
+	for kind, size := range map[string]int{"standard52": 52, "standard54": 54, "tarot": 78} {
+		cards, err := newDeckCards(kind, "")
+		assert.Nil(t, err, kind)
+		assert.Len(t, cards, size, kind)
+	}
+	cards, err := newDeckCards("standard52", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"A♠️", "2♠️"}, cards[:2])
+	assert.Equal(t, "K♣️", cards[51])
+
+	cards, err = newDeckCards("custom", " Sun, Moon,,Star ")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Sun", "Moon", "Star"}, cards)
+
+	for _, custom := range []string{"", " , "} {
+		_, err = newDeckCards("custom", custom)
+		assert.NotNil(t, err)
+	}
+	_, err = newDeckCards("uno", "")
+	assert.NotNil(t, err)
+}
+
+func TestDeckDrawAndShuffle(t *testing.T) {
+	d := &deck{Kind: "custom", Pile: []string{"a", "b", "c", "d"}, InPlay: []string{}, Discard: []string{}}
+	// Always swapping with the first card rotates the cards.
+	d.shuffle(false, fixedRoller(1, 1, 1))
+	assert.Equal(t, []string{"b", "c", "d", "a"}, d.Pile)
+
+	drawn, err := d.draw(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, drawn)
+	_, err = d.draw(2)
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, d.discard())
+	drawn, err = d.draw(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, drawn)
+	assert.Equal(t, "**Deck** (custom): 0 cards to draw, 3 discarded.\nIn play: a", d.render())
+
+	// Shuffling leaves the cards in play, unless shuffling all.
+	d.shuffle(false, fixedRoller(2, 2))
+	assert.ElementsMatch(t, []string{"b", "c", "d"}, d.Pile)
+	assert.Equal(t, []string{"a"}, d.InPlay)
+	d.shuffle(true, fixedRoller(3, 2, 1))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, d.Pile)
+	assert.Empty(t, d.InPlay)
+	assert.Empty(t, d.Discard)
+}
+
+func TestDeckCommand(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		posts = append(posts, post)
+		return post
+	}, nil)
+	api.On("HasPermissionToChannel", "gm", "channel1", model.PermissionManageChannelRoles).Return(true)
+	api.On("HasPermissionToChannel", mock.Anything, mock.Anything, mock.Anything).Return(false)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, command string) (*model.CommandResponse, *model.AppError) {
+		posts = nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: command, UserId: userID, ChannelId: "channel1"})
+	}
+
+	_, err := run("userid", "/deck draw")
+	assert.NotNil(t, err)
+
+	_, err = run("userid", "/deck new custom Sun, Moon, Star")
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, "**User** takes a new shuffled custom deck of 3 cards.", posts[0].Message)
+	}
+
+	response, err := run("gm", "/deck peek 2")
+	assert.Nil(t, err)
+	d, _ := p.getDeck("channel1")
+	assert.Equal(t, "The top 2 cards of the deck are: "+d.Pile[0]+", "+d.Pile[1], response.Text)
+	_, err = run("userid", "/deck peek")
+	assert.NotNil(t, err)
+
+	_, err = run("userid", "/deck draw 2")
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, "**User** draws "+d.Pile[0]+", "+d.Pile[1]+" (1 left).", posts[0].Message)
+	}
+	_, err = run("userid", "/deck draw 2")
+	assert.NotNil(t, err)
+
+	_, err = run("userid", "/deck discard")
+	assert.Nil(t, err)
+	_, err = run("userid", "/deck shuffle")
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, "**User** shuffles the discarded cards back into the deck: 3 cards to draw.", posts[0].Message)
+	}
+
+	for _, command := range []string{"/deck draw 0", "/deck draw 21", "/deck draw many", "/deck shuffle some", "/deck new uno", "/deck flip"} {
+		_, err = run("userid", command)
+		assert.NotNil(t, err, command)
+	}
+
+	response, err = run("userid", "/deck")
+	assert.Nil(t, err)
+	assert.Equal(t, deckHelpText, response.Text)
+}
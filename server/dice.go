@@ -60,8 +60,6 @@ type RollResult struct {
 	order  int // order rolled
 	rank   int // index when sorted by (result, order)
 }
-type Stats struct{}
-type DeathSave struct{}
 type Labeled struct {
 	label string
 }
@@ -113,8 +111,6 @@ func (sp Dice) roll(n Node, roller Roller) NodeSpecialization {
 	})
 	return Dice{n: sp.n, x: sp.x, l: sp.l, h: sp.h, rolls: rolls}
 }
-func (sp Stats) roll(_ Node, _ Roller) NodeSpecialization     { return sp }
-func (sp DeathSave) roll(_ Node, _ Roller) NodeSpecialization { return sp }
 func (sp Labeled) roll(_ Node, _ Roller) NodeSpecialization   { return sp }
 func (sp CommaList) roll(_ Node, _ Roller) NodeSpecialization { return sp }
 
@@ -161,10 +157,6 @@ func (sp Dice) value(_ Node) BR {
 	}
 	return ret
 }
-func (Stats) value(_ Node) BR { return zero }
-func (DeathSave) value(n Node) BR {
-	return n.child[0].value()
-}
 func (sp Labeled) value(n Node) BR {
 	return n.child[0].value()
 }
@@ -270,46 +262,6 @@ func (sp Dice) render(n Node, ind string, rr int, rcok bool, options string) (st
 	}
 	return token, result, detail
 }
-func (sp Stats) render(n Node, ind string, _ int, _ bool, options string) (string, string, string) {
-	intro := "up a new character! Adventure awaits. In the meanwhile, here are your ability scores:"
-	// Extract values and sort them descending
-	values := make([]BR, len(n.child))
-	for i, c := range n.child {
-		values[i] = c.value()
-	}
-	sort.Slice(values, func(i int, j int) bool {
-		return values[j].LessThan(values[i])
-	})
-	// Render the scores
-	scoreText := ""
-	for _, v := range values {
-		scoreText += fmt.Sprintf("%s, ", v.Render(options+"b"))
-	}
-	scoreText = scoreText[:len(scoreText)-2]
-	// Render details
-	details := ""
-	for _, c := range n.child {
-		_, _, detail := c.render(ind, RR_NONE, false, options)
-		details += detail
-	}
-	return fmt.Sprintf("%s\n%s", intro, scoreText), "", details
-}
-func (sp DeathSave) render(n Node, ind string, rr int, _ bool, options string) (string, string, string) {
-	event := ""
-	value := n.value()
-	switch {
-	case value.Equals(one):
-		event = "suffers **A CRITICAL FAIL!** :coffin:"
-	case value.LessThanOrEquals(nine):
-		event = "**FAILS** :skull:"
-	case value.LessThanOrEquals(nineteen):
-		event = "**SUCCEEDS** :thumbsup:"
-	default:
-		event = "**REGAINS 1 HP!** :star-struck:"
-	}
-	_, _, details := n.child[0].render(ind, RR_NONE, false, options)
-	return fmt.Sprintf("a death saving throw, and %s", event), "", details
-}
 func (sp Labeled) render(n Node, ind string, rr int, rcok bool, options string) (string, string, string) {
 	if sp.label == "" {
 		return n.child[0].render(ind, rr, rcok, options)
@@ -377,18 +329,19 @@ func rollCommentSumProd(n Node, conf configuration) string {
 	return ROLL_COMMENT_NOTHING
 }
 func (sp Dice) rollComment(n Node, conf configuration) string {
-	if conf.EnableDnd5e && sp.x == 20 && (sp.h-sp.l) == 1 {
-		if n.value().Equals(twenty) {
-			return " (NAT20! :star-struck:)"
+	if !conf.EnableCritMessages {
+		return ROLL_COMMENT_BLOCK_PARENT
+	}
+	for _, gs := range conf.gameSystems() {
+		if gs.diceRollComment == nil {
+			continue
 		}
-		if n.value().Equals(one) {
-			return " (NAT1! :grimacing:)"
+		if comment := gs.diceRollComment(sp, n); comment != ROLL_COMMENT_NOTHING {
+			return comment
 		}
 	}
 	return ROLL_COMMENT_BLOCK_PARENT
 }
-func (sp Stats) rollComment(n Node, _ configuration) string     { return ROLL_COMMENT_NOTHING }
-func (sp DeathSave) rollComment(n Node, _ configuration) string { return ROLL_COMMENT_NOTHING }
 func (sp Labeled) rollComment(n Node, conf configuration) string {
 	return n.child[0].sp.rollComment(n.child[0], conf)
 }
@@ -399,6 +352,15 @@ func (sp CommaList) rollComment(n Node, conf configuration) string {
 	return ROLL_COMMENT_NOTHING
 }
 
+// Rolled dice
+func (sp Dice) rolledDice() diceRecord {
+	results := make([]int, len(sp.rolls))
+	for i, r := range sp.rolls {
+		results[i] = r.result
+	}
+	return diceRecord{Dice: fmt.Sprintf("d%d", sp.x), Results: results}
+}
+
 // Probability distributions
 func (n Node) prob() PD {
 	return n.sp.prob(n)
@@ -438,12 +400,6 @@ func (sp Prod) prob(n Node) PD {
 func (sp Dice) prob(_ Node) PD {
 	return pd.Dice(sp.n, sp.x, sp.l, sp.n-sp.h)
 }
-func (Stats) prob(n Node) PD {
-	return errPD // todo: maybe list of probs after sorting
-}
-func (DeathSave) prob(n Node) PD {
-	return errPD // todo: maybe constant string.
-}
 func (sp Labeled) prob(n Node) PD {
 	return n.child[0].prob()
 }
@@ -454,3 +410,36 @@ func (sp CommaList) prob(n Node) PD {
 		return errPD // todo: maybe list of probs
 	}
 }
+
+// Outcome analysis
+// Specializations whose outcomes mean more than their numeric value, e.g.
+// success or failure against a target, can implement outcomeAnalyzer to add a
+// summary below the probability table of /analyzeroll.
+type outcomeAnalyzer interface {
+	analyzeOutcomes(n Node, prob PD, options string) string
+}
+type outcomeRow struct {
+	name        string
+	probability BR
+}
+
+func (n Node) analyzeOutcomes(options string) string {
+	if a, ok := n.sp.(outcomeAnalyzer); ok {
+		return a.analyzeOutcomes(n, n.prob(), options)
+	}
+	// Look through nodes that only wrap a single expression.
+	if len(n.child) == 1 {
+		switch n.sp.(type) {
+		case GroupExpr, Sum, Prod, Labeled, CommaList:
+			return n.child[0].analyzeOutcomes(options)
+		}
+	}
+	return ""
+}
+func renderOutcomeTable(header string, rows []outcomeRow, options string) string {
+	table := fmt.Sprintf("\n\n|%s|Chance|\n|-|-|", header)
+	for _, row := range rows {
+		table += fmt.Sprintf("\n|%s|%s|", row.name, row.probability.Render(options+"p"))
+	}
+	return table
+}
@@ -188,7 +188,7 @@ func TestParserGoodInputs(t *testing.T) {
 			render:   "2-3d6÷3 = **-1 1/3**\n- *3d6 (2 3 5) =* ***10***"},
 	}
 	for _, enableDnd := range []bool{false, true} {
-		conf := configuration{EnableDnd5e: enableDnd, EnableLatex: true}
+		conf := configuration{EnableDnd5e: enableDnd, EnableLatex: true, EnableCritMessages: true}
 		parse := GetParser(conf)
 		for _, testCase := range testCases {
 			parsedNode, err := parse(testCase.query)
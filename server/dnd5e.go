@@ -0,0 +1,338 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	. "github.com/vektah/goparsify" //nolint: stylecheck
+)
+
+// DnD 5e: advantage and disadvantage, stats, death saves, crits, and skill checks,
+// saving throws and initiative using character sheets.
+
+//go:embed helptext-dnd5e.md
+var helpTextDnd5e string
+
+var dnd5eSystem = gameSystem{
+	id:              "dnd5e",
+	name:            "DnD 5e",
+	enabled:         func(c *configuration) *bool { return &c.EnableDnd5e },
+	grammar:         dnd5eGrammar,
+	helpText:        helpTextDnd5e,
+	diceRollComment: dnd5eDiceRollComment,
+	commands: map[string]func(query string, sheet *characterSheet) (string, error){
+		"check": dnd5eCheck,
+		"save":  dnd5eSave,
+		"init":  dnd5eInitiative,
+	},
+	macros: macroLibrary{
+		"adv": "d20a advantage",
+		"dis": "d20d disadvantage",
+	},
+}
+
+// Types
+type Stats struct{}
+type DeathSave struct{}
+
+// Grammar
+func dnd5eGrammar(g grammar) gameSystemGrammar {
+	var (
+		advdisDice = Seq(Regex("[Dd]"), g.diceSides, Regex("([AaDd])")).Map(func(r *Result) {
+			x, err := getNatural(r.Child[1])
+			if err != nil {
+				r.Result = err
+				return
+			}
+
+			mode := strings.ToLower(r.Child[2].Token)
+			var l, h int
+			switch {
+			case mode == "a":
+				l, h = 1, 2
+			case mode == "d":
+				l, h = 0, 1
+			default:
+				r.Result = fmt.Errorf("invalid mode in advdisDice: %s", mode)
+				return
+			}
+			r.Token = r.Child[0].Token + r.Child[1].Token + r.Child[2].Token
+			r.Result = makeNode(r.Token, []Result{}, Dice{n: 2, x: x, l: l, h: h})
+		})
+
+		stats = Regex("(?i)stats").Map(func(r *Result) {
+			oneStat := Node{
+				token: "4d6d1",
+				child: []Node{},
+				sp:    Dice{n: 4, x: 6, l: 1, h: 4},
+			}
+			r.Result = Node{
+				token: r.Token,
+				child: []Node{
+					oneStat,
+					oneStat,
+					oneStat,
+					oneStat,
+					oneStat,
+					oneStat,
+				},
+				sp: Stats{},
+			}
+		})
+
+		deathSave = Regex("(?i)death[ -]?save").Map(func(r *Result) {
+			r.Result = Node{
+				token: r.Token,
+				child: []Node{{token: "1d20", child: []Node{}, sp: Dice{n: 1, x: 20, l: 0, h: 1}}},
+				sp:    DeathSave{},
+			}
+		})
+	)
+	return gameSystemGrammar{
+		values:   []Parserish{advdisDice},
+		toplevel: []Parserish{stats, deathSave},
+	}
+}
+
+// Roller
+func (sp Stats) roll(_ Node, _ Roller) NodeSpecialization     { return sp }
+func (sp DeathSave) roll(_ Node, _ Roller) NodeSpecialization { return sp }
+
+// Evaluate
+func (Stats) value(_ Node) BR { return zero }
+func (DeathSave) value(n Node) BR {
+	return n.child[0].value()
+}
+
+// Render
+func (sp Stats) render(n Node, ind string, _ int, _ bool, options string) (string, string, string) {
+	intro := "up a new character! Adventure awaits. In the meanwhile, here are your ability scores:"
+	// Extract values and sort them descending
+	values := make([]BR, len(n.child))
+	for i, c := range n.child {
+		values[i] = c.value()
+	}
+	sort.Slice(values, func(i int, j int) bool {
+		return values[j].LessThan(values[i])
+	})
+	// Render the scores
+	scoreText := ""
+	for _, v := range values {
+		scoreText += fmt.Sprintf("%s, ", v.Render(options+"b"))
+	}
+	scoreText = scoreText[:len(scoreText)-2]
+	// Render details
+	details := ""
+	for _, c := range n.child {
+		_, _, detail := c.render(ind, RR_NONE, false, options)
+		details += detail
+	}
+	return fmt.Sprintf("%s\n%s", intro, scoreText), "", details
+}
+func (sp DeathSave) render(n Node, ind string, rr int, _ bool, options string) (string, string, string) {
+	event := ""
+	value := n.value()
+	switch {
+	case value.Equals(one):
+		event = "suffers **A CRITICAL FAIL!** :coffin:"
+	case value.LessThanOrEquals(nine):
+		event = "**FAILS** :skull:"
+	case value.LessThanOrEquals(nineteen):
+		event = "**SUCCEEDS** :thumbsup:"
+	default:
+		event = "**REGAINS 1 HP!** :star-struck:"
+	}
+	_, _, details := n.child[0].render(ind, RR_NONE, false, options)
+	return fmt.Sprintf("a death saving throw, and %s", event), "", details
+}
+
+// roll comment
+func (sp Stats) rollComment(n Node, _ configuration) string     { return ROLL_COMMENT_NOTHING }
+func (sp DeathSave) rollComment(n Node, _ configuration) string { return ROLL_COMMENT_NOTHING }
+
+// Comment on a natural 1 or 20 when a single d20 is kept.
+func dnd5eDiceRollComment(sp Dice, n Node) string {
+	if sp.x == 20 && (sp.h-sp.l) == 1 {
+		if n.value().Equals(twenty) {
+			return " (NAT20! :star-struck:)"
+		}
+		if n.value().Equals(one) {
+			return " (NAT1! :grimacing:)"
+		}
+	}
+	return ROLL_COMMENT_NOTHING
+}
+
+// Probability distributions
+func (Stats) prob(n Node) PD {
+	return errPD // todo: maybe list of probs after sorting
+}
+func (DeathSave) prob(n Node) PD {
+	return errPD // todo: maybe constant string.
+}
+
+// Skill checks, saving throws and initiative
+// These build a roll expression from the character sheet values:
+// - the ability modifier, e.g. `dex`, or else the ability score, e.g. `dex_score`,
+// - the proficiency bonus `prof`, or else the character `level`,
+// - the proficiency in a skill, e.g. `stealth_prof`, 1 for proficiency and 2 for expertise,
+// - the proficiency in a saving throw, e.g. `dex_save_prof`,
+// - an extra initiative bonus `init`.
+var dnd5eAbilities = map[string]string{
+	"str": "Strength",
+	"dex": "Dexterity",
+	"con": "Constitution",
+	"int": "Intelligence",
+	"wis": "Wisdom",
+	"cha": "Charisma",
+}
+
+type dnd5eSkill struct {
+	name    string
+	ability string
+}
+
+var dnd5eSkills = map[string]dnd5eSkill{
+	"acrobatics":      {name: "Acrobatics", ability: "dex"},
+	"animal_handling": {name: "Animal Handling", ability: "wis"},
+	"arcana":          {name: "Arcana", ability: "int"},
+	"athletics":       {name: "Athletics", ability: "str"},
+	"deception":       {name: "Deception", ability: "cha"},
+	"history":         {name: "History", ability: "int"},
+	"insight":         {name: "Insight", ability: "wis"},
+	"intimidation":    {name: "Intimidation", ability: "cha"},
+	"investigation":   {name: "Investigation", ability: "int"},
+	"medicine":        {name: "Medicine", ability: "wis"},
+	"nature":          {name: "Nature", ability: "int"},
+	"perception":      {name: "Perception", ability: "wis"},
+	"performance":     {name: "Performance", ability: "cha"},
+	"persuasion":      {name: "Persuasion", ability: "cha"},
+	"religion":        {name: "Religion", ability: "int"},
+	"sleight_of_hand": {name: "Sleight of Hand", ability: "dex"},
+	"stealth":         {name: "Stealth", ability: "dex"},
+	"survival":        {name: "Survival", ability: "wis"},
+}
+
+// `/roll check <skill or ability> [adv|dis]`
+func dnd5eCheck(query string, sheet *characterSheet) (string, error) {
+	words, d20 := dnd5eAdvantage(strings.Fields(strings.ToLower(query)))
+	key := strings.Join(words, "_")
+	if skill, ok := dnd5eSkills[key]; ok {
+		modifier, err := dnd5eAbilityModifier(sheet, skill.ability)
+		if err != nil {
+			return "", err
+		}
+		proficiency, err := dnd5eProficiency(sheet, sheet.Values[key+"_prof"])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s%s%s %s check", d20, modifier, proficiency, skill.name), nil
+	}
+	if ability, ok := dnd5eAbility(key); ok {
+		modifier, err := dnd5eAbilityModifier(sheet, ability)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s%s %s check", d20, modifier, dnd5eAbilities[ability]), nil
+	}
+	return "", fmt.Errorf("unknown skill or ability `%s`", strings.Join(words, " "))
+}
+
+// `/roll save <ability> [adv|dis]`
+func dnd5eSave(query string, sheet *characterSheet) (string, error) {
+	words, d20 := dnd5eAdvantage(strings.Fields(strings.ToLower(query)))
+	ability, ok := dnd5eAbility(strings.Join(words, "_"))
+	if !ok {
+		return "", fmt.Errorf("unknown ability `%s`", strings.Join(words, " "))
+	}
+	modifier, err := dnd5eAbilityModifier(sheet, ability)
+	if err != nil {
+		return "", err
+	}
+	proficiency, err := dnd5eProficiency(sheet, sheet.Values[ability+"_save_prof"])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s%s %s saving throw", d20, modifier, proficiency, dnd5eAbilities[ability]), nil
+}
+
+// `/roll init [adv|dis]`
+func dnd5eInitiative(query string, sheet *characterSheet) (string, error) {
+	words, d20 := dnd5eAdvantage(strings.Fields(strings.ToLower(query)))
+	if len(words) > 0 {
+		return "", fmt.Errorf("expected `adv` or `dis` but got `%s`", strings.Join(words, " "))
+	}
+	modifier, err := dnd5eAbilityModifier(sheet, "dex")
+	if err != nil {
+		return "", err
+	}
+	if _, ok := sheet.Values["init"]; ok {
+		modifier += "+$init"
+	}
+	return fmt.Sprintf("%s%s Initiative", d20, modifier), nil
+}
+
+// Remove a trailing advantage or disadvantage from the words of a command, and return
+// the d20 roll to use.
+func dnd5eAdvantage(words []string) ([]string, string) {
+	if len(words) > 0 {
+		switch words[len(words)-1] {
+		case "adv", "advantage":
+			return words[:len(words)-1], "d20a"
+		case "dis", "disadvantage":
+			return words[:len(words)-1], "d20d"
+		}
+	}
+	return words, "d20"
+}
+
+// Return the abbreviation of an ability given by abbreviation or full name.
+func dnd5eAbility(s string) (string, bool) {
+	for ability, name := range dnd5eAbilities {
+		if s == ability || s == strings.ToLower(name) {
+			return ability, true
+		}
+	}
+	return "", false
+}
+
+// Return the term adding the ability modifier to a roll expression.
+func dnd5eAbilityModifier(sheet *characterSheet, ability string) (string, error) {
+	if sheet == nil {
+		return "", fmt.Errorf("no character sheet: Use `/roll sheet set <name> <value>` to create one")
+	}
+	if _, ok := sheet.Values[ability]; ok {
+		return "+$" + ability, nil
+	}
+	if score, ok := sheet.Values[ability+"_score"]; ok {
+		return dnd5eTerm(int(math.Floor(float64(score-10) / 2))), nil
+	}
+	return "", fmt.Errorf("no value `%s` or `%s_score` on your character sheet", ability, ability)
+}
+
+// Return the term adding a multiple of the proficiency bonus to a roll expression.
+func dnd5eProficiency(sheet *characterSheet, multiplier int) (string, error) {
+	if multiplier == 0 {
+		return "", nil
+	}
+	if _, ok := sheet.Values["prof"]; ok {
+		if multiplier == 1 {
+			return "+$prof", nil
+		}
+		return fmt.Sprintf("+%d*$prof", multiplier), nil
+	}
+	if level, ok := sheet.Values["level"]; ok && level >= 1 {
+		return dnd5eTerm(multiplier * (2 + (level-1)/4)), nil
+	}
+	return "", fmt.Errorf("no value `prof` or `level` on your character sheet")
+}
+
+func dnd5eTerm(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%+d", n)
+}
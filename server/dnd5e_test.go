@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDnd5eSheetCommands(t *testing.T) {
+	sheet := &characterSheet{Name: "Aria", Values: map[string]int{
+		"dex":           3,
+		"wis_score":     13,
+		"str_score":     7,
+		"prof":          2,
+		"stealth_prof":  2,
+		"insight_prof":  1,
+		"dex_save_prof": 1,
+	}}
+	leveled := &characterSheet{Name: "Bram", Values: map[string]int{
+		"dex":          0,
+		"level":        5,
+		"stealth_prof": 1,
+		"init":         5,
+	}}
+
+	for _, testCase := range []struct {
+		command  func(query string, sheet *characterSheet) (string, error)
+		query    string
+		sheet    *characterSheet
+		expected string
+	}{
+		{command: dnd5eCheck, query: "stealth", sheet: sheet, expected: "d20+$dex+2*$prof Stealth check"},
+		{command: dnd5eCheck, query: "Insight adv", sheet: sheet, expected: "d20a+1+$prof Insight check"},
+		{command: dnd5eCheck, query: "sleight of hand dis", sheet: sheet, expected: "d20d+$dex Sleight of Hand check"},
+		{command: dnd5eCheck, query: "strength", sheet: sheet, expected: "d20-2 Strength check"},
+		{command: dnd5eCheck, query: "stealth", sheet: leveled, expected: "d20+$dex+3 Stealth check"},
+		{command: dnd5eSave, query: "dex", sheet: sheet, expected: "d20+$dex+$prof Dexterity saving throw"},
+		{command: dnd5eSave, query: "wisdom advantage", sheet: sheet, expected: "d20a+1 Wisdom saving throw"},
+		{command: dnd5eInitiative, query: "", sheet: sheet, expected: "d20+$dex Initiative"},
+		{command: dnd5eInitiative, query: "adv", sheet: leveled, expected: "d20a+$dex+$init Initiative"},
+	} {
+		expr, err := testCase.command(testCase.query, testCase.sheet)
+		assert.Nil(t, err, testCase.query)
+		assert.Equal(t, testCase.expected, expr, testCase.query)
+	}
+
+	for _, testCase := range []struct {
+		command func(query string, sheet *characterSheet) (string, error)
+		query   string
+		sheet   *characterSheet
+	}{
+		{command: dnd5eCheck, query: "stealth", sheet: nil},
+		{command: dnd5eCheck, query: "cooking", sheet: sheet},
+		{command: dnd5eCheck, query: "arcana", sheet: sheet},
+		{command: dnd5eSave, query: "luck", sheet: sheet},
+		{command: dnd5eInitiative, query: "now", sheet: sheet},
+		{command: dnd5eCheck, query: "stealth", sheet: &characterSheet{Values: map[string]int{"dex": 1, "stealth_prof": 1}}},
+	} {
+		_, err := testCase.command(testCase.query, testCase.sheet)
+		assert.NotNil(t, err, testCase.query)
+	}
+}
+
+func TestDnd5eSheetCommandsDispatch(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	})
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", TeamId: "team1"}, nil)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(command string) (*model.CommandResponse, *model.AppError) {
+		posts = nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    "userid",
+			ChannelId: "channel1",
+		})
+	}
+
+	_, err := run("/roll sheet import {\"values\": {\"wis\": 2, \"prof\": 3, \"wis_save_prof\": 1}}")
+	assert.Nil(t, err)
+	_, err = run("/roll save wis adv")
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 1) {
+		// A natural 1 or 20 adds a crit comment.
+		assert.Regexp(t, "^\\*\\*User\\*\\* rolls d20a\\+wis\\(2\\)\\+prof\\(3\\) = \\*\\*\\d+\\*\\* Wisdom saving throw( \\(NAT(1|20)! :[a-z-]+:\\))?\\n- \\*d20a ", posts[0].Message)
+	}
+
+	// `/roll save @name` still saves macros.
+	resp, err := run("/roll save @wis 1d20+$wis")
+	assert.Nil(t, err)
+	assert.Equal(t, "Saved user macro `@wis`: `1d20+$wis`", resp.Text)
+
+	// Without DnD 5e, there are no saving throws.
+	p.configuration.EnableDnd5e = false
+	_, err = run("/roll save wis")
+	assert.NotNil(t, err)
+	_, err = run("/roll check stealth")
+	assert.NotNil(t, err)
+}
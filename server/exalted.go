@@ -0,0 +1,184 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/vektah/goparsify" //nolint: stylecheck
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/pd"
+)
+
+// Exalted and other Storyteller games: pools of d10 counting successes.
+
+//go:embed helptext-exalted.md
+var helpTextExalted string
+
+var exaltedSystem = gameSystem{
+	id:       "exalted",
+	name:     "Exalted",
+	enabled:  func(c *configuration) *bool { return &c.EnableExalted },
+	grammar:  exaltedGrammar,
+	helpText: helpTextExalted,
+}
+
+// Types
+type Exalted struct {
+	n      int   // number of dice in the pool
+	target int   // lowest result counting as a success
+	double int   // lowest result counting as two successes
+	rolls  []int // roll results
+}
+
+const maxExaltedPool = 100
+
+func (sp Exalted) successes() int {
+	ret := 0
+	for _, r := range sp.rolls {
+		switch {
+		case r >= sp.double:
+			ret += 2
+		case r >= sp.target:
+			ret++
+		}
+	}
+	return ret
+}
+
+// A botch is a roll with no successes and at least one 1.
+func (sp Exalted) botched() bool {
+	if sp.successes() != 0 {
+		return false
+	}
+	for _, r := range sp.rolls {
+		if r == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Grammar
+func exaltedGrammar(g grammar) gameSystemGrammar {
+	var (
+		exalted = Seq(Regex("(?i)exalted +"), g.natural, Maybe(Regex(" +(?i:target|tn) +(10|[1-9])")), Maybe(Regex(" +(?i:double) +(10|[1-9])"))).Map(func(r *Result) {
+			n, err := getNatural(r.Child[1])
+			if err != nil {
+				r.Result = err
+				return
+			}
+			if n > maxExaltedPool {
+				r.Result = fmt.Errorf("pool too large: %d", n)
+				return
+			}
+			sp := Exalted{n: n, target: 7, double: 10}
+			if r.Child[2].Token != "" {
+				fields := strings.Fields(r.Child[2].Token)
+				sp.target, _ = strconv.Atoi(fields[1])
+			}
+			if r.Child[3].Token != "" {
+				fields := strings.Fields(r.Child[3].Token)
+				sp.double, _ = strconv.Atoi(fields[1])
+			}
+			if sp.target < 2 || sp.double < sp.target {
+				r.Result = fmt.Errorf("invalid target %d and double %d: need 2 <= target <= double", sp.target, sp.double)
+				return
+			}
+			r.Token = r.Child[0].Token + r.Child[1].Token + r.Child[2].Token + r.Child[3].Token
+			r.Result = makeNode(r.Token, []Result{}, sp)
+		})
+	)
+	return gameSystemGrammar{
+		toplevel: []Parserish{exalted},
+	}
+}
+
+// Roller
+func (sp Exalted) roll(_ Node, roller Roller) NodeSpecialization {
+	rolls := make([]int, sp.n)
+	for i := range rolls {
+		rolls[i] = roller(10)
+	}
+	return Exalted{n: sp.n, target: sp.target, double: sp.double, rolls: rolls}
+}
+
+// Evaluate
+func (sp Exalted) value(_ Node) BR { return itobr(sp.successes()) }
+
+// Render
+// Each die is marked by category: double successes in bold, successes plain,
+// failures struck through and ones struck through in bold.
+func (sp Exalted) render(n Node, ind string, _ int, _ bool, options string) (string, string, string) {
+	rollStrs := make([]string, len(sp.rolls))
+	for i, r := range sp.rolls {
+		switch {
+		case r >= sp.double:
+			rollStrs[i] = fmt.Sprintf("**%d**", r)
+		case r >= sp.target:
+			rollStrs[i] = fmt.Sprintf("%d", r)
+		case r == 1:
+			rollStrs[i] = "~~**1**~~"
+		default:
+			rollStrs[i] = fmt.Sprintf("~~%d~~", r)
+		}
+	}
+	intro := fmt.Sprintf("Exalted %d dice (target %d, double %d)", sp.n, sp.target, sp.double)
+	successes := sp.successes()
+	event := ""
+	switch {
+	case sp.botched():
+		event = "**BOTCHES!** :boom:"
+	case successes == 1:
+		event = "gets **1** success"
+	default:
+		event = fmt.Sprintf("gets **%d** successes", successes)
+	}
+	details := fmt.Sprintf("\n%s*%dd10 (%s) =* %s", ind, sp.n, strings.Join(rollStrs, " "), n.value().Render(options+"ib"))
+	return fmt.Sprintf("%s and %s", intro, event), "", details
+}
+
+// roll comment
+func (sp Exalted) rollComment(_ Node, _ configuration) string { return ROLL_COMMENT_NOTHING }
+
+// Rolled dice
+func (sp Exalted) rolledDice() diceRecord {
+	return diceRecord{Dice: "d10", Results: append([]int{}, sp.rolls...)}
+}
+
+// Probability distributions
+func (sp Exalted) prob(_ Node) PD {
+	ten := itobr(10)
+	oneDie := pd.LinearCombination([]pd.LCTerm{
+		{PD: zeroPD, Coeff: itobr(sp.target - 1).Div(ten)},
+		{PD: onePD, Coeff: itobr(sp.double - sp.target).Div(ten)},
+		{PD: pd.Constant(itobr(2)), Coeff: itobr(11 - sp.double).Div(ten)},
+	})
+	// Add up the dice by repeated doubling.
+	ret := zeroPD
+	for i := sp.n; i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ret = ret.Plus(oneDie)
+		}
+		if i > 1 {
+			oneDie = oneDie.Plus(oneDie)
+		}
+	}
+	return ret
+}
+
+// Outcome analysis
+func (sp Exalted) analyzeOutcomes(_ Node, prob PD, options string) string {
+	ten := itobr(10)
+	nofDice := itobr(sp.n)
+	// Every die fails, minus the cases where no die shows a 1.
+	allFail := itobr(sp.target - 1).Div(ten).Pow(nofDice)
+	allFailNoOnes := itobr(sp.target - 2).Div(ten).Pow(nofDice)
+	botch := allFail.Minus(allFailNoOnes)
+	return renderOutcomeTable("Outcome", []outcomeRow{
+		{"Botch", botch},
+		{"Failure", prob.Get(zero).Minus(botch)},
+		{"Success", one.Minus(prob.Get(zero))},
+	}, options)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExaltedRolls(t *testing.T) {
+	testCases := []struct {
+		query    string
+		rolls    []int
+		expected string
+		render   string
+	}{
+		{query: "exalted 5",
+			rolls:    []int{10, 7, 3, 1, 8},
+			expected: "4",
+			render:   "Exalted 5 dice (target 7, double 10) and gets **4** successes\n- *5d10 (**10** 7 ~~3~~ ~~**1**~~ 8) =* ***4***"},
+		{query: "Exalted 8 double 10",
+			rolls:    []int{2, 5, 6, 1, 3, 7, 4, 2},
+			expected: "1",
+			render:   "Exalted 8 dice (target 7, double 10) and gets **1** success\n- *8d10 (~~2~~ ~~5~~ ~~6~~ ~~**1**~~ ~~3~~ 7 ~~4~~ ~~2~~) =* ***1***"},
+		{query: "exalted 3 target 6 double 9",
+			rolls:    []int{6, 9, 10},
+			expected: "5",
+			render:   "Exalted 3 dice (target 6, double 9) and gets **5** successes\n- *3d10 (6 **9** **10**) =* ***5***"},
+		{query: "exalted 3",
+			rolls:    []int{1, 4, 6},
+			expected: "0",
+			render:   "Exalted 3 dice (target 7, double 10) and **BOTCHES!** :boom:\n- *3d10 (~~**1**~~ ~~4~~ ~~6~~) =* ***0***"},
+		{query: "exalted 2",
+			rolls:    []int{2, 6},
+			expected: "0",
+			render:   "Exalted 2 dice (target 7, double 10) and gets **0** successes\n- *2d10 (~~2~~ ~~6~~) =* ***0***"},
+	}
+	conf := configuration{EnableExalted: true}
+	parse := GetParser(conf)
+	for _, testCase := range testCases {
+		message := "Testing case " + testCase.query
+		parsedNode, err := parse(testCase.query)
+		assert.Nil(t, err, message)
+		if err != nil {
+			continue
+		}
+		rollerIdx := 0
+		roller := func(x int) int {
+			assert.Equal(t, 10, x, message)
+			ret := testCase.rolls[rollerIdx]
+			rollerIdx++
+			return ret
+		}
+		rolledNode := parsedNode.roll(roller, conf)
+		assert.Equal(t, len(testCase.rolls), rollerIdx, message)
+		assert.Equal(t, testCase.expected, rolledNode.value().Render(""), message)
+		assert.Equal(t, testCase.render, rolledNode.renderToplevel(""), message)
+	}
+
+	for _, query := range []string{"exalted 0", "exalted 101", "exalted 5 target 1", "exalted 5 target 8 double 7", "exalted"} {
+		_, err := parse(query)
+		assert.NotNil(t, err, "Testing bad case "+query)
+	}
+	_, err := GetParser(configuration{})("exalted 5")
+	assert.NotNil(t, err, "Exalted disabled")
+}
+
+func TestExaltedAnalyze(t *testing.T) {
+	parse := GetParser(configuration{EnableExalted: true})
+
+	node, err := parse("exalted 1")
+	assert.Nil(t, err)
+	prob := node.prob()
+	assert.Equal(t, "3/5", prob.Get(zero).String())
+	assert.Equal(t, "3/10", prob.Get(one).String())
+	assert.Equal(t, "1/10", prob.Get(itobr(2)).String())
+
+	node, err = parse("exalted 2 target 6 double 9")
+	assert.Nil(t, err)
+	prob = node.prob()
+	// Per die: 1/2 fail, 3/10 success, 1/5 double.
+	assert.Equal(t, "1/4", prob.Get(zero).String())
+	assert.Equal(t, "3/10", prob.Get(one).String())
+	assert.Equal(t, "29/100", prob.Get(itobr(2)).String())
+	assert.Equal(t, "3/25", prob.Get(itobr(3)).String())
+	assert.Equal(t, "1/25", prob.Get(itobr(4)).String())
+	assert.Equal(t, "\n\n|Outcome|Chance|\n|-|-|"+
+		"\n|Botch|9 %|"+
+		"\n|Failure|16 %|"+
+		"\n|Success|75 %|", node.analyzeOutcomes(""))
+
+	// Large pools are computed exactly.
+	node, err = parse("exalted 100")
+	assert.Nil(t, err)
+	assert.Equal(t, "50", node.prob().ExpectedValue().Render(""))
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// Provably fair rolls: the plugin commits to a secret server seed for each UTC day by
+// publishing its SHA-256, and derives the dice of each fair roll from the seed, a nonce
+// and a counter. Once the day is over, the seed is published and anyone can check the
+// rolls of that day.
+//
+// The n-th 64 bit value of a roll is the first 8 bytes, big endian, of
+// HMAC-SHA256(seed, "<nonce>:<n>"), with n starting at 0. Dice are rolled from these
+// values by rejection sampling, as with the other generators.
+//
+// The nonce is chosen by the user with `--nonce`. Otherwise it is
+// "<channel ID>.<user ID>.<n>" for the n-th fair roll of the user in the channel that
+// day, starting at 1, so that the server cannot pick it: a missing or repeated number
+// shows in the channel.
+
+const (
+	// Post prop holding the proof of a fair roll.
+	fairRollProp  = "dice_fair"
+	nonceFlag     = "--nonce"
+	maxNonceSize  = 64
+	fairDayFormat = "2006-01-02"
+	// Nonces chosen by users, and the fair roll counts, are kept until their day is over
+	// everywhere.
+	fairNonceExpirySeconds = 2 * 24 * 60 * 60
+	// Separates the parts of the nonces chosen by the server, and so cannot be used in
+	// the nonces chosen by users.
+	fairNonceSeparator  = "."
+	maxFairCountRetries = 10
+)
+
+// fairRoll is the proof of a fair roll: what is needed to roll its dice again.
+type fairRoll struct {
+	Day   string `json:"day"`
+	Hash  string `json:"seed_hash"`
+	Nonce string `json:"nonce"`
+	// Each call to the roller, in order.
+	Draws []fairDraw `json:"draws"`
+	// The result shown in the post, before the proof and any other text is added.
+	Result string `json:"result"`
+}
+
+type fairDraw struct {
+	Sides  int `json:"sides"`
+	Result int `json:"result"`
+}
+
+func fairSeedKey(day string) string {
+	return "fairseed_" + day
+}
+
+func fairSeedHash(seed string) string {
+	hash := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(hash[:])
+}
+
+func fairToday() string {
+	return time.Now().UTC().Format(fairDayFormat)
+}
+
+// fairSource returns the 64 bit values of a fair roll.
+func fairSource(seed, nonce string) func() uint64 {
+	counter := 0
+	return func() uint64 {
+		mac := hmac.New(sha256.New, []byte(seed))
+		mac.Write([]byte(nonce + ":" + strconv.Itoa(counter)))
+		counter++
+		return binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+	}
+}
+
+// fairRoller returns a roller deriving its rolls from a seed and a nonce, recording them
+// in the proof.
+func fairRoller(seed string, proof *fairRoll) Roller {
+	next := fairSource(seed, proof.Nonce)
+	return func(x int) int {
+		result := uniformRoll(next, x)
+		proof.Draws = append(proof.Draws, fairDraw{Sides: x, Result: result})
+		return result
+	}
+}
+
+// getFairSeed loads the seed of a day, creating it if asked to. It returns "" for a day
+// without seed.
+func (p *Plugin) getFairSeed(day string, create bool) (string, error) {
+	data, appErr := p.API.KVGet(fairSeedKey(day))
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "failed to load the server seed")
+	}
+	if data != nil || !create {
+		return string(data), nil
+	}
+	seedBytes := make([]byte, 32)
+	if _, err := rand.Read(seedBytes); err != nil {
+		return "", errors.Wrap(err, "failed to generate a server seed")
+	}
+	seed := hex.EncodeToString(seedBytes)
+	ok, appErr := p.API.KVCompareAndSet(fairSeedKey(day), nil, []byte(seed))
+	if appErr != nil {
+		return "", errors.Wrap(appErr, "failed to save the server seed")
+	}
+	if !ok {
+		// Another roll created the seed first.
+		return p.getFairSeed(day, false)
+	}
+	return seed, nil
+}
+
+func fairNonceKey(day, nonce string) string {
+	return "fairnonce_" + day + "_" + nonce
+}
+
+// useFairNonce marks a nonce chosen by a user as used on a day, returning false if it
+// already was. Otherwise, a user could try nonces until one rolls well, and then roll
+// with it again.
+func (p *Plugin) useFairNonce(day, nonce string) (bool, error) {
+	ok, appErr := p.API.KVSetWithOptions(fairNonceKey(day, nonce), []byte{1}, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: fairNonceExpirySeconds,
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to save the nonce")
+	}
+	return ok, nil
+}
+
+func fairCountKey(day, channelID, userID string) string {
+	return "faircount_" + day + "_" + channelID + "_" + userID
+}
+
+// nextFairCount returns the number of the next fair roll of a user in a channel on a
+// day, starting at 1.
+func (p *Plugin) nextFairCount(day, channelID, userID string) (int, error) {
+	key := fairCountKey(day, channelID, userID)
+	for i := 0; i < maxFairCountRetries; i++ {
+		data, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return 0, errors.Wrap(appErr, "failed to load the fair roll count")
+		}
+		count := 0
+		if data != nil {
+			var err error
+			if count, err = strconv.Atoi(string(data)); err != nil {
+				return 0, errors.Wrap(err, "failed to parse the fair roll count")
+			}
+		}
+		count++
+		ok, appErr := p.API.KVSetWithOptions(key, []byte(strconv.Itoa(count)), model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        data,
+			ExpireInSeconds: fairNonceExpirySeconds,
+		})
+		if appErr != nil {
+			return 0, errors.Wrap(appErr, "failed to save the fair roll count")
+		}
+		if ok {
+			return count, nil
+		}
+	}
+	return 0, errors.New("too many concurrent fair rolls")
+}
+
+// publicRoller returns the roller of a public roll by a user in a channel. In channels
+// with fair rolls, or when a nonce is given, it is a fair roller, along with the proof to
+// add to the post once rolled.
+func (p *Plugin) publicRoller(conf configuration, userID, channelID, nonce string) (Roller, *fairRoll, error) {
+	if !conf.EnableFairRolls && nonce == "" {
+		return p.newRoller(), nil, nil
+	}
+	day := fairToday()
+	if nonce == "" {
+		count, err := p.nextFairCount(day, channelID, userID)
+		if err != nil {
+			return nil, nil, err
+		}
+		nonce = strings.Join([]string{channelID, userID, strconv.Itoa(count)}, fairNonceSeparator)
+	}
+	seed, err := p.getFairSeed(day, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof := &fairRoll{Day: day, Hash: fairSeedHash(seed), Nonce: nonce, Draws: []fairDraw{}}
+	return fairRoller(seed, proof), proof, nil
+}
+
+// addToPost adds the proof of a fair roll to its post. It does nothing for other rolls.
+func (proof *fairRoll) addToPost(post *model.Post) {
+	if proof == nil {
+		return
+	}
+	proof.Result = post.Message
+	post.Message += fmt.Sprintf("\n*Provably fair roll with nonce `%s` and the server seed of %s, of hash `%s`. Check it with `/roll verify <link to this post>` once the day is over (UTC).*", proof.Nonce, proof.Day, proof.Hash)
+	addStructuredProp(post, fairRollProp, proof)
+}
+
+// executeNonceRoll handles `/roll --nonce <nonce> expression`: a fair roll with a nonce
+// chosen by the user.
+func (p *Plugin) executeNonceRoll(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	nonce, query := splitFirstWord(query)
+	if nonce == "" || query == "" {
+		return nil, appError(fmt.Sprintf("Expected a nonce and a roll expression, like `/roll %s mynonce 1d20`.", nonceFlag), nil)
+	}
+	if len(nonce) > maxNonceSize {
+		return nil, appError(fmt.Sprintf("The nonce cannot be longer than %d characters.", maxNonceSize), nil)
+	}
+	if strings.Contains(nonce, fairNonceSeparator) {
+		return nil, appError(fmt.Sprintf("The nonce cannot contain `%s`.", fairNonceSeparator), nil)
+	}
+	roller, proof, err := p.publicRoller(conf, args.UserId, args.ChannelId, nonce)
+	if err != nil {
+		return nil, appError("Cannot load the server seed.", err)
+	}
+	ok, err := p.useFairNonce(proof.Day, nonce)
+	if err != nil {
+		return nil, appError("Cannot save the nonce.", err)
+	}
+	if !ok {
+		return nil, appError(fmt.Sprintf("The nonce `%s` was already used today (UTC): Choose another one.", nonce), nil)
+	}
+	post, rolled, appErr := p.generateDiceRoll(query, args.UserId, args.ChannelId, args.RootId, roller, conf)
+	if appErr != nil {
+		return nil, appErr
+	}
+	proof.addToPost(post)
+	if _, appErr := p.createRollPost(post, rolled, query, args.UserId); appErr != nil {
+		return nil, appErr
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// executeFairSeedCommand handles `/roll fair [YYYY-MM-DD]`: it shows the hash of the
+// server seed of today, or the seed of a past day.
+func (p *Plugin) executeFairSeedCommand(query string) (*model.CommandResponse, *model.AppError) {
+	today := fairToday()
+	day := strings.TrimSpace(query)
+	if day == "" {
+		day = today
+	}
+	if _, err := time.Parse(fairDayFormat, day); err != nil {
+		return nil, appError(fmt.Sprintf("Expected a day like `%s` but got `%s`.", today, day), err)
+	}
+	if day >= today {
+		if day > today {
+			return ephemeralResponse(fmt.Sprintf("The server seed of %s is not chosen yet.", day)), nil
+		}
+		seed, err := p.getFairSeed(day, true)
+		if err != nil {
+			return nil, appError("Cannot load the server seed.", err)
+		}
+		return ephemeralResponse(fmt.Sprintf("The server seed of %s has hash `%s`. It will be published once the day is over (UTC).", day, fairSeedHash(seed))), nil
+	}
+	seed, err := p.getFairSeed(day, false)
+	if err != nil {
+		return nil, appError("Cannot load the server seed.", err)
+	}
+	if seed == "" {
+		return ephemeralResponse(fmt.Sprintf("There were no fair rolls on %s.", day)), nil
+	}
+	return ephemeralResponse(fmt.Sprintf("The server seed of %s is `%s`, of hash `%s`.", day, seed, fairSeedHash(seed))), nil
+}
+
+// Return the ID of a post from its ID or its permalink.
+func parsePostReference(ref string) string {
+	ref = strings.TrimRight(strings.TrimSpace(ref), "/")
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// executeVerifyCommand handles `/roll verify <post>`: it rolls the dice of a fair roll
+// again from the published seed, and checks that they are the same.
+func (p *Plugin) executeVerifyCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	postID := parsePostReference(query)
+	if postID == "" {
+		return nil, appError("Expected the link or ID of a fair roll post, like `/roll verify <link>`.", nil)
+	}
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		return nil, appError("Cannot find this post.", appErr)
+	}
+	if !p.API.HasPermissionToChannel(args.UserId, post.ChannelId, model.PermissionReadChannel) {
+		return nil, appError("Cannot find this post.", nil)
+	}
+	proof := &fairRoll{}
+	data, err := json.Marshal(post.GetProp(fairRollProp))
+	if err == nil {
+		err = json.Unmarshal(data, proof)
+	}
+	// Users can add any props to their own posts: only the rolls of the bot count.
+	if err != nil || proof.Day == "" || post.UserId != p.diceBotID {
+		return nil, appError("This post is not a fair roll.", err)
+	}
+
+	text := fmt.Sprintf("Fair roll with nonce `%s` and the server seed of %s, of hash `%s`.", proof.Nonce, proof.Day, proof.Hash)
+	if proof.Day >= fairToday() {
+		return ephemeralResponse(text + " The seed will be published once the day is over (UTC): verify the roll again then."), nil
+	}
+	seed, err := p.getFairSeed(proof.Day, false)
+	if err != nil {
+		return nil, appError("Cannot load the server seed.", err)
+	}
+	if seed == "" || fairSeedHash(seed) != proof.Hash {
+		return ephemeralResponse(text + "\n\n:x: The server seed of that day does not match the hash."), nil
+	}
+	text += fmt.Sprintf(" The server seed is `%s`.", seed)
+	if proof.Result == "" || !strings.Contains(post.Message, proof.Result) {
+		return ephemeralResponse(text + "\n\n:x: The post does not show the result of the roll."), nil
+	}
+
+	next := fairSource(seed, proof.Nonce)
+	rolls := []string{}
+	for _, draw := range proof.Draws {
+		if draw.Sides < 1 {
+			return ephemeralResponse(text + "\n\n:x: The roll has an invalid die."), nil
+		}
+		if result := uniformRoll(next, draw.Sides); result != draw.Result {
+			return ephemeralResponse(text + fmt.Sprintf("\n\n:x: Die %d is a d%d that should have rolled %d but rolled %d.", len(rolls)+1, draw.Sides, result, draw.Result)), nil
+		}
+		rolls = append(rolls, fmt.Sprintf("%d (d%d)", draw.Result, draw.Sides))
+	}
+	if len(rolls) == 0 {
+		return ephemeralResponse(text + "\n\n:white_check_mark: The roll has no dice."), nil
+	}
+	return ephemeralResponse(text + fmt.Sprintf("\n\n:white_check_mark: All %d dice match: %s.", len(rolls), strings.Join(rolls, ", "))), nil
+}
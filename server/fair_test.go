@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFairRolls(t *testing.T) {
+	p, api := initTestPlugin()
+	store := mockPostStore(api)
+	api.On("HasPermissionToChannel", "userid", "channel1", model.PermissionReadChannel).Return(true)
+	api.On("HasPermissionToChannel", mock.Anything, mock.Anything, mock.Anything).Return(false)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(command string) (*model.CommandResponse, *model.AppError) {
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: command, UserId: "userid", ChannelId: "channel1"})
+	}
+
+	// Rolls are not fair unless enabled or given a nonce.
+	_, err := run("/roll 1d20")
+	assert.Nil(t, err)
+	assert.Nil(t, store.posts[0].GetProp(fairRollProp))
+
+	_, err = run("/roll --nonce mynonce 3d6")
+	assert.Nil(t, err)
+	post := store.posts[1]
+	proof, ok := post.GetProp(fairRollProp).(map[string]interface{})
+	if !assert.True(t, ok) {
+		return
+	}
+	today := fairToday()
+	seed, _ := p.getFairSeed(today, false)
+	assert.Equal(t, today, proof["day"])
+	assert.Equal(t, "mynonce", proof["nonce"])
+	assert.Equal(t, fairSeedHash(seed), proof["seed_hash"])
+	assert.Len(t, proof["draws"], 3)
+	assert.Contains(t, post.Message, "*Provably fair roll with nonce `mynonce` and the server seed of "+today+", of hash `"+fairSeedHash(seed)+"`.")
+
+	// A nonce can only be used once a day, so that it cannot be chosen for its dice.
+	_, err = run("/roll --nonce mynonce 3d6")
+	assert.NotNil(t, err)
+	assert.Len(t, store.posts, 2)
+
+	// The same seed and nonce give the same dice.
+	again := &fairRoll{Nonce: "mynonce"}
+	roller := fairRoller(seed, again)
+	for _, draw := range proof["draws"].([]interface{}) {
+		assert.Equal(t, int(draw.(map[string]interface{})["result"].(float64)), roller(6))
+	}
+
+	// The seed is only published once the day is over.
+	response, err := run("/roll verify " + post.Id)
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, "The seed will be published once the day is over")
+	assert.NotContains(t, response.Text, seed)
+	response, err = run("/roll fair")
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, fairSeedHash(seed))
+	assert.NotContains(t, response.Text, "`"+seed+"`")
+
+	// Pretend that the roll was made on a past day.
+	assert.Nil(t, api.KVSet(fairSeedKey("2020-01-01"), []byte(seed)))
+	proof["day"] = "2020-01-01"
+	response, err = run("/roll verify https://chat.example.com/team/pl/" + post.Id)
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, "The server seed is `"+seed+"`.")
+	assert.Contains(t, response.Text, ":white_check_mark: All 3 dice match")
+	response, err = run("/roll fair 2020-01-01")
+	assert.Nil(t, err)
+	assert.Equal(t, "The server seed of 2020-01-01 is `"+seed+"`, of hash `"+fairSeedHash(seed)+"`.", response.Text)
+
+	draw := proof["draws"].([]interface{})[1].(map[string]interface{})
+	draw["result"] = float64(int(draw["result"].(float64))%6 + 1)
+	response, err = run("/roll verify " + post.Id)
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, ":x: Die 2 is a d6")
+
+	result := proof["result"].(string)
+	assert.True(t, strings.HasPrefix(result, "**User** rolls 3d6 = **"), result)
+	assert.True(t, strings.HasPrefix(post.Message, result+"\n*Provably fair roll"), post.Message)
+	proof["result"] = "**User** rolls 3d6 = **18**"
+	response, err = run("/roll verify " + post.Id)
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, ":x: The post does not show the result of the roll.")
+	proof["result"] = result
+
+	// Only the rolls of the bot are verified.
+	forged := post.Clone()
+	forged.Id, forged.UserId = model.NewId(), "userid"
+	store.all = append(store.all, forged)
+	_, err = run("/roll verify " + forged.Id)
+	assert.NotNil(t, err)
+
+	proof["seed_hash"] = fairSeedHash("another seed")
+	response, err = run("/roll verify " + post.Id)
+	assert.Nil(t, err)
+	assert.Contains(t, response.Text, ":x: The server seed of that day does not match the hash.")
+
+	// In channels with fair rolls, every public roll is fair, with a nonce counting the
+	// fair rolls of the user in the channel that day.
+	p.configuration.EnableFairRolls = true
+	for i := 1; i <= 2; i++ {
+		_, err = run("/roll 1d20+1")
+		assert.Nil(t, err)
+		proof, ok = store.posts[len(store.posts)-1].GetProp(fairRollProp).(map[string]interface{})
+		if assert.True(t, ok) {
+			assert.Equal(t, fmt.Sprintf("channel1.userid.%d", i), proof["nonce"])
+			assert.Len(t, proof["draws"], 1)
+		}
+	}
+
+	for _, command := range []string{
+		"/roll verify " + store.posts[0].Id,
+		"/roll verify unknown",
+		"/roll verify",
+		"/roll fair yesterday",
+		"/roll --nonce",
+		"/roll --nonce mynonce",
+		"/roll --nonce channel1.userid.3 1d20",
+	} {
+		_, err = run(command)
+		assert.NotNil(t, err, command)
+	}
+	response, err = run("/roll fair 2019-12-31")
+	assert.Nil(t, err)
+	assert.Equal(t, "There were no fair rolls on 2019-12-31.", response.Text)
+	response, err = run("/roll fair 2999-01-01")
+	assert.Nil(t, err)
+	assert.Equal(t, "The server seed of 2999-01-01 is not chosen yet.", response.Text)
+}
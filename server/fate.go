@@ -0,0 +1,218 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/vektah/goparsify" //nolint: stylecheck
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/pd"
+)
+
+// Fate Core: fudge dice, the adjective ladder and opposed rolls.
+
+//go:embed helptext-fate.md
+var helpTextFate string
+
+var fateSystem = gameSystem{
+	id:       "fate",
+	name:     "Fate Core",
+	enabled:  func(c *configuration) *bool { return &c.EnableFate },
+	grammar:  fateGrammar,
+	helpText: helpTextFate,
+	macros: macroLibrary{
+		"fudge": "4dF",
+	},
+}
+
+// Types
+type FateDice struct {
+	n     int   // number of dice
+	rolls []int // roll results, each -1, 0 or 1
+}
+type Fate struct {
+	modifier   int  // skill rating added to the dice
+	opposition int  // opposition rating, only meaningful if versus is true
+	versus     bool // whether the roll is opposed
+}
+
+var fateLadder = []string{"Terrible", "Poor", "Mediocre", "Average", "Fair", "Good", "Great", "Superb", "Fantastic", "Epic", "Legendary"}
+
+// Return the name of a rating on the Fate ladder, e.g. "Good" for 3.
+func fateLadderName(rating int) string {
+	switch {
+	case rating < -2:
+		return fmt.Sprintf("Terrible%d", rating+2)
+	case rating > 8:
+		return fmt.Sprintf("Legendary+%d", rating-8)
+	}
+	return fateLadder[rating+2]
+}
+
+// Return a rating with both its ladder name and its number, e.g. "Good (+3)".
+func fateRating(rating int) string {
+	return fmt.Sprintf("%s (%+d)", fateLadderName(rating), rating)
+}
+
+func fateGlyph(result int) string {
+	switch result {
+	case 1:
+		return "[+]"
+	case -1:
+		return "[−]"
+	default:
+		return "[ ]"
+	}
+}
+
+func (sp FateDice) sum() int {
+	ret := 0
+	for _, r := range sp.rolls {
+		ret += r
+	}
+	return ret
+}
+
+func (sp Fate) total(n Node) int {
+	return n.child[0].sp.(FateDice).sum() + sp.modifier
+}
+
+// Grammar
+func fateGrammar(g grammar) gameSystemGrammar {
+	var (
+		fateDice = Seq(Maybe(g.natural), Regex("[Dd][Ff]")).Map(func(r *Result) {
+			n := 1
+			if r.Child[0].Token != "" {
+				var err error
+				n, err = getNatural(r.Child[0])
+				if err != nil {
+					r.Result = err
+					return
+				}
+			}
+			r.Token = r.Child[0].Token + r.Child[1].Token
+			r.Result = makeNode(r.Token, []Result{}, FateDice{n: n})
+		})
+
+		fate = Seq(Regex("(?i)fate"), Maybe(Regex(" *[+-] *(0|[1-9][0-9]{0,2})")), Maybe(Regex(" +(?i:vs\\.?) +[+-]?(0|[1-9][0-9]{0,2})"))).Map(func(r *Result) {
+			sp := Fate{}
+			if r.Child[1].Token != "" {
+				sp.modifier, _ = strconv.Atoi(strings.ReplaceAll(r.Child[1].Token, " ", ""))
+			}
+			if r.Child[2].Token != "" {
+				fields := strings.Fields(r.Child[2].Token)
+				sp.opposition, _ = strconv.Atoi(fields[len(fields)-1])
+				sp.versus = true
+			}
+			r.Token = r.Child[0].Token + r.Child[1].Token + r.Child[2].Token
+			r.Result = Node{
+				token: r.Token,
+				child: []Node{{token: "4dF", child: []Node{}, sp: FateDice{n: 4}}},
+				sp:    sp,
+			}
+		})
+	)
+	return gameSystemGrammar{
+		values:   []Parserish{fateDice},
+		toplevel: []Parserish{fate},
+	}
+}
+
+// Roller
+func (sp FateDice) roll(_ Node, roller Roller) NodeSpecialization {
+	rolls := make([]int, sp.n)
+	for i := range rolls {
+		rolls[i] = roller(3) - 2
+	}
+	return FateDice{n: sp.n, rolls: rolls}
+}
+func (sp Fate) roll(_ Node, _ Roller) NodeSpecialization { return sp }
+
+// Evaluate
+func (sp FateDice) value(_ Node) BR { return itobr(sp.sum()) }
+func (sp Fate) value(n Node) BR     { return itobr(sp.total(n)) }
+
+// Render
+func (sp FateDice) render(n Node, ind string, rr int, _ bool, options string) (string, string, string) {
+	glyphs := make([]string, len(sp.rolls))
+	for i, r := range sp.rolls {
+		glyphs[i] = fateGlyph(r)
+	}
+	rollStr := fmt.Sprintf(" (%s)", strings.Join(glyphs, " "))
+	result := renderNumber(n.value(), rr, options)
+	if rr == RR_DETAIL {
+		return n.token + rollStr, result, ""
+	}
+	return n.token, result, fmt.Sprintf("\n%s*%s%s =* %s", ind, n.token, rollStr, n.value().Render(options+"ib"))
+}
+func (sp Fate) render(n Node, ind string, _ int, _ bool, options string) (string, string, string) {
+	total := sp.total(n)
+	intro := fmt.Sprintf("Fate %+d", sp.modifier)
+	if sp.versus {
+		intro += " vs " + fateRating(sp.opposition)
+	}
+	text := fmt.Sprintf("%s and gets **%s**", intro, fateRating(total))
+	if sp.versus {
+		text += ": " + fateOutcome(total-sp.opposition)
+	}
+	_, _, details := n.child[0].render(ind, RR_NONE, false, options)
+	return text, "", details
+}
+
+// Describe the outcome of an opposed roll from the number of shifts.
+func fateOutcome(shifts int) string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 shift"
+		}
+		return fmt.Sprintf("%d shifts", n)
+	}
+	switch {
+	case shifts < 0:
+		return fmt.Sprintf("**FAILS** by %s :x:", plural(-shifts))
+	case shifts == 0:
+		return "**TIES** :handshake:"
+	case shifts < 3:
+		return fmt.Sprintf("**SUCCEEDS** by %s :thumbsup:", plural(shifts))
+	default:
+		return fmt.Sprintf("**SUCCEEDS WITH STYLE** by %s :sunglasses:", plural(shifts))
+	}
+}
+
+// roll comment
+func (sp FateDice) rollComment(_ Node, _ configuration) string { return ROLL_COMMENT_BLOCK_PARENT }
+func (sp Fate) rollComment(_ Node, _ configuration) string     { return ROLL_COMMENT_NOTHING }
+
+// Rolled dice
+func (sp FateDice) rolledDice() diceRecord {
+	return diceRecord{Dice: "dF", Results: append([]int{}, sp.rolls...)}
+}
+
+// Probability distributions
+func (sp FateDice) prob(_ Node) PD {
+	// Each fudge die is a d3 shifted down by 2.
+	return pd.Dice(sp.n, 3, 0, 0).Minus(pd.Constant(itobr(2 * sp.n)))
+}
+func (sp Fate) prob(n Node) PD {
+	return n.child[0].prob().Plus(pd.Constant(itobr(sp.modifier)))
+}
+
+// Outcome analysis
+func (sp Fate) analyzeOutcomes(_ Node, prob PD, options string) string {
+	if !sp.versus {
+		return ""
+	}
+	opposition := itobr(sp.opposition)
+	shifts := func(predicate func(BR) bool) BR {
+		return prob.ProbabilityOf(func(outcome BR) bool { return predicate(outcome.Minus(opposition)) })
+	}
+	three := itobr(3)
+	return renderOutcomeTable("Outcome vs "+fateRating(sp.opposition), []outcomeRow{
+		{"Fail", shifts(func(s BR) bool { return s.LessThan(zero) })},
+		{"Tie", shifts(func(s BR) bool { return s.Equals(zero) })},
+		{"Succeed", shifts(func(s BR) bool { return zero.LessThan(s) && s.LessThan(three) })},
+		{"Succeed with style", shifts(func(s BR) bool { return three.LessThanOrEquals(s) })},
+	}, options)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFateRolls(t *testing.T) {
+	testCases := []struct {
+		query    string
+		rolls    []int
+		expected string
+		render   string
+	}{
+		{query: "4dF",
+			rolls:    []int{3, 1, 2, 3},
+			expected: "1",
+			render:   "4dF = **1**\n- *4dF ([+] [−] [ ] [+]) =* ***1***"},
+		{query: "dF+2",
+			rolls:    []int{1},
+			expected: "1",
+			render:   "dF+2 = **1**\n- *dF ([−]) =* ***-1***"},
+		{query: "fate",
+			rolls:    []int{2, 2, 2, 2},
+			expected: "0",
+			render:   "Fate +0 and gets **Mediocre (+0)**\n- *4dF ([ ] [ ] [ ] [ ]) =* ***0***"},
+		{query: "Fate +3",
+			rolls:    []int{3, 3, 2, 1},
+			expected: "4",
+			render:   "Fate +3 and gets **Great (+4)**\n- *4dF ([+] [+] [ ] [−]) =* ***1***"},
+		{query: "fate -1 vs -2",
+			rolls:    []int{1, 1, 1, 2},
+			expected: "-4",
+			render:   "Fate -1 vs Terrible (-2) and gets **Terrible-2 (-4)**: **FAILS** by 2 shifts :x:\n- *4dF ([−] [−] [−] [ ]) =* ***-3***"},
+		{query: "fate +3 vs 2",
+			rolls:    []int{2, 2, 1, 3},
+			expected: "3",
+			render:   "Fate +3 vs Fair (+2) and gets **Good (+3)**: **SUCCEEDS** by 1 shift :thumbsup:\n- *4dF ([ ] [ ] [−] [+]) =* ***0***"},
+		{query: "fate+2 vs. 2",
+			rolls:    []int{2, 2, 1, 3},
+			expected: "2",
+			render:   "Fate +2 vs Fair (+2) and gets **Fair (+2)**: **TIES** :handshake:\n- *4dF ([ ] [ ] [−] [+]) =* ***0***"},
+		{query: "fate +5 vs 0",
+			rolls:    []int{3, 3, 3, 3},
+			expected: "9",
+			render:   "Fate +5 vs Mediocre (+0) and gets **Legendary+1 (+9)**: **SUCCEEDS WITH STYLE** by 9 shifts :sunglasses:\n- *4dF ([+] [+] [+] [+]) =* ***4***"},
+	}
+	conf := configuration{EnableFate: true}
+	parse := GetParser(conf)
+	for _, testCase := range testCases {
+		message := "Testing case " + testCase.query
+		parsedNode, err := parse(testCase.query)
+		assert.Nil(t, err, message)
+		if err != nil {
+			continue
+		}
+		rollerIdx := 0
+		roller := func(x int) int {
+			assert.Equal(t, 3, x, message)
+			ret := testCase.rolls[rollerIdx]
+			rollerIdx++
+			return ret
+		}
+		rolledNode := parsedNode.roll(roller, conf)
+		assert.Equal(t, len(testCase.rolls), rollerIdx, message)
+		assert.Equal(t, testCase.expected, rolledNode.value().Render(""), message)
+		assert.Equal(t, testCase.render, rolledNode.renderToplevel(""), message)
+	}
+
+	for _, query := range []string{"fate", "4dF"} {
+		_, err := GetParser(configuration{})(query)
+		assert.NotNil(t, err, "Fate disabled: "+query)
+	}
+}
+
+func TestFateAnalyze(t *testing.T) {
+	parse := GetParser(configuration{EnableFate: true})
+
+	node, err := parse("4dF")
+	assert.Nil(t, err)
+	assert.Equal(t, "0", node.prob().ExpectedValue().Render(""))
+	assert.Equal(t, "1/81", node.prob().Get(itobr(4)).String())
+	assert.Equal(t, "", node.analyzeOutcomes(""))
+
+	node, err = parse("fate +3 vs 2")
+	assert.Nil(t, err)
+	assert.Equal(t, "3", node.prob().ExpectedValue().Render(""))
+	assert.Equal(t, "\n\n|Outcome vs Fair (+2)|Chance|\n|-|-|"+
+		"\n|Fail|18 14/27 %|"+
+		"\n|Tie|19 61/81 %|"+
+		"\n|Succeed|43 17/81 %|"+
+		"\n|Succeed with style|18 14/27 %|", node.analyzeOutcomes(""))
+}
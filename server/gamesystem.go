@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	. "github.com/vektah/goparsify" //nolint: stylecheck
+)
+
+// A gameSystem is a module of functionality specific to one game. Each game
+// system can be enabled independently in the plugin settings, using the
+// setting "enable_<id>".
+type gameSystem struct {
+	id   string
+	name string
+	// Returns the configuration field enabling the game system.
+	enabled func(c *configuration) *bool
+	// Grammar alternatives contributed by the game system.
+	grammar func(g grammar) gameSystemGrammar
+	// Markdown appended to the help text when the game system is enabled.
+	helpText string
+	// Optional. Returns a roll comment for a rolled Dice node, or
+	// ROLL_COMMENT_NOTHING.
+	diceRollComment func(sp Dice, n Node) string
+	// Optional. Subcommands of `/roll` building a roll expression, e.g. for
+	// a skill check, from the rest of the command and the caller's active
+	// character sheet, which is nil if there is none.
+	commands map[string]func(query string, sheet *characterSheet) (string, error)
+	// Optional. Built-in macros, used when no user, channel or team macro has
+	// the same name.
+	macros macroLibrary
+}
+
+// Building blocks of the core grammar available to game systems.
+type grammar struct {
+	natural   Parser
+	diceSides Parser
+}
+
+type gameSystemGrammar struct {
+	// Alternatives for a single value, e.g. a special kind of dice. These are
+	// tried after keep/drop dice and before simple dice.
+	values []Parserish
+	// Alternatives for the whole input, tried after a comma separated list of
+	// expressions.
+	toplevel []Parserish
+}
+
+// All game systems, in the order their grammar alternatives and help texts
+// are used.
+var gameSystems = []gameSystem{
+	dnd5eSystem,
+	fateSystem,
+	exaltedSystem,
+}
+
+// Return the game systems enabled in the configuration.
+func (c configuration) gameSystems() []gameSystem {
+	ret := []gameSystem{}
+	for _, gs := range gameSystems {
+		if *gs.enabled(&c) {
+			ret = append(ret, gs)
+		}
+	}
+	return ret
+}
+
+func gameSystemIDs(systems []gameSystem) []string {
+	ids := make([]string, len(systems))
+	for i, gs := range systems {
+		ids[i] = gs.id
+	}
+	return ids
+}
+
+// Return the built-in macros of the enabled game systems.
+func (c configuration) builtinMacros() macroLibrary {
+	ret := macroLibrary{}
+	for _, gs := range c.gameSystems() {
+		for name, expr := range gs.macros {
+			if _, ok := ret[name]; !ok {
+				ret[name] = expr
+			}
+		}
+	}
+	return ret
+}
+
+// Return the subcommand with the given name of an enabled game system.
+func (c configuration) gameSystemCommand(name string) (func(query string, sheet *characterSheet) (string, error), bool) {
+	for _, gs := range c.gameSystems() {
+		if command, ok := gs.commands[name]; ok {
+			return command, true
+		}
+	}
+	return nil, false
+}
+
+// executeGameSystemCommand rolls the expression built by a game system's subcommand.
+func (p *Plugin) executeGameSystemCommand(args *model.CommandArgs, query string, command func(query string, sheet *characterSheet) (string, error), conf configuration) (*model.CommandResponse, *model.AppError) {
+	sheets, err := p.getCharacterSheets(args.UserId)
+	if err != nil {
+		return nil, appError("Cannot load your character sheets.", err)
+	}
+	expr, err := command(query, sheets.active())
+	if err != nil {
+		return nil, appError(fmt.Sprintf("%s.", err.Error()), err)
+	}
+	roller, proof, err := p.publicRoller(conf, args.UserId, args.ChannelId, "")
+	if err != nil {
+		return nil, appError("Cannot load the server seed.", err)
+	}
+	post, rolled, generatePostError := p.generateDiceRoll(expr, args.UserId, args.ChannelId, args.RootId, roller, conf)
+	if generatePostError != nil {
+		return nil, generatePostError
+	}
+	proof.addToPost(post)
+	addRollActions(post, expr, conf)
+	if _, appErr := p.createRollPost(post, rolled, expr, args.UserId); appErr != nil {
+		return nil, appErr
+	}
+	return &model.CommandResponse{}, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGameSystemSettings(t *testing.T) {
+	settings := map[string]string{}
+	for _, setting := range manifest.SettingsSchema.Settings {
+		settings[setting.Key] = setting.Type
+	}
+	for _, gs := range gameSystems {
+		assert.Equal(t, "bool", settings["enable_"+gs.id], "Setting for "+gs.name)
+		assert.NotEmpty(t, gs.helpText, "Help text for "+gs.name)
+
+		conf := configuration{}
+		*gs.enabled(&conf) = true
+		assert.Equal(t, []string{gs.id}, gameSystemIDs(conf.gameSystems()), "Enabling "+gs.name)
+	}
+	assert.Empty(t, configuration{}.gameSystems())
+}
+
+func TestGameSystemRollComments(t *testing.T) {
+	node, err := GetParser(configuration{})("d20")
+	assert.Nil(t, err)
+	roller := func(int) int { return 20 }
+	assert.Equal(t, "d20 = **20** (NAT20! :star-struck:)", node.roll(roller, configuration{EnableDnd5e: true, EnableCritMessages: true}).renderToplevel(""))
+	assert.Equal(t, "d20 = **20**", node.roll(roller, configuration{EnableDnd5e: true}).renderToplevel(""))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// hiddenRoll is a roll made with `/roll hidden`, stored in the plugin KV store until it
+// is revealed. The commitment published when rolling is the hex encoded SHA-256 of the
+// salt followed by the message.
+type hiddenRoll struct {
+	UserID     string `json:"user_id"`
+	ChannelID  string `json:"channel_id"`
+	PostID     string `json:"post_id"`
+	Message    string `json:"message"`
+	Salt       string `json:"salt"`
+	Commitment string `json:"commitment"`
+}
+
+const (
+	hiddenRollIDLength     = 8
+	maxHiddenRollIDRetries = 5
+)
+
+func hiddenRollKey(id string) string {
+	return "hidden_" + id
+}
+
+func hiddenRollCommitment(salt, message string) string {
+	hash := sha256.Sum256([]byte(salt + message))
+	return hex.EncodeToString(hash[:])
+}
+
+// executeHiddenRoll handles `/roll hidden ...`: the result is only shown to the caller,
+// and the channel sees a commitment to the result that can be checked once revealed.
+func (p *Plugin) executeHiddenRoll(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	post, generatePostError := p.generateDicePost(query, args.UserId, args.ChannelId, args.RootId, p.newRoller(), conf)
+	if generatePostError != nil {
+		return nil, generatePostError
+	}
+
+	saltBytes := make([]byte, 16)
+	if _, err := rand.Read(saltBytes); err != nil {
+		return nil, appError("Cannot generate a salt for the hidden roll.", err)
+	}
+	hidden := &hiddenRoll{
+		UserID:    args.UserId,
+		ChannelID: args.ChannelId,
+		Message:   post.Message,
+		Salt:      hex.EncodeToString(saltBytes),
+	}
+	hidden.Commitment = hiddenRollCommitment(hidden.Salt, hidden.Message)
+
+	displayName, appErr := p.getDisplayName(args.UserId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	// Save the roll before announcing it, so that every notice can be revealed.
+	id, err := p.addHiddenRoll(hidden)
+	if err != nil {
+		return nil, appError("Cannot save the hidden roll.", err)
+	}
+	notice, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: args.ChannelId,
+		RootId:    args.RootId,
+		Message:   fmt.Sprintf("**%s** made hidden roll `%s` with commitment `%s`.", displayName, id, hidden.Commitment),
+	})
+	if appErr != nil {
+		_ = p.API.KVDelete(hiddenRollKey(id))
+		return nil, appErr
+	}
+
+	// Without the notice ID, the roll is revealed outside of its thread.
+	hidden.PostID = notice.Id
+	if err := p.setHiddenRoll(id, hidden); err != nil {
+		p.API.LogWarn("Cannot link a hidden roll to its notice.", "error", err.Error())
+	}
+
+	post.Message = fmt.Sprintf("Hidden roll `%s`: %s\n\nUse `/roll reveal %s` to show it to the channel.", id, post.Message, id)
+	p.API.SendEphemeralPost(args.UserId, post)
+	return &model.CommandResponse{}, nil
+}
+
+// executeRevealCommand handles `/roll reveal <id>`: the original result of a hidden
+// roll is posted in its channel, along with the salt needed to check the commitment.
+func (p *Plugin) executeRevealCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	id := strings.TrimSpace(query)
+	hidden, err := p.getHiddenRoll(id)
+	if err != nil {
+		return nil, appError("Cannot load the hidden roll.", err)
+	}
+	if hidden == nil || hidden.UserID != args.UserId {
+		return nil, appError(fmt.Sprintf("You have no hidden roll `%s` to reveal.", id), nil)
+	}
+
+	text := fmt.Sprintf("Revealing hidden roll `%s`: %s\n\n"+
+		"Salt: `%s`\nCommitment: `%s`\n"+
+		"The commitment is the SHA-256 of the salt followed by the original message:\n```\n%s\n```",
+		id, hidden.Message, hidden.Salt, hidden.Commitment, hidden.Message)
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: hidden.ChannelID,
+		RootId:    hidden.PostID,
+		Message:   text,
+	}); appErr != nil {
+		return nil, appErr
+	}
+
+	if appErr := p.API.KVDelete(hiddenRollKey(id)); appErr != nil {
+		return nil, appError("Cannot delete the revealed roll.", appErr)
+	}
+	return &model.CommandResponse{}, nil
+}
+
+func (p *Plugin) getHiddenRoll(id string) (*hiddenRoll, error) {
+	data, appErr := p.API.KVGet(hiddenRollKey(id))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load hidden roll")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	hidden := &hiddenRoll{}
+	if err := json.Unmarshal(data, hidden); err != nil {
+		return nil, errors.Wrap(err, "failed to decode hidden roll")
+	}
+	return hidden, nil
+}
+
+// addHiddenRoll saves a new hidden roll under a short random ID, returning the ID.
+// IDs already in use are never overwritten.
+func (p *Plugin) addHiddenRoll(hidden *hiddenRoll) (string, error) {
+	data, err := json.Marshal(hidden)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode hidden roll")
+	}
+	for i := 0; i < maxHiddenRollIDRetries; i++ {
+		id := model.NewId()[:hiddenRollIDLength]
+		ok, appErr := p.API.KVCompareAndSet(hiddenRollKey(id), nil, data)
+		if appErr != nil {
+			return "", errors.Wrap(appErr, "failed to save hidden roll")
+		}
+		if ok {
+			return id, nil
+		}
+	}
+	return "", errors.New("failed to save hidden roll: no free ID")
+}
+
+func (p *Plugin) setHiddenRoll(id string, hidden *hiddenRoll) error {
+	data, err := json.Marshal(hidden)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode hidden roll")
+	}
+	if appErr := p.API.KVSet(hiddenRollKey(id), data); appErr != nil {
+		return errors.Wrap(appErr, "failed to save hidden roll")
+	}
+	return nil
+}
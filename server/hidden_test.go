@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHiddenRolls(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts, ephemeralPosts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		post.Id = model.NewId()
+		posts = append(posts, post)
+		return post
+	}, nil)
+	api.On("SendEphemeralPost", mock.Anything, mock.AnythingOfType("*model.Post")).Return(nil).Run(func(args mock.Arguments) {
+		ephemeralPosts = append(ephemeralPosts, args.Get(1).(*model.Post))
+	})
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, command string) (*model.CommandResponse, *model.AppError) {
+		posts, ephemeralPosts = nil, nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    userID,
+			ChannelId: "channel1",
+		})
+	}
+
+	_, err := run("userid", "/roll hidden 2+3")
+	assert.Nil(t, err)
+	assert.Len(t, posts, 1)
+	m := regexp.MustCompile("^\\*\\*User\\*\\* made hidden roll `(\\w+)` with commitment `([0-9a-f]{64})`\\.$").FindStringSubmatch(posts[0].Message)
+	assert.NotNil(t, m, posts[0].Message)
+	id, commitment, noticeID := m[1], m[2], posts[0].Id
+	assert.Len(t, ephemeralPosts, 1)
+	assert.Equal(t, "Hidden roll `"+id+"`: **User** rolls 2+3 = **5**\n\nUse `/roll reveal "+id+"` to show it to the channel.", ephemeralPosts[0].Message)
+
+	// Only the roller can reveal.
+	_, err = run("otheruser", "/roll reveal "+id)
+	assert.NotNil(t, err)
+	_, err = run("userid", "/roll reveal unknown")
+	assert.NotNil(t, err)
+
+	_, err = run("userid", "/roll reveal "+id)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 1)
+	assert.Equal(t, noticeID, posts[0].RootId)
+	m = regexp.MustCompile("Salt: `([0-9a-f]{32})`\nCommitment: `" + commitment + "`").FindStringSubmatch(posts[0].Message)
+	assert.NotNil(t, m, posts[0].Message)
+	assert.Equal(t, commitment, hiddenRollCommitment(m[1], "**User** rolls 2+3 = **5**"))
+	assert.Contains(t, posts[0].Message, "Revealing hidden roll `"+id+"`: **User** rolls 2+3 = **5**")
+
+	// A roll can only be revealed once.
+	_, err = run("userid", "/roll reveal "+id)
+	assert.NotNil(t, err)
+}
+
+func TestAddHiddenRoll(t *testing.T) {
+	p, _ := initTestPlugin()
+	hidden := &hiddenRoll{UserID: "userid", Message: "**User** rolls 1 = **1**"}
+	id, err := p.addHiddenRoll(hidden)
+	assert.Nil(t, err)
+	assert.Len(t, id, hiddenRollIDLength)
+	saved, err := p.getHiddenRoll(id)
+	assert.Nil(t, err)
+	assert.Equal(t, hidden, saved)
+
+	// IDs in use are not overwritten.
+	api := &plugintest.API{}
+	api.On("KVCompareAndSet", mock.Anything, []byte(nil), mock.Anything).Return(false, nil)
+	p.SetAPI(api)
+	_, err = p.addHiddenRoll(hidden)
+	assert.NotNil(t, err)
+	api.AssertNumberOfCalls(t, "KVCompareAndSet", maxHiddenRollIDRetries)
+}
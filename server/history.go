@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/br"
+)
+
+// rollRecord is the structured result of a public roll, kept in the roll history of
+// its channel.
+type rollRecord struct {
+	UserID     string `json:"user_id"`
+	Expression string `json:"expression"`
+	// Dice rolled, in order, up to maxRecordedDice results.
+	Dice []diceRecord `json:"dice"`
+	// Whether dice beyond maxRecordedDice were left out.
+	Truncated bool `json:"truncated,omitempty"`
+	// Result of each comma separated expression, as rational number strings.
+	Totals []string `json:"totals"`
+	// Milliseconds since the epoch.
+	Timestamp int64  `json:"timestamp"`
+	PostID    string `json:"post_id"`
+}
+
+type diceRecord struct {
+	// The kind of dice, e.g. "d20" or "dF".
+	Dice    string `json:"dice"`
+	Results []int  `json:"results"`
+}
+
+// A diceReporter is a rolled node specialization reporting the dice it rolled.
+type diceReporter interface {
+	rolledDice() diceRecord
+}
+
+const (
+	maxHistoryLength  = 500
+	maxHistoryRetries = 5
+	maxHistoryListed  = 50
+	// Rolls can have any number of dice: only the first results are kept, so that the
+	// history stays small.
+	maxRecordedDice = 100
+)
+
+// Return the dice rolled in an expression, in order.
+func collectDice(n Node) []diceRecord {
+	ret := []diceRecord{}
+	if reporter, ok := n.sp.(diceReporter); ok {
+		ret = append(ret, reporter.rolledDice())
+	}
+	for _, c := range n.child {
+		ret = append(ret, collectDice(c)...)
+	}
+	return ret
+}
+
+// Return the result of each comma separated expression.
+func collectTotals(n Node) []string {
+	if _, ok := n.sp.(CommaList); ok && len(n.child) > 1 {
+		ret := []string{}
+		for _, c := range n.child {
+			ret = append(ret, c.value().String())
+		}
+		return ret
+	}
+	return []string{n.value().String()}
+}
+
+// Return the first n dice results, and whether any were left out.
+func truncateDice(dice []diceRecord, n int) ([]diceRecord, bool) {
+	ret := []diceRecord{}
+	for _, d := range dice {
+		if len(d.Results) > n {
+			if n > 0 {
+				ret = append(ret, diceRecord{Dice: d.Dice, Results: d.Results[:n]})
+			}
+			return ret, true
+		}
+		ret = append(ret, d)
+		n -= len(d.Results)
+	}
+	return ret, false
+}
+
+func newRollRecord(userID, expression, postID string, rolled *Node) rollRecord {
+	dice, truncated := truncateDice(collectDice(*rolled), maxRecordedDice)
+	return rollRecord{
+		UserID:     userID,
+		Expression: expression,
+		Dice:       dice,
+		Truncated:  truncated,
+		Totals:     collectTotals(*rolled),
+		Timestamp:  model.GetMillis(),
+		PostID:     postID,
+	}
+}
+
+func historyKey(channelID string) string {
+	return "history_" + channelID
+}
+
+func (p *Plugin) getRollHistory(channelID string) ([]rollRecord, error) {
+	_, records, err := p.getRollHistoryData(channelID)
+	return records, err
+}
+
+func (p *Plugin) getRollHistoryData(channelID string) ([]byte, []rollRecord, error) {
+	records := []rollRecord{}
+	data, appErr := p.API.KVGet(historyKey(channelID))
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to load roll history")
+	}
+	if data == nil {
+		return nil, records, nil
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode roll history")
+	}
+	return data, records, nil
+}
+
+// appendRollHistory adds a roll to the history of a channel, dropping the oldest rolls
+// beyond maxHistoryLength. Concurrent appends are retried.
+func (p *Plugin) appendRollHistory(channelID string, record rollRecord) error {
+	for i := 0; i < maxHistoryRetries; i++ {
+		oldData, records, err := p.getRollHistoryData(channelID)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+		if len(records) > maxHistoryLength {
+			records = records[len(records)-maxHistoryLength:]
+		}
+		newData, err := json.Marshal(records)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode roll history")
+		}
+		ok, appErr := p.API.KVCompareAndSet(historyKey(channelID), oldData, newData)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to save roll history")
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errors.New("failed to save roll history: too many concurrent changes")
+}
+
+// createRollPost creates the post of a public roll, records the roll in the channel's
+// history and sends it to the webhooks. It returns the created post. Failing to record
+// the roll is only logged, as the roll is already posted.
+func (p *Plugin) createRollPost(post *model.Post, rolled *Node, expression, userID string) (*model.Post, *model.AppError) {
+	created, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if created == nil {
+		created = post
+	}
+	if err := p.appendRollHistory(post.ChannelId, newRollRecord(userID, expression, created.Id, rolled)); err != nil {
+		p.API.LogWarn("Cannot record a roll in the channel history.", "error", err.Error())
+	}
+	p.notifyRollWebhooks(created, rolled, expression, userID)
+	return created, nil
+}
+
+// executeHistoryCommand handles `/roll history [@user] [n]` and
+// `/roll history export csv|json`.
+func (p *Plugin) executeHistoryCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	records, err := p.getRollHistory(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the roll history.", err)
+	}
+
+	fields := strings.Fields(query)
+	if len(fields) > 0 && strings.ToLower(fields[0]) == "export" {
+		format := "csv"
+		if len(fields) > 1 {
+			format = strings.ToLower(fields[1])
+		}
+		return p.exportRollHistory(args, records, format)
+	}
+
+	userID, n := "", 10
+	for _, field := range fields {
+		if strings.HasPrefix(field, "@") {
+			user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(field, "@"))
+			if appErr != nil {
+				return nil, appError(fmt.Sprintf("Cannot find user `%s`.", field), appErr)
+			}
+			userID = user.Id
+			continue
+		}
+		if n, err = strconv.Atoi(field); err != nil || n < 1 || n > maxHistoryListed {
+			return nil, appError(fmt.Sprintf("Usage: `/roll history [@user] [n]`, with n from 1 to %d, or `/roll history export csv|json`.", maxHistoryListed), err)
+		}
+	}
+
+	selected := []rollRecord{}
+	for i := len(records) - 1; i >= 0 && len(selected) < n; i-- {
+		if userID == "" || records[i].UserID == userID {
+			selected = append(selected, records[i])
+		}
+	}
+	if len(selected) == 0 {
+		return ephemeralResponse("No rolls found in this channel."), nil
+	}
+
+	names := map[string]string{}
+	text := "Recent rolls in this channel:\n\n|Time (UTC)|User|Roll|Result|\n|-|-|-|-|"
+	for _, r := range selected {
+		if _, ok := names[r.UserID]; !ok {
+			names[r.UserID] = r.UserID
+			if name, appErr := p.getDisplayName(r.UserID); appErr == nil {
+				names[r.UserID] = name
+			}
+		}
+		totals := make([]string, len(r.Totals))
+		for i, t := range r.Totals {
+			totals[i] = br.FromString(t).Render("")
+		}
+		text += fmt.Sprintf("\n|%s|%s|`%s`|%s|", formatRollTime(r.Timestamp), names[r.UserID], r.Expression, strings.Join(totals, ", "))
+	}
+	return ephemeralResponse(text), nil
+}
+
+func formatRollTime(millis int64) string {
+	return time.UnixMilli(millis).UTC().Format("2006-01-02 15:04:05")
+}
+
+// exportRollHistory sends the history of the channel as a file to the caller, in a
+// direct message from the bot.
+func (p *Plugin) exportRollHistory(args *model.CommandArgs, records []rollRecord, format string) (*model.CommandResponse, *model.AppError) {
+	var data []byte
+	switch format {
+	case "json":
+		var err error
+		if data, err = json.MarshalIndent(records, "", "  "); err != nil {
+			return nil, appError("Cannot encode the roll history.", err)
+		}
+	case "csv":
+		var err error
+		if data, err = rollHistoryCSV(records); err != nil {
+			return nil, appError("Cannot encode the roll history.", err)
+		}
+	default:
+		return nil, appError(fmt.Sprintf("Expected `csv` or `json` but got `%s`.", format), nil)
+	}
+
+	channel, appErr := p.API.GetChannel(args.ChannelId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	dm, appErr := p.API.GetDirectChannel(p.diceBotID, args.UserId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	filename := fmt.Sprintf("roll-history-%s-%s.%s", channel.Name, time.Now().UTC().Format("20060102-150405"), format)
+	info, appErr := p.API.UploadFile(data, dm.Id, filename)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if _, appErr = p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: dm.Id,
+		Message:   fmt.Sprintf("Roll history of ~%s (%d rolls).", channel.Name, len(records)),
+		FileIds:   []string{info.Id},
+	}); appErr != nil {
+		return nil, appErr
+	}
+	return ephemeralResponse("The roll history was sent to you in a direct message."), nil
+}
+
+func rollHistoryCSV(records []rollRecord) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	if err := w.Write([]string{"time", "user_id", "expression", "dice", "totals", "post_id"}); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		dice := make([]string, len(r.Dice))
+		for i, d := range r.Dice {
+			results := make([]string, len(d.Results))
+			for j, result := range d.Results {
+				results[j] = strconv.Itoa(result)
+			}
+			dice[i] = d.Dice + ":" + strings.Join(results, " ")
+		}
+		if err := w.Write([]string{
+			time.UnixMilli(r.Timestamp).UTC().Format(time.RFC3339),
+			r.UserID,
+			r.Expression,
+			strings.Join(dice, "; "),
+			strings.Join(r.Totals, "; "),
+			r.PostID,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
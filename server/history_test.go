@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRollHistory(t *testing.T) {
+	p, api := initTestPlugin()
+	p.diceBotID = "botid"
+	var posts []*model.Post
+	var uploaded []byte
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		post.Id = model.NewId()
+		posts = append(posts, post)
+		return post
+	}, nil)
+	api.On("SendEphemeralPost", mock.Anything, mock.AnythingOfType("*model.Post")).Return(nil)
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Name: "campaign", TeamId: "team1"}, nil)
+	api.On("GetUserByUsername", "user").Return(&model.User{Id: "userid", Username: "user"}, nil)
+	api.On("GetUserByUsername", "other").Return(&model.User{Id: "otherid", Username: "other"}, nil)
+	api.On("GetDirectChannel", "botid", "userid").Return(&model.Channel{Id: "dmid"}, nil)
+	api.On("UploadFile", mock.Anything, "dmid", mock.AnythingOfType("string")).Return(func(data []byte, channelID, filename string) *model.FileInfo {
+		uploaded = data
+		return &model.FileInfo{Id: "fileid", Name: filename}
+	}, nil)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(command string) (*model.CommandResponse, *model.AppError) {
+		posts = nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    "userid",
+			ChannelId: "channel1",
+		})
+	}
+
+	resp, err := run("/roll history")
+	assert.Nil(t, err)
+	assert.Equal(t, "No rolls found in this channel.", resp.Text)
+
+	_, err = run("/roll 2d1+3")
+	assert.Nil(t, err)
+	postID := posts[0].Id
+	_, err = run("/roll 1d1, 7//2")
+	assert.Nil(t, err)
+	// Secret rolls stay secret.
+	_, err = run("/roll secret 1d1")
+	assert.Nil(t, err)
+
+	records, err2 := p.getRollHistory("channel1")
+	assert.Nil(t, err2)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "userid", records[0].UserID)
+		assert.Equal(t, "2d1+3", records[0].Expression)
+		assert.Equal(t, []diceRecord{{Dice: "d1", Results: []int{1, 1}}}, records[0].Dice)
+		assert.Equal(t, []string{"5"}, records[0].Totals)
+		assert.Equal(t, postID, records[0].PostID)
+		assert.NotZero(t, records[0].Timestamp)
+		assert.Equal(t, []string{"1", "7/2"}, records[1].Totals)
+	}
+
+	resp, err = run("/roll history")
+	assert.Nil(t, err)
+	lines := strings.Split(resp.Text, "\n")
+	if assert.Len(t, lines, 6) {
+		assert.Regexp(t, "^\\|\\d{4}-\\d\\d-\\d\\d \\d\\d:\\d\\d:\\d\\d\\|User\\|`1d1, 7//2`\\|1, 3\\.5\\|$", lines[4])
+		assert.Regexp(t, "\\|User\\|`2d1\\+3`\\|5\\|$", lines[5])
+	}
+	resp, err = run("/roll history @user 1")
+	assert.Nil(t, err)
+	assert.Len(t, strings.Split(resp.Text, "\n"), 5)
+	resp, err = run("/roll history @other")
+	assert.Nil(t, err)
+	assert.Equal(t, "No rolls found in this channel.", resp.Text)
+	_, err = run("/roll history 0")
+	assert.NotNil(t, err)
+
+	resp, err = run("/roll history export json")
+	assert.Nil(t, err)
+	assert.Equal(t, "The roll history was sent to you in a direct message.", resp.Text)
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, "dmid", posts[0].ChannelId)
+		assert.Equal(t, model.StringArray{"fileid"}, posts[0].FileIds)
+	}
+	exported := []rollRecord{}
+	assert.Nil(t, json.Unmarshal(uploaded, &exported))
+	assert.Equal(t, records, exported)
+
+	_, err = run("/roll history export")
+	assert.Nil(t, err)
+	csvLines := strings.Split(strings.TrimSpace(string(uploaded)), "\n")
+	if assert.Len(t, csvLines, 3) {
+		assert.Equal(t, "time,user_id,expression,dice,totals,post_id", csvLines[0])
+		assert.Regexp(t, "^\\d{4}-\\d\\d-\\d\\dT\\d\\d:\\d\\d:\\d\\dZ,userid,2d1\\+3,d1:1 1,5,"+postID+"$", csvLines[1])
+	}
+	_, err = run("/roll history export xml")
+	assert.NotNil(t, err)
+
+	// The history is bounded.
+	for i := 0; i < maxHistoryLength; i++ {
+		assert.Nil(t, p.appendRollHistory("channel1", rollRecord{Expression: "1"}))
+	}
+	records, err2 = p.getRollHistory("channel1")
+	assert.Nil(t, err2)
+	assert.Len(t, records, maxHistoryLength)
+	assert.Equal(t, "1", records[0].Expression)
+
+	// A roll is still posted when the history cannot be saved.
+	api.On("LogWarn", "Cannot record a roll in the channel history.", "error", mock.AnythingOfType("string")).Return()
+	assert.Nil(t, p.API.KVSet(historyKey("channel1"), []byte("not json")))
+	_, err = run("/roll 1")
+	assert.Nil(t, err)
+	assert.Len(t, posts, 1)
+	api.AssertCalled(t, "LogWarn", "Cannot record a roll in the channel history.", "error", mock.AnythingOfType("string"))
+}
+
+func TestRollRecordSize(t *testing.T) {
+	node, err := GetParser(configuration{})("60d6+60d4+2d8")
+	assert.Nil(t, err)
+	rolled := node.roll(func(int) int { return 1 }, configuration{})
+
+	record := newRollRecord("userid", "60d6+60d4+2d8", "postid", &rolled)
+	assert.True(t, record.Truncated)
+	if assert.Len(t, record.Dice, 2) {
+		assert.Equal(t, "d6", record.Dice[0].Dice)
+		assert.Len(t, record.Dice[0].Results, 60)
+		assert.Equal(t, "d4", record.Dice[1].Dice)
+		assert.Len(t, record.Dice[1].Results, maxRecordedDice-60)
+	}
+	assert.Equal(t, []string{"122"}, record.Totals)
+
+	dice := []diceRecord{{Dice: "d20", Results: []int{1, 2}}, {Dice: "d6", Results: []int{3}}}
+	truncated, ok := truncateDice(dice, 3)
+	assert.False(t, ok)
+	assert.Equal(t, dice, truncated)
+	truncated, ok = truncateDice(dice, 2)
+	assert.True(t, ok)
+	assert.Equal(t, dice[:1], truncated)
+}
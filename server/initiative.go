@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/br"
+)
+
+const triggerInit string = "init"
+
+// initiativeTracker is the turn order of a combat in a channel, stored as JSON in the
+// plugin KV store, and shown in a pinned post of the channel.
+type initiativeTracker struct {
+	// Combatants in turn order.
+	Entries []initiativeEntry `json:"entries"`
+	// Round number, 0 until the first turn.
+	Round int `json:"round"`
+	// Key of the combatant whose turn it is, if the combat has started.
+	Current string `json:"current,omitempty"`
+	// The pinned post showing the tracker.
+	PostID string `json:"post_id,omitempty"`
+}
+
+type initiativeEntry struct {
+	Name string `json:"name"`
+	// Set for players, empty for NPCs.
+	UserID string `json:"user_id,omitempty"`
+	// Initiative result, as a rational number string.
+	Total string `json:"total"`
+	// Expected value of the initiative roll, used to break ties in favor of the
+	// higher bonus.
+	Expected string `json:"expected"`
+	// Random number breaking the remaining ties.
+	Tiebreak int `json:"tiebreak"`
+}
+
+const (
+	maxInitiativeEntries    = 50
+	maxInitiativeNameLength = 32
+)
+
+// Combatants are identified by user for players, and by name for NPCs.
+func (e initiativeEntry) key() string {
+	if e.UserID != "" {
+		return "user:" + e.UserID
+	}
+	return "npc:" + strings.ToLower(e.Name)
+}
+
+// Sort the combatants in turn order: higher initiative first, then higher initiative
+// bonus, then players before NPCs, then at random.
+func (t *initiativeTracker) sort() {
+	sort.SliceStable(t.Entries, func(i, j int) bool {
+		a, b := t.Entries[i], t.Entries[j]
+		aTotal, bTotal := br.FromString(a.Total), br.FromString(b.Total)
+		if !aTotal.Equals(bTotal) {
+			return bTotal.LessThan(aTotal)
+		}
+		aExpected, bExpected := br.FromString(a.Expected), br.FromString(b.Expected)
+		if !aExpected.Equals(bExpected) {
+			return bExpected.LessThan(aExpected)
+		}
+		if (a.UserID == "") != (b.UserID == "") {
+			return a.UserID != ""
+		}
+		return a.Tiebreak > b.Tiebreak
+	})
+}
+
+func (t *initiativeTracker) find(key string) int {
+	for i, e := range t.Entries {
+		if e.key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add a combatant, replacing any with the same key.
+func (t *initiativeTracker) add(entry initiativeEntry) error {
+	if i := t.find(entry.key()); i >= 0 {
+		t.Entries[i] = entry
+	} else {
+		if len(t.Entries) >= maxInitiativeEntries {
+			return fmt.Errorf("there cannot be more than %d combatants", maxInitiativeEntries)
+		}
+		t.Entries = append(t.Entries, entry)
+	}
+	t.sort()
+	return nil
+}
+
+// Move to the next combatant, starting a new round after the last one.
+func (t *initiativeTracker) next() {
+	i := t.find(t.Current)
+	if i < 0 || i == len(t.Entries)-1 {
+		t.Round++
+		t.Current = t.Entries[0].key()
+		return
+	}
+	t.Current = t.Entries[i+1].key()
+}
+
+func (t *initiativeTracker) remove(key string) {
+	i := t.find(key)
+	if i < 0 {
+		return
+	}
+	if t.Current == key {
+		if len(t.Entries) == 1 {
+			t.Current = ""
+		} else {
+			// The turn passes to the next combatant, starting a new round if the
+			// current one was last.
+			t.next()
+		}
+	}
+	t.Entries = append(t.Entries[:i], t.Entries[i+1:]...)
+}
+
+func (t *initiativeTracker) render() string {
+	text := "**Initiative**"
+	if t.Round > 0 {
+		text += fmt.Sprintf(": round %d", t.Round)
+	}
+	if len(t.Entries) == 0 {
+		return text + "\n\nNo combatants yet: Use `/init roll` or `/init add <name> <expression>`."
+	}
+	text += "\n\n|Turn|Name|Initiative|\n|:-:|-|-|"
+	for _, e := range t.Entries {
+		text += fmt.Sprintf("\n|%s|%s|%s|", ternaryStr(e.key() == t.Current, "▶", ""), e.Name, br.FromString(e.Total).Render(""))
+	}
+	if t.Round == 0 {
+		text += "\n\nUse `/init next` to start."
+	}
+	return text
+}
+
+func initiativeKey(channelID string) string {
+	return "initiative_" + channelID
+}
+
+func (p *Plugin) getInitiativeTracker(channelID string) (*initiativeTracker, error) {
+	tracker := &initiativeTracker{}
+	data, appErr := p.API.KVGet(initiativeKey(channelID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load initiative tracker")
+	}
+	if data == nil {
+		return tracker, nil
+	}
+	if err := json.Unmarshal(data, tracker); err != nil {
+		return nil, errors.Wrap(err, "failed to decode initiative tracker")
+	}
+	return tracker, nil
+}
+
+func (p *Plugin) setInitiativeTracker(channelID string, tracker *initiativeTracker) error {
+	data, err := json.Marshal(tracker)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode initiative tracker")
+	}
+	if appErr := p.API.KVSet(initiativeKey(channelID), data); appErr != nil {
+		return errors.Wrap(appErr, "failed to save initiative tracker")
+	}
+	return nil
+}
+
+// executeInitiativeCommand handles the `/init` command.
+func (p *Plugin) executeInitiativeCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	subcommand, rest := splitFirstWord(query)
+	if subcommand == "" || subcommand == "help" {
+		return ephemeralResponse(initiativeHelpText), nil
+	}
+
+	conf, err := p.getEffectiveConfiguration(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the channel configuration.", err)
+	}
+
+	p.initiativeLock.Lock()
+	defer p.initiativeLock.Unlock()
+
+	tracker, err := p.getInitiativeTracker(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the initiative tracker.", err)
+	}
+
+	switch subcommand {
+	case "show":
+		return ephemeralResponse(tracker.render()), nil
+	case "roll":
+		if appErr := p.rollInitiative(args, tracker, rest, conf); appErr != nil {
+			return nil, appErr
+		}
+	case "add":
+		name, expr := splitFirstWord(rest)
+		if expr == "" {
+			return nil, appError("Usage: `/init add <name> <expression>`.", nil)
+		}
+		// splitFirstWord lowercases the name.
+		name = strings.Fields(rest)[0]
+		if len(name) > maxInitiativeNameLength {
+			return nil, appError(fmt.Sprintf("The name of a combatant can be at most %d characters long.", maxInitiativeNameLength), nil)
+		}
+		post, rolled, entry, appErr := p.rollInitiativeEntry(args, name, expr, conf)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if err = tracker.add(*entry); err != nil {
+			return nil, appError(err.Error()+".", err)
+		}
+		post.Message = fmt.Sprintf("Initiative for **%s**: %s", name, post.Message)
+		if _, appErr = p.createRollPost(post, rolled, expr, args.UserId); appErr != nil {
+			return nil, appErr
+		}
+	case "remove":
+		name := strings.TrimSpace(rest)
+		key := initiativeEntry{Name: name}.key()
+		if strings.HasPrefix(name, "@") {
+			user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(name, "@"))
+			if appErr != nil {
+				return nil, appError(fmt.Sprintf("Cannot find user `%s`.", name), appErr)
+			}
+			key = initiativeEntry{UserID: user.Id}.key()
+		} else if name == "" || name == "me" {
+			key = initiativeEntry{UserID: args.UserId}.key()
+		}
+		if tracker.find(key) < 0 {
+			return nil, appError(fmt.Sprintf("There is no combatant `%s`.", name), nil)
+		}
+		tracker.remove(key)
+	case "next":
+		if len(tracker.Entries) == 0 {
+			return nil, appError("There are no combatants: Use `/init roll` or `/init add <name> <expression>` first.", nil)
+		}
+		tracker.next()
+		if appErr := p.announceTurn(args, tracker); appErr != nil {
+			return nil, appErr
+		}
+	case "end":
+		if appErr := p.endInitiative(args, tracker); appErr != nil {
+			return nil, appErr
+		}
+		return &model.CommandResponse{}, nil
+	default:
+		return nil, appError("Usage: `/init [roll [expression]|add <name> <expression>|remove <name>|next|show|end]`.", nil)
+	}
+
+	if appErr := p.updateInitiativePost(args, tracker); appErr != nil {
+		return nil, appErr
+	}
+	if err = p.setInitiativeTracker(args.ChannelId, tracker); err != nil {
+		return nil, appError("Cannot save the initiative tracker.", err)
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// rollInitiative rolls the initiative of the caller, using the given expression, or
+// the initiative command of a game system with the caller's character sheet, or a d20.
+func (p *Plugin) rollInitiative(args *model.CommandArgs, tracker *initiativeTracker, query string, conf configuration) *model.AppError {
+	expr := query
+	if command, ok := conf.gameSystemCommand("init"); ok {
+		sheets, err := p.getCharacterSheets(args.UserId)
+		if err != nil {
+			return appError("Cannot load your character sheets.", err)
+		}
+		if sheetExpr, err := command(query, sheets.active()); err == nil {
+			expr = sheetExpr
+		}
+	}
+	if expr == "" {
+		expr = "d20 Initiative"
+	}
+	displayName, appErr := p.getDisplayName(args.UserId)
+	if appErr != nil {
+		return appErr
+	}
+	post, rolled, entry, appErr := p.rollInitiativeEntry(args, displayName, expr, conf)
+	if appErr != nil {
+		return appErr
+	}
+	entry.UserID = args.UserId
+	if err := tracker.add(*entry); err != nil {
+		return appError(err.Error()+".", err)
+	}
+	_, appErr = p.createRollPost(post, rolled, expr, args.UserId)
+	return appErr
+}
+
+// rollInitiativeEntry rolls an initiative expression, returning the post showing the
+// roll, the rolled expression and the resulting entry.
+func (p *Plugin) rollInitiativeEntry(args *model.CommandArgs, name, expr string, conf configuration) (*model.Post, *Node, *initiativeEntry, *model.AppError) {
+	roller, proof, err := p.publicRoller(conf, args.UserId, args.ChannelId, "")
+	if err != nil {
+		return nil, nil, nil, appError("Cannot load the server seed.", err)
+	}
+	post, rolled, appErr := p.generateDiceRoll(expr, args.UserId, args.ChannelId, args.RootId, roller, conf)
+	if appErr != nil {
+		return nil, nil, nil, appErr
+	}
+	if _, ok := rolled.sp.(CommaList); ok && len(rolled.child) != 1 {
+		return nil, nil, nil, appError("Initiative is rolled with a single expression.", nil)
+	}
+	total := rolled.value()
+	if total.IsNaN() {
+		return nil, nil, nil, appError("Initiative is rolled with a number expression.", nil)
+	}
+	proof.addToPost(post)
+	return post, rolled, &initiativeEntry{
+		Name:     name,
+		Total:    total.String(),
+		Expected: rolled.prob().ExpectedValue().String(),
+		Tiebreak: p.newRoller()(1000000),
+	}, nil
+}
+
+// announceTurn tells the channel whose turn it is, mentioning players.
+func (p *Plugin) announceTurn(args *model.CommandArgs, tracker *initiativeTracker) *model.AppError {
+	entry := tracker.Entries[tracker.find(tracker.Current)]
+	name := "**" + entry.Name + "**"
+	if entry.UserID != "" {
+		user, appErr := p.API.GetUser(entry.UserID)
+		if appErr != nil {
+			return appErr
+		}
+		name = "@" + user.Username
+	}
+	_, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: args.ChannelId,
+		Message:   fmt.Sprintf("Round %d: %s is up!", tracker.Round, name),
+	})
+	return appErr
+}
+
+// updateInitiativePost shows the tracker in its pinned post, creating the post if
+// needed.
+func (p *Plugin) updateInitiativePost(args *model.CommandArgs, tracker *initiativeTracker) *model.AppError {
+	if tracker.PostID != "" {
+		post, appErr := p.API.GetPost(tracker.PostID)
+		if appErr == nil {
+			post.Message = tracker.render()
+			_, appErr = p.API.UpdatePost(post)
+			return appErr
+		}
+		// The post was deleted: create another one.
+	}
+	post, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: args.ChannelId,
+		Message:   tracker.render(),
+		IsPinned:  true,
+	})
+	if appErr != nil {
+		return appErr
+	}
+	tracker.PostID = post.Id
+	return nil
+}
+
+// endInitiative ends the combat, unpinning the tracker post and forgetting the tracker.
+func (p *Plugin) endInitiative(args *model.CommandArgs, tracker *initiativeTracker) *model.AppError {
+	if tracker.PostID != "" {
+		if post, appErr := p.API.GetPost(tracker.PostID); appErr == nil {
+			post.Message = tracker.render() + fmt.Sprintf("\n\nCombat ended after %d rounds.", tracker.Round)
+			post.IsPinned = false
+			if _, appErr = p.API.UpdatePost(post); appErr != nil {
+				return appErr
+			}
+		}
+	}
+	if appErr := p.API.KVDelete(initiativeKey(args.ChannelId)); appErr != nil {
+		return appError("Cannot delete the initiative tracker.", appErr)
+	}
+	return nil
+}
+
+const initiativeHelpText = "Use `/init` to track the turn order of a combat in this channel:\n" +
+	"- `/init roll [expression]` rolls your initiative, with your character sheet if you have one, or `d20` by default.\n" +
+	"- `/init add <name> <expression>` rolls the initiative of an NPC, e.g. `/init add Goblin 1d20+2`.\n" +
+	"- `/init next` moves to the next turn and mentions whoever is up.\n" +
+	"- `/init remove <name>|@user|me` removes a combatant.\n" +
+	"- `/init show` shows the turn order, which is also kept in a pinned post.\n" +
+	"- `/init end` ends the combat.\n\n" +
+	"Ties go to the higher bonus, then to players, then are broken at random."
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitiativeTrackerOrder(t *testing.T) {
+	tracker := &initiativeTracker{}
+	for _, entry := range []initiativeEntry{
+		{Name: "Goblin", Total: "12", Expected: "25/2", Tiebreak: 5},
+		{Name: "Alice", UserID: "alice", Total: "15", Expected: "23/2", Tiebreak: 1},
+		{Name: "Orc", Total: "12", Expected: "23/2", Tiebreak: 9},
+		{Name: "Bob", UserID: "bob", Total: "12", Expected: "23/2", Tiebreak: 2},
+		{Name: "Wolf", Total: "12", Expected: "23/2", Tiebreak: 7},
+	} {
+		assert.Nil(t, tracker.add(entry))
+	}
+	names := func() []string {
+		ret := []string{}
+		for _, e := range tracker.Entries {
+			ret = append(ret, e.Name)
+		}
+		return ret
+	}
+	// Higher total, then higher bonus, then players, then tie break.
+	assert.Equal(t, []string{"Alice", "Goblin", "Bob", "Orc", "Wolf"}, names())
+
+	// Re-adding replaces.
+	assert.Nil(t, tracker.add(initiativeEntry{Name: "goblin", Total: "1", Expected: "11/2"}))
+	assert.Equal(t, []string{"Alice", "Bob", "Orc", "Wolf", "goblin"}, names())
+
+	// Turns and rounds.
+	tracker.next()
+	assert.Equal(t, 1, tracker.Round)
+	assert.Equal(t, "user:alice", tracker.Current)
+	for i := 0; i < 4; i++ {
+		tracker.next()
+	}
+	assert.Equal(t, "npc:goblin", tracker.Current)
+	tracker.next()
+	assert.Equal(t, 2, tracker.Round)
+	assert.Equal(t, "user:alice", tracker.Current)
+
+	// Removing the current combatant passes the turn on.
+	tracker.remove("user:alice")
+	assert.Equal(t, 2, tracker.Round)
+	assert.Equal(t, "user:bob", tracker.Current)
+	tracker.next()
+	tracker.next()
+	tracker.next()
+	assert.Equal(t, "npc:goblin", tracker.Current)
+	tracker.remove("npc:goblin")
+	assert.Equal(t, 3, tracker.Round)
+	assert.Equal(t, "user:bob", tracker.Current)
+	assert.Equal(t, []string{"Bob", "Orc", "Wolf"}, names())
+
+	assert.Equal(t, "**Initiative**: round 3\n\n|Turn|Name|Initiative|\n|:-:|-|-|\n|▶|Bob|12|\n||Orc|12|\n||Wolf|12|", tracker.render())
+}
+
+func TestInitiativeCommand(t *testing.T) {
+	p, api := initTestPlugin()
+	store := mockPostStore(api)
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", TeamId: "team1"}, nil)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(command string) (*model.CommandResponse, *model.AppError) {
+		store.posts = nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    "userid",
+			ChannelId: "channel1",
+		})
+	}
+
+	resp, err := run("/init")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "/init next")
+	_, err = run("/init next")
+	assert.NotNil(t, err)
+
+	_, err = run("/init add Goblin 20")
+	assert.Nil(t, err)
+	if assert.Len(t, store.posts, 2) {
+		assert.Equal(t, "Initiative for **Goblin**: **User** rolls 20 = **20**", store.posts[0].Message)
+		assert.True(t, store.posts[1].IsPinned)
+		assert.Equal(t, "**Initiative**\n\n|Turn|Name|Initiative|\n|:-:|-|-|\n||Goblin|20|\n\nUse `/init next` to start.", store.posts[1].Message)
+	}
+	trackerPost := store.posts[1]
+
+	_, err = run("/init roll 5")
+	assert.Nil(t, err)
+	if assert.Len(t, store.posts, 1) {
+		assert.Equal(t, "**User** rolls 5 = **5**", store.posts[0].Message)
+	}
+	assert.Equal(t, trackerPost.Id, store.updated.Id)
+	assert.Contains(t, store.updated.Message, "||Goblin|20|\n||User|5|")
+
+	_, err = run("/init next")
+	assert.Nil(t, err)
+	if assert.Len(t, store.posts, 1) {
+		assert.Equal(t, "Round 1: **Goblin** is up!", store.posts[0].Message)
+	}
+	_, err = run("/init next")
+	assert.Nil(t, err)
+	if assert.Len(t, store.posts, 1) {
+		assert.Equal(t, "Round 1: @user is up!", store.posts[0].Message)
+	}
+	assert.Contains(t, store.updated.Message, "**Initiative**: round 1")
+	assert.Contains(t, store.updated.Message, "|▶|User|5|")
+
+	_, err = run("/init add Goblin 1d20+, 2")
+	assert.NotNil(t, err)
+	_, err = run("/init add Goblin 1, 2")
+	assert.NotNil(t, err)
+	_, err = run("/init remove Orc")
+	assert.NotNil(t, err)
+	_, err = run("/init remove goblin")
+	assert.Nil(t, err)
+	assert.NotContains(t, store.updated.Message, "Goblin")
+
+	_, err = run("/init end")
+	assert.Nil(t, err)
+	assert.False(t, store.updated.IsPinned)
+	assert.Contains(t, store.updated.Message, "Combat ended after 1 rounds.")
+	resp, err = run("/init show")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "No combatants yet")
+
+	// In channels with fair rolls, initiative rolls are fair.
+	p.configuration.EnableFairRolls = true
+	_, err = run("/init add Goblin 1d20")
+	assert.Nil(t, err)
+	if assert.NotEmpty(t, store.posts) {
+		assert.NotNil(t, store.posts[0].GetProp(fairRollProp))
+		assert.Contains(t, store.posts[0].Message, "*Provably fair roll with nonce ")
+	}
+}
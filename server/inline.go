@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// Inline rolls: `[[expression]]` in an ordinary message is rolled and replaced by its
+// result, e.g. "I swing my axe [[1d20+5]] at the orc".
+
+const (
+	// Only the first inline rolls of a message are rolled.
+	maxInlineRolls = 10
+	// Post prop holding the token of the pending inline rolls of a post.
+	inlineRollsProp = "dice_inline_rolls"
+	// Pending inline rolls are dropped after a minute, e.g. if the post was rejected.
+	maxPendingInlineRollsAge = time.Minute
+)
+
+var inlineRollRegex = regexp.MustCompile(`\[\[([^\[\]\n]+)\]\]`)
+
+// inlineRoll is a rolled inline roll, along with its proof if it is a fair roll.
+type inlineRoll struct {
+	expression string
+	rolled     Node
+	proof      *fairRoll
+}
+
+// pendingInlineRolls are the inline rolls of a post, kept in memory from
+// MessageWillBePosted until MessageHasBeenPosted posts them.
+type pendingInlineRolls struct {
+	userID    string
+	channelID string
+	posts     []*model.Post
+	rolls     []inlineRoll
+	created   time.Time
+}
+
+// MessageWillBePosted rolls the inline rolls of a message. Each is replaced by its
+// result, and their posts are kept until MessageHasBeenPosted posts them in the thread,
+// under a token held by the post props. Expressions that cannot be parsed are left as
+// they are.
+func (p *Plugin) MessageWillBePosted(_ *plugin.Context, post *model.Post) (*model.Post, string) {
+	// Users can set any props: only tokens set here count.
+	var changed *model.Post
+	if post.GetProp(inlineRollsProp) != nil {
+		post.DelProp(inlineRollsProp)
+		changed = post
+	}
+	if post.UserId == p.diceBotID || post.IsSystemMessage() || !strings.Contains(post.Message, "[[") {
+		return changed, ""
+	}
+	conf, err := p.getEffectiveConfiguration(post.ChannelId)
+	if err != nil {
+		p.API.LogWarn("Cannot load the channel configuration for inline rolls.", "error", err.Error())
+		return changed, ""
+	}
+	message, rolls, err := p.rollInline(post.Message, post.UserId, post.ChannelId, func() (Roller, *fairRoll, error) {
+		return p.publicRoller(conf, post.UserId, post.ChannelId, "")
+	}, conf)
+	if err != nil {
+		p.API.LogWarn("Cannot roll inline rolls.", "error", err.Error())
+		return changed, ""
+	}
+	if len(rolls) == 0 {
+		return changed, ""
+	}
+	displayName, appErr := p.getDisplayName(post.UserId)
+	if appErr != nil {
+		p.API.LogWarn("Cannot find the author of inline rolls.", "error", appErr.Error())
+		return changed, ""
+	}
+	pending := &pendingInlineRolls{userID: post.UserId, channelID: post.ChannelId, rolls: rolls, created: time.Now()}
+	for _, roll := range rolls {
+		rollPost := p.newRollPost(displayName, roll.expression, post.ChannelId, "", roll.rolled, conf)
+		roll.proof.addToPost(rollPost)
+		pending.posts = append(pending.posts, rollPost)
+	}
+	token := model.NewId()
+	p.addPendingInlineRolls(token, pending)
+
+	post.Message = message
+	post.AddProp(inlineRollsProp, token)
+	return post, ""
+}
+
+// MessageHasBeenPosted posts the inline rolls of a post in its thread.
+func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
+	token, ok := post.GetProp(inlineRollsProp).(string)
+	if !ok || token == "" || post.UserId == p.diceBotID {
+		return
+	}
+	pending := p.takePendingInlineRolls(token)
+	if pending == nil || pending.userID != post.UserId || pending.channelID != post.ChannelId {
+		return
+	}
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+	for i, rollPost := range pending.posts {
+		rollPost.RootId = rootID
+		roll := pending.rolls[i]
+		if _, appErr := p.createRollPost(rollPost, &roll.rolled, roll.expression, post.UserId); appErr != nil {
+			p.API.LogWarn("Cannot post an inline roll.", "error", appErr.Error())
+		}
+	}
+}
+
+// addPendingInlineRolls keeps the inline rolls of a post until it is posted, dropping
+// the rolls of posts that never were.
+func (p *Plugin) addPendingInlineRolls(token string, pending *pendingInlineRolls) {
+	p.inlineLock.Lock()
+	defer p.inlineLock.Unlock()
+	if p.inlineRolls == nil {
+		p.inlineRolls = make(map[string]*pendingInlineRolls)
+	}
+	for t, old := range p.inlineRolls {
+		if time.Since(old.created) > maxPendingInlineRollsAge {
+			delete(p.inlineRolls, t)
+		}
+	}
+	p.inlineRolls[token] = pending
+}
+
+// takePendingInlineRolls returns and forgets the inline rolls of a token, or nil if
+// there are none.
+func (p *Plugin) takePendingInlineRolls(token string) *pendingInlineRolls {
+	p.inlineLock.Lock()
+	defer p.inlineLock.Unlock()
+	pending := p.inlineRolls[token]
+	delete(p.inlineRolls, token)
+	return pending
+}
+
+// rollInline rolls the inline rolls of a message, each with a roller from newRoller,
+// returning the message with the results in place and the rolls.
+func (p *Plugin) rollInline(message, userID, channelID string, newRoller func() (Roller, *fairRoll, error), conf configuration) (string, []inlineRoll, error) {
+	rolls := []inlineRoll{}
+	var err error
+	message = inlineRollRegex.ReplaceAllStringFunc(message, func(match string) string {
+		if len(rolls) >= maxInlineRolls || err != nil {
+			return match
+		}
+		query := strings.TrimSpace(match[2 : len(match)-2])
+		parsed, parseErr := p.parseQuery(query, userID, channelID, conf)
+		if parseErr != nil {
+			return match
+		}
+		var roller Roller
+		var proof *fairRoll
+		if roller, proof, err = newRoller(); err != nil {
+			return match
+		}
+		rolled := parsed.roll(roller, conf)
+		rolls = append(rolls, inlineRoll{expression: query, rolled: rolled, proof: proof})
+		return renderInlineResult(query, rolled)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return message, rolls, nil
+}
+
+// Render the compact result of an inline roll, e.g. "`1d20+5` = **17**".
+func renderInlineResult(query string, rolled Node) string {
+	results := []string{}
+	if _, ok := rolled.sp.(CommaList); ok && len(rolled.child) > 1 {
+		for _, c := range rolled.child {
+			results = append(results, c.value().Render("b"))
+		}
+	} else {
+		results = append(results, rolled.value().Render("b"))
+	}
+	return fmt.Sprintf("`%s` = %s", query, strings.Join(results, ", "))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineRolls(t *testing.T) {
+	p, api := initTestPlugin()
+	p.diceBotID = "botid"
+	store := mockPostStore(api)
+	assert.Nil(t, p.OnActivate())
+
+	write := func(message string) *model.Post {
+		return &model.Post{Id: "postid", UserId: "userid", ChannelId: "channel1", Message: message}
+	}
+
+	post, rejection := p.MessageWillBePosted(&plugin.Context{}, write("I swing my axe [[2+3]] at the orc, twice [[ 1, 2*4 ]]."))
+	assert.Equal(t, "", rejection)
+	if assert.NotNil(t, post) {
+		assert.Equal(t, "I swing my axe `2+3` = **5** at the orc, twice `1, 2*4` = **1**, **8**.", post.Message)
+
+		// Each roll is posted as a regular roll, and recorded in the history.
+		p.MessageHasBeenPosted(&plugin.Context{}, post)
+		if assert.Len(t, store.posts, 2) {
+			assert.Equal(t, "**User** rolls 2+3 = **5**", store.posts[0].Message)
+			assert.Equal(t, "**User** rolls 1, 2×4 = **1**, **8**", store.posts[1].Message)
+			for _, rollPost := range store.posts {
+				assert.Equal(t, "botid", rollPost.UserId)
+				assert.Equal(t, "channel1", rollPost.ChannelId)
+				assert.Equal(t, "postid", rollPost.RootId)
+				assert.NotNil(t, rollPost.GetProp(rollProp))
+			}
+		}
+		records, _ := p.getRollHistory("channel1")
+		assert.Len(t, records, 2)
+
+		// The rolls are only posted once.
+		p.MessageHasBeenPosted(&plugin.Context{}, post)
+		assert.Len(t, store.posts, 2)
+	}
+
+	post, _ = p.MessageWillBePosted(&plugin.Context{}, write("[[d20]] and [[hahaha]] and [[See the wiki]]"))
+	if assert.NotNil(t, post) {
+		assert.Regexp(t, regexp.MustCompile("^`d20` = \\*\\*\\d+\\*\\* and \\[\\[hahaha\\]\\] and \\[\\[See the wiki\\]\\]$"), post.Message)
+	}
+
+	// A reply in a thread gets the detail in the same thread.
+	store.posts = nil
+	reply := write("[[1]]")
+	reply.RootId = "rootid"
+	post, _ = p.MessageWillBePosted(&plugin.Context{}, reply)
+	if assert.NotNil(t, post) {
+		p.MessageHasBeenPosted(&plugin.Context{}, post)
+		if assert.Len(t, store.posts, 1) {
+			assert.Equal(t, "rootid", store.posts[0].RootId)
+		}
+	}
+
+	// Users cannot make the bot post anything by setting the prop themselves.
+	store.posts = nil
+	forged := write("No roll here")
+	forged.AddProp(inlineRollsProp, "**User** rolls 1d20 = **20**")
+	post, _ = p.MessageWillBePosted(&plugin.Context{}, forged)
+	if assert.NotNil(t, post) {
+		assert.Nil(t, post.GetProp(inlineRollsProp))
+	}
+	p.MessageHasBeenPosted(&plugin.Context{}, forged)
+	assert.Len(t, store.posts, 0)
+
+	// The rolls of a post are only posted for that post.
+	post, _ = p.MessageWillBePosted(&plugin.Context{}, write("[[1]]"))
+	if assert.NotNil(t, post) {
+		other := write("No roll here")
+		other.UserId = "otheruser"
+		other.AddProp(inlineRollsProp, post.GetProp(inlineRollsProp))
+		p.MessageHasBeenPosted(&plugin.Context{}, other)
+		assert.Len(t, store.posts, 0)
+	}
+
+	// In channels with fair rolls, inline rolls are fair.
+	p.configuration.EnableFairRolls = true
+	post, _ = p.MessageWillBePosted(&plugin.Context{}, write("[[1d20]]"))
+	if assert.NotNil(t, post) {
+		p.MessageHasBeenPosted(&plugin.Context{}, post)
+		if assert.Len(t, store.posts, 1) {
+			assert.NotNil(t, store.posts[0].GetProp(fairRollProp))
+			assert.Contains(t, store.posts[0].Message, "*Provably fair roll")
+		}
+	}
+	p.configuration.EnableFairRolls = false
+
+	// Messages without valid inline rolls are left alone.
+	for _, message := range []string{"No roll here", "[[hahaha]]", "[[$dex]]", "[1d20]"} {
+		post, rejection = p.MessageWillBePosted(&plugin.Context{}, write(message))
+		assert.Nil(t, post, message)
+		assert.Equal(t, "", rejection, message)
+	}
+	botPost := write("[[1d20]]")
+	botPost.UserId = "botid"
+	post, _ = p.MessageWillBePosted(&plugin.Context{}, botPost)
+	assert.Nil(t, post)
+
+	store.posts = nil
+	p.MessageHasBeenPosted(&plugin.Context{}, write("No roll here"))
+	assert.Len(t, store.posts, 0)
+}
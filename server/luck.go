@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/pd"
+)
+
+// Luck statistics: how the dice of the roll history compare with fair dice.
+
+const (
+	// Dice with more sides only get a summary, not a histogram.
+	maxHistogramSides = 20
+	maxHistogramBar   = 20
+	// The chi-squared test is unreliable when fewer rolls are expected per face.
+	minExpectedPerFace = 5
+)
+
+// The faces of a kind of dice, as recorded in diceRecord.Dice.
+type diceFaces struct {
+	name     string
+	low      int // lowest face
+	sides    int
+	expected PD // distribution of one die
+}
+
+func parseDiceFaces(dice string) (diceFaces, bool) {
+	if dice == "dF" {
+		return diceFaces{name: dice, low: -1, sides: 3, expected: pd.Dice(1, 3, 0, 0).Minus(pd.Constant(itobr(2)))}, true
+	}
+	sides, err := strconv.Atoi(strings.TrimPrefix(dice, "d"))
+	if !strings.HasPrefix(dice, "d") || err != nil || sides < 2 {
+		return diceFaces{}, false
+	}
+	return diceFaces{name: dice, low: 1, sides: sides, expected: pd.Dice(1, sides, 0, 0)}, true
+}
+
+// Counts of each face of one kind of dice.
+type faceHistogram struct {
+	faces  diceFaces
+	counts []int
+	total  int
+}
+
+// Return the histograms of the dice in the records, ordered by number of sides.
+func luckHistograms(records []rollRecord) []*faceHistogram {
+	byDice := map[string]*faceHistogram{}
+	for _, r := range records {
+		for _, d := range r.Dice {
+			h, ok := byDice[d.Dice]
+			if !ok {
+				faces, ok := parseDiceFaces(d.Dice)
+				if !ok {
+					continue
+				}
+				h = &faceHistogram{faces: faces, counts: make([]int, faces.sides)}
+				byDice[d.Dice] = h
+			}
+			for _, result := range d.Results {
+				if i := result - h.faces.low; 0 <= i && i < h.faces.sides {
+					h.counts[i]++
+					h.total++
+				}
+			}
+		}
+	}
+	ret := []*faceHistogram{}
+	for _, h := range byDice {
+		ret = append(ret, h)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].faces.sides != ret[j].faces.sides {
+			return ret[i].faces.sides < ret[j].faces.sides
+		}
+		return ret[i].faces.name < ret[j].faces.name
+	})
+	return ret
+}
+
+func (h *faceHistogram) average() float64 {
+	sum := 0
+	for i, c := range h.counts {
+		sum += (h.faces.low + i) * c
+	}
+	return float64(sum) / float64(h.total)
+}
+
+// Return the chi-squared p-value of the counts against fair dice.
+func (h *faceHistogram) pValue() float64 {
+	expected := make([]float64, h.faces.sides)
+	for i := range expected {
+		expected[i] = float64(h.total) / float64(h.faces.sides)
+	}
+	_, p := pd.ChiSquaredTest(h.counts, expected)
+	return p
+}
+
+func (h *faceHistogram) render() string {
+	text := fmt.Sprintf("**%s**: %d dice, average %.2f (expected %.2f), fairness p-value %.3f",
+		h.faces.name, h.total, h.average(), h.faces.expected.ExpectedValue().Float64(), h.pValue())
+	if float64(h.total)/float64(h.faces.sides) < minExpectedPerFace {
+		text += " (too few dice for a reliable test)"
+	}
+	if h.faces.sides > maxHistogramSides {
+		return text
+	}
+	highest := 0
+	for _, c := range h.counts {
+		if c > highest {
+			highest = c
+		}
+	}
+	text += "\n\n|Face|Count||\n|-:|-:|-|"
+	for i, c := range h.counts {
+		bar := 0
+		if highest > 0 {
+			bar = int(math.Round(float64(c) * maxHistogramBar / float64(highest)))
+		}
+		text += fmt.Sprintf("\n|%d|%d|%s|", h.faces.low+i, c, strings.Repeat("█", bar))
+	}
+	return text
+}
+
+// executeLuckCommand handles `/roll stats me|channel`.
+func (p *Plugin) executeLuckCommand(args *model.CommandArgs, who string) (*model.CommandResponse, *model.AppError) {
+	records, err := p.getRollHistory(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the roll history.", err)
+	}
+	title := "Luck statistics of this channel"
+	if who == "me" {
+		displayName, appErr := p.getDisplayName(args.UserId)
+		if appErr != nil {
+			return nil, appErr
+		}
+		title = fmt.Sprintf("Luck statistics of **%s** in this channel", displayName)
+		mine := []rollRecord{}
+		for _, r := range records {
+			if r.UserID == args.UserId {
+				mine = append(mine, r)
+			}
+		}
+		records = mine
+	}
+
+	histograms := luckHistograms(records)
+	if len(histograms) == 0 {
+		return ephemeralResponse(title + ": No dice rolled yet."), nil
+	}
+	parts := []string{fmt.Sprintf("%s, from the last %d rolls:", title, len(records))}
+	for _, h := range histograms {
+		parts = append(parts, h.render())
+	}
+	parts = append(parts, "A fairness p-value is the chance that fair dice give results at least this uneven. A value below 0.01 means very unusual luck, or unfair dice.")
+	return ephemeralResponse(strings.Join(parts, "\n\n")), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLuckStatistics(t *testing.T) {
+	p, _ := initTestPlugin()
+	assert.Nil(t, p.OnActivate())
+
+	run := func(command string) (*model.CommandResponse, *model.AppError) {
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    "userid",
+			ChannelId: "channel1",
+		})
+	}
+
+	resp, err := run("/roll stats me")
+	assert.Nil(t, err)
+	assert.Equal(t, "Luck statistics of **User** in this channel: No dice rolled yet.", resp.Text)
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, p.appendRollHistory("channel1", rollRecord{UserID: "userid", Dice: []diceRecord{
+			{Dice: "d4", Results: []int{1, 2, 3, 4}},
+			{Dice: "dF", Results: []int{-1, 1}},
+		}}))
+	}
+	assert.Nil(t, p.appendRollHistory("channel1", rollRecord{UserID: "otherid", Dice: []diceRecord{
+		{Dice: "d4", Results: []int{4, 4, 4, 4, 4, 4, 4, 4, 4, 4}},
+		{Dice: "d100", Results: []int{100}},
+		{Dice: "d1", Results: []int{1}},
+	}}))
+
+	resp, err = run("/roll stats me")
+	assert.Nil(t, err)
+	assert.Equal(t, "Luck statistics of **User** in this channel, from the last 5 rolls:\n\n"+
+		"**dF**: 10 dice, average 0.00 (expected 0.00), fairness p-value 0.082 (too few dice for a reliable test)\n\n"+
+		"|Face|Count||\n|-:|-:|-|\n|-1|5|████████████████████|\n|0|0||\n|1|5|████████████████████|\n\n"+
+		"**d4**: 20 dice, average 2.50 (expected 2.50), fairness p-value 1.000\n\n"+
+		"|Face|Count||\n|-:|-:|-|\n|1|5|████████████████████|\n|2|5|████████████████████|\n|3|5|████████████████████|\n|4|5|████████████████████|\n\n"+
+		"A fairness p-value is the chance that fair dice give results at least this uneven. A value below 0.01 means very unusual luck, or unfair dice.", resp.Text)
+
+	resp, err = run("/roll stats channel")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "Luck statistics of this channel, from the last 6 rolls:")
+	assert.Contains(t, resp.Text, "**d4**: 30 dice, average 3.00 (expected 2.50), fairness p-value 0.019\n\n|Face|Count||\n|-:|-:|-|\n|1|5|███████|\n|2|5|███████|\n|3|5|███████|\n|4|15|████████████████████|")
+	assert.Contains(t, resp.Text, "**d100**: 1 dice, average 100.00 (expected 50.50), fairness p-value 0.481 (too few dice for a reliable test)\n\nA fairness")
+	assert.NotContains(t, resp.Text, "**d1**")
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// Macros: named roll expressions, referenced as `@name` in any roll expression.
+
+// Types
+type MacroRef struct {
+	name string // lower case name, without the @
+}
+
+const (
+	maxMacroNameLength = 32
+	maxMacroLength     = 500
+	maxMacroCount      = 100
+	// Maximum number of macros being expanded inside each other.
+	maxMacroDepth = 5
+	// Maximum number of macro expansions in one roll.
+	maxMacroExpansions = 50
+)
+
+var macroNameRegex = regexp.MustCompile(`^@([A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z0-9_]+)*)$`)
+
+// Roller
+func (sp MacroRef) roll(_ Node, _ Roller) NodeSpecialization { return sp }
+
+// Evaluate
+func (sp MacroRef) value(n Node) BR { return n.child[0].value() }
+
+// Render
+// A macro renders like its expansion, labeled with the macro name.
+func (sp MacroRef) render(n Node, ind string, rr int, rcok bool, options string) (string, string, string) {
+	return Labeled{label: "@" + sp.name}.render(n, ind, rr, rcok, options)
+}
+
+// roll comment
+func (sp MacroRef) rollComment(n Node, conf configuration) string {
+	return n.child[0].sp.rollComment(n.child[0], conf)
+}
+
+// Probability distributions
+func (sp MacroRef) prob(n Node) PD { return n.child[0].prob() }
+
+// Resolution
+// A resolver replaces the references in a parsed expression, i.e. macros and
+// character sheet values, by what they refer to, before the expression is rolled
+// or analyzed.
+type resolver struct {
+	parse          func(input string) (*Node, error)
+	lookupMacro    func(name string) (string, bool, error)
+	lookupVariable func(name string) (int, bool, error)
+	expansions     int      // number of macros expanded so far
+	stack          []string // names of the macros being expanded
+}
+
+func (r *resolver) resolve(n Node) (Node, error) {
+	switch sp := n.sp.(type) {
+	case MacroRef:
+		expansion, err := r.expand(sp.name)
+		if err != nil {
+			return Node{}, err
+		}
+		if _, ok := expansion.sp.(CommaList); !ok || len(expansion.child) != 1 {
+			return Node{}, fmt.Errorf("macro @%s cannot be used within an expression", sp.name)
+		}
+		return Node{token: n.token, child: []Node{expansion.child[0]}, sp: sp}, nil
+	case CommaList:
+		// A macro making up a whole comma separated item may hold several
+		// expressions, or special rolls like stats.
+		child := []Node{}
+		for _, c := range n.child {
+			if ref, ok := soleMacroRef(c); ok {
+				expansion, err := r.expand(ref.name)
+				if err != nil {
+					return Node{}, err
+				}
+				if _, ok := expansion.sp.(CommaList); !ok {
+					child = append(child, expansion)
+					continue
+				}
+				if len(expansion.child) > 1 {
+					child = append(child, expansion.child...)
+					continue
+				}
+				child = append(child, Node{token: c.token, child: []Node{expansion.child[0]}, sp: ref})
+				continue
+			}
+			rc, err := r.resolve(c)
+			if err != nil {
+				return Node{}, err
+			}
+			child = append(child, rc)
+		}
+		return Node{token: n.token, child: child, sp: n.sp}, nil
+	case Variable:
+		value, ok, err := r.lookupVariable(sp.name)
+		if err != nil {
+			return Node{}, err
+		}
+		if !ok {
+			return Node{}, fmt.Errorf("no value $%s on your character sheet", sp.name)
+		}
+		return Node{token: n.token, sp: Variable{name: sp.name, n: value}}, nil
+	default:
+		child := make([]Node, len(n.child))
+		for i, c := range n.child {
+			rc, err := r.resolve(c)
+			if err != nil {
+				return Node{}, err
+			}
+			child[i] = rc
+		}
+		return Node{token: n.token, child: child, sp: n.sp}, nil
+	}
+}
+
+// Return the parsed and resolved expression of a macro.
+func (r *resolver) expand(name string) (Node, error) {
+	for _, s := range r.stack {
+		if s == name {
+			return Node{}, fmt.Errorf("macro @%s refers to itself", name)
+		}
+	}
+	if len(r.stack) >= maxMacroDepth {
+		return Node{}, fmt.Errorf("macros nested too deeply in @%s", name)
+	}
+	r.expansions++
+	if r.expansions > maxMacroExpansions {
+		return Node{}, fmt.Errorf("too many macros")
+	}
+	expr, ok, err := r.lookupMacro(name)
+	if err != nil {
+		return Node{}, err
+	}
+	if !ok {
+		return Node{}, fmt.Errorf("unknown macro @%s", name)
+	}
+	parsed, err := r.parse(expr)
+	if err != nil {
+		return Node{}, fmt.Errorf("in macro @%s: %s", name, err.Error())
+	}
+	r.stack = append(r.stack, name)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+	return r.resolve(*parsed)
+}
+
+// Return the macro reference that a node consists of, looking through sums and
+// products of a single term.
+func soleMacroRef(n Node) (MacroRef, bool) {
+	switch sp := n.sp.(type) {
+	case MacroRef:
+		return sp, true
+	case Sum, Prod:
+		if len(n.child) == 1 {
+			return soleMacroRef(n.child[0])
+		}
+	}
+	return MacroRef{}, false
+}
+
+// parseQuery parses a roll expression for a user in a channel and resolves its
+// references.
+func (p *Plugin) parseQuery(query, userID, channelID string, conf configuration) (*Node, error) {
+	parse := p.getParser(conf)
+	parsed, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	r := &resolver{
+		parse:          parse,
+		lookupMacro:    p.macroLookup(userID, channelID, conf),
+		lookupVariable: p.variableLookup(userID),
+	}
+	resolved, err := r.resolve(*parsed)
+	if err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
+
+// macroLookup returns a function finding macros by name, looking in the user's
+// macros, then the channel's, then the team's, then the built-in macros. The
+// libraries are only loaded when a macro is looked up.
+func (p *Plugin) macroLookup(userID, channelID string, conf configuration) func(name string) (string, bool, error) {
+	var libraries []macroLibrary
+	return func(name string) (string, bool, error) {
+		if libraries == nil {
+			var err error
+			if libraries, err = p.getVisibleMacros(userID, channelID, conf); err != nil {
+				return "", false, err
+			}
+		}
+		for _, macros := range libraries {
+			if expr, ok := macros[name]; ok {
+				return expr, true, nil
+			}
+		}
+		return "", false, nil
+	}
+}
+
+// getVisibleMacros returns the macro libraries available to a user in a
+// channel, in lookup order.
+func (p *Plugin) getVisibleMacros(userID, channelID string, conf configuration) ([]macroLibrary, error) {
+	keys := []string{macrosKey(macroScopeUser, userID), macrosKey(macroScopeChannel, channelID)}
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load channel")
+	}
+	if channel.TeamId != "" {
+		keys = append(keys, macrosKey(macroScopeTeam, channel.TeamId))
+	}
+	libraries := []macroLibrary{}
+	for _, key := range keys {
+		macros, err := p.getMacros(key)
+		if err != nil {
+			return nil, err
+		}
+		libraries = append(libraries, macros)
+	}
+	return append(libraries, conf.builtinMacros()), nil
+}
+
+// Storage
+// A macroLibrary maps macro names to roll expressions.
+type macroLibrary map[string]string
+
+// Macro libraries are kept per user, channel or team.
+const (
+	macroScopeUser    = "user"
+	macroScopeChannel = "channel"
+	macroScopeTeam    = "team"
+)
+
+func macrosKey(scope, id string) string {
+	return "macros_" + scope + "_" + id
+}
+
+func (p *Plugin) getMacros(key string) (macroLibrary, error) {
+	macros := macroLibrary{}
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load macros")
+	}
+	if data == nil {
+		return macros, nil
+	}
+	if err := json.Unmarshal(data, &macros); err != nil {
+		return nil, errors.Wrap(err, "failed to decode macros")
+	}
+	return macros, nil
+}
+
+func (p *Plugin) setMacros(key string, macros macroLibrary) error {
+	data, err := json.Marshal(macros)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode macros")
+	}
+	if appErr := p.API.KVSet(key, data); appErr != nil {
+		return errors.Wrap(appErr, "failed to save macros")
+	}
+	return nil
+}
+
+// Parse a macro name like "@fireball", returning it in lower case without the @.
+func parseMacroName(s string) (string, error) {
+	m := macroNameRegex.FindStringSubmatch(s)
+	if m == nil || len(m[1]) > maxMacroNameLength {
+		return "", fmt.Errorf("invalid macro name `%s`: Use @ followed by up to %d letters, digits, underscores and dots", s, maxMacroNameLength)
+	}
+	return strings.ToLower(m[1]), nil
+}
+
+// Check that an expression can be saved as a macro.
+func (p *Plugin) validateMacro(expr string, conf configuration) error {
+	if len(expr) > maxMacroLength {
+		return fmt.Errorf("the expression of a macro can be at most %d characters long", maxMacroLength)
+	}
+	_, err := p.getParser(conf)(expr)
+	return err
+}
+
+// Commands
+// splitMacroScope reads an optional scope at the start of a macro command. It returns
+// the scope, the KV key of its macro library, and the rest of the query.
+func splitMacroScope(args *model.CommandArgs, query string) (string, string, string, *model.AppError) {
+	scope, rest := splitFirstWord(query)
+	switch scope {
+	case macroScopeUser:
+		return scope, macrosKey(scope, args.UserId), rest, nil
+	case macroScopeChannel:
+		return scope, macrosKey(scope, args.ChannelId), rest, nil
+	case macroScopeTeam:
+		if args.TeamId == "" {
+			return "", "", "", appError("There are no team macros outside of teams.", nil)
+		}
+		return scope, macrosKey(scope, args.TeamId), rest, nil
+	default:
+		return macroScopeUser, macrosKey(macroScopeUser, args.UserId), query, nil
+	}
+}
+
+// isMacroSaveCommand tells whether `/roll save ...` saves a macro, as opposed to a
+// game system's saving throw.
+func isMacroSaveCommand(query string) bool {
+	first, _ := splitFirstWord(query)
+	return strings.HasPrefix(first, "@") || first == macroScopeUser || first == macroScopeChannel || first == macroScopeTeam
+}
+
+// checkMacroPermission checks that the user can change the macros of a scope: channel
+// macros can be changed by channel admins, and team macros by team admins.
+func (p *Plugin) checkMacroPermission(args *model.CommandArgs, scope string) *model.AppError {
+	switch scope {
+	case macroScopeChannel:
+		if !p.API.HasPermissionToChannel(args.UserId, args.ChannelId, model.PermissionManageChannelRoles) {
+			return appError("Only channel admins can change the macros of a channel.", nil)
+		}
+	case macroScopeTeam:
+		if !p.API.HasPermissionToTeam(args.UserId, args.TeamId, model.PermissionManageTeam) {
+			return appError("Only team admins can change the macros of a team.", nil)
+		}
+	}
+	return nil
+}
+
+// executeSaveMacroCommand handles `/roll save [user|channel|team] @name <expression>`.
+func (p *Plugin) executeSaveMacroCommand(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	scope, key, query, appErr := splitMacroScope(args, query)
+	if appErr != nil {
+		return nil, appErr
+	}
+	nameStr, expr := splitFirstWord(query)
+	name, err := parseMacroName(nameStr)
+	if err != nil {
+		return nil, appError(err.Error()+".", err)
+	}
+	if expr == "" {
+		return nil, appError("Usage: `/roll save [user|channel|team] @name <expression>`.", nil)
+	}
+	if err = p.validateMacro(expr, conf); err != nil {
+		return nil, appError(fmt.Sprintf("%s: See `/roll help` for examples.", err.Error()), err)
+	}
+	if appErr = p.checkMacroPermission(args, scope); appErr != nil {
+		return nil, appErr
+	}
+
+	macros, err := p.getMacros(key)
+	if err != nil {
+		return nil, appError("Cannot load the macros.", err)
+	}
+	if _, ok := macros[name]; !ok && len(macros) >= maxMacroCount {
+		return nil, appError(fmt.Sprintf("There cannot be more than %d %s macros.", maxMacroCount, scope), nil)
+	}
+	macros[name] = expr
+	if err = p.setMacros(key, macros); err != nil {
+		return nil, appError("Cannot save the macros.", err)
+	}
+	return ephemeralResponse(fmt.Sprintf("Saved %s macro `@%s`: `%s`", scope, name, expr)), nil
+}
+
+// executeDeleteMacroCommand handles `/roll delete [user|channel|team] @name`.
+func (p *Plugin) executeDeleteMacroCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	scope, key, query, appErr := splitMacroScope(args, query)
+	if appErr != nil {
+		return nil, appErr
+	}
+	name, err := parseMacroName(strings.TrimSpace(query))
+	if err != nil {
+		return nil, appError(err.Error()+".", err)
+	}
+	if appErr = p.checkMacroPermission(args, scope); appErr != nil {
+		return nil, appErr
+	}
+	macros, err := p.getMacros(key)
+	if err != nil {
+		return nil, appError("Cannot load the macros.", err)
+	}
+	if _, ok := macros[name]; !ok {
+		return nil, appError(fmt.Sprintf("There is no %s macro `@%s`.", scope, name), nil)
+	}
+	delete(macros, name)
+	if err = p.setMacros(key, macros); err != nil {
+		return nil, appError("Cannot save the macros.", err)
+	}
+	return ephemeralResponse(fmt.Sprintf("Deleted %s macro `@%s`.", scope, name)), nil
+}
+
+// executeMacrosCommand handles `/roll macros [export [user|channel|team]|import [user|channel|team] <json>]`.
+func (p *Plugin) executeMacrosCommand(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	action, rest := splitFirstWord(query)
+	switch action {
+	case "":
+		return p.executeListMacrosCommand(args, conf)
+	case "export":
+		_, key, _, appErr := splitMacroScope(args, rest)
+		if appErr != nil {
+			return nil, appErr
+		}
+		macros, err := p.getMacros(key)
+		if err != nil {
+			return nil, appError("Cannot load the macros.", err)
+		}
+		data, err := json.MarshalIndent(macros, "", "  ")
+		if err != nil {
+			return nil, appError("Cannot encode the macros.", err)
+		}
+		return ephemeralResponse("```json\n" + string(data) + "\n```"), nil
+	case "import":
+		return p.executeImportMacrosCommand(args, rest, conf)
+	default:
+		return nil, appError("Usage: `/roll macros [export [user|channel|team]|import [user|channel|team] <json>]`.", nil)
+	}
+}
+
+// executeImportMacrosCommand adds the macros of a JSON object mapping names to
+// expressions, as exported by `/roll macros export`, replacing macros with the same name.
+func (p *Plugin) executeImportMacrosCommand(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	scope, key, query, appErr := splitMacroScope(args, query)
+	if appErr != nil {
+		return nil, appErr
+	}
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(query), "```json"), "```"))
+	imported := map[string]string{}
+	if err := json.Unmarshal([]byte(query), &imported); err != nil {
+		return nil, appError("Expected a JSON object mapping macro names to expressions.", err)
+	}
+	if appErr = p.checkMacroPermission(args, scope); appErr != nil {
+		return nil, appErr
+	}
+
+	macros, err := p.getMacros(key)
+	if err != nil {
+		return nil, appError("Cannot load the macros.", err)
+	}
+	for nameStr, expr := range imported {
+		name, err := parseMacroName("@" + strings.TrimPrefix(nameStr, "@"))
+		if err != nil {
+			return nil, appError(err.Error()+".", err)
+		}
+		if err = p.validateMacro(expr, conf); err != nil {
+			return nil, appError(fmt.Sprintf("In macro `@%s`: %s.", name, err.Error()), err)
+		}
+		macros[name] = expr
+	}
+	if len(macros) > maxMacroCount {
+		return nil, appError(fmt.Sprintf("There cannot be more than %d %s macros.", maxMacroCount, scope), nil)
+	}
+	if err = p.setMacros(key, macros); err != nil {
+		return nil, appError("Cannot save the macros.", err)
+	}
+	return ephemeralResponse(fmt.Sprintf("Imported %d %s macros.", len(imported), scope)), nil
+}
+
+// executeListMacrosCommand lists the macros available in the channel, leaving out those
+// hidden by a macro with the same name.
+func (p *Plugin) executeListMacrosCommand(args *model.CommandArgs, conf configuration) (*model.CommandResponse, *model.AppError) {
+	libraries, err := p.getVisibleMacros(args.UserId, args.ChannelId, conf)
+	if err != nil {
+		return nil, appError("Cannot load the macros.", err)
+	}
+	sources := []string{"personal", "channel", "team", "built-in"}
+	if len(libraries) == 3 {
+		// No team macros outside of teams.
+		sources = []string{"personal", "channel", "built-in"}
+	}
+	seen := map[string]bool{}
+	rows := []string{}
+	for i, macros := range libraries {
+		names := make([]string, 0, len(macros))
+		for name := range macros {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				rows = append(rows, fmt.Sprintf("\n|`@%s`|`%s`|%s|", name, macros[name], sources[i]))
+			}
+		}
+	}
+	if len(rows) == 0 {
+		return ephemeralResponse("There are no macros here. Use `/roll save @name <expression>` to create one."), nil
+	}
+	return ephemeralResponse("Macros available in this channel:\n\n|Macro|Expression|Source|\n|-|-|-|" + strings.Join(rows, "")), nil
+}
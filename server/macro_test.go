@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMacros(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts, ephemeralPosts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	})
+	api.On("SendEphemeralPost", mock.Anything, mock.AnythingOfType("*model.Post")).Return(nil).Run(func(args mock.Arguments) {
+		ephemeralPosts = append(ephemeralPosts, args.Get(1).(*model.Post))
+	})
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", TeamId: "team1"}, nil)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, command string) (*model.CommandResponse, *model.AppError) {
+		posts, ephemeralPosts = nil, nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    userID,
+			ChannelId: "channel1",
+		})
+	}
+
+	resp, err := run("userid", "/roll save @Goblin.Attack 2+3")
+	assert.Nil(t, err)
+	assert.Equal(t, "Saved user macro `@goblin.attack`: `2+3`", resp.Text)
+	_, err = run("userid", "/roll save @bonus 4")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll save @both 1, 2")
+	assert.Nil(t, err)
+
+	for _, testCase := range []struct {
+		query    string
+		expected string
+	}{
+		{query: "@goblin.attack", expected: "**User** rolls 2+3 = **5** @goblin.attack"},
+		{query: "@goblin.attack+@BONUS", expected: "**User** rolls 2+3+4 = **9**\n- *2+3 =* ***5*** *@goblin.attack*\n- *4 =* ***4*** *@bonus*"},
+		{query: "@bonus to hit", expected: "**User** rolls 4 = **4** @bonus to hit"},
+		{query: "@both, 3", expected: "**User** rolls 1, 2, 3 = **1**, **2**, **3**"},
+	} {
+		_, err = run("userid", "/roll "+testCase.query)
+		assert.Nil(t, err, testCase.query)
+		if assert.Len(t, posts, 1, testCase.query) {
+			assert.Equal(t, testCase.expected, posts[0].Message, testCase.query)
+		}
+	}
+
+	// Macros are personal.
+	_, err = run("otheruser", "/roll @bonus")
+	assert.NotNil(t, err)
+
+	// Macros with several expressions cannot be used within an expression.
+	_, err = run("userid", "/roll @both+1")
+	assert.NotNil(t, err)
+
+	// Macros can refer to each other, but not to themselves.
+	_, err = run("userid", "/roll save @double @bonus*2")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll @double")
+	assert.Nil(t, err)
+	assert.Equal(t, "**User** rolls 4×2 = **8** @double\n- *4 =* ***4*** *@bonus*", posts[0].Message)
+	_, err = run("userid", "/roll save @loop1 @loop2+1")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll save @loop2 @loop1+1")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll @loop1")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Message, "refers to itself")
+
+	// Deeply nested macros are refused.
+	for i := 0; i < maxMacroDepth+1; i++ {
+		_, err = run("userid", fmt.Sprintf("/roll save @deep%d @deep%d+1", i, i+1))
+		assert.Nil(t, err)
+	}
+	_, err = run("userid", "/roll save @deep6 1")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll @deep2")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll @deep1")
+	assert.NotNil(t, err)
+
+	// Invalid macros are refused.
+	for _, command := range []string{
+		"/roll save bonus 4",
+		"/roll save @bonus",
+		"/roll save @bonus 4+",
+		"/roll save @bonus. 4",
+		"/roll delete @unknown",
+	} {
+		_, err = run("userid", command)
+		assert.NotNil(t, err, command)
+	}
+
+	resp, err = run("userid", "/roll delete @bonus")
+	assert.Nil(t, err)
+	assert.Equal(t, "Deleted user macro `@bonus`.", resp.Text)
+	resp, err = run("userid", "/roll macros")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "|`@goblin.attack`|`2+3`|personal|")
+	assert.NotContains(t, resp.Text, "@bonus`")
+
+	// Analysis uses macros too.
+	_, err = run("userid", "/analyzeroll @goblin.attack")
+	assert.Nil(t, err)
+}
+
+func TestSharedMacros(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	})
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", TeamId: "team1"}, nil)
+	api.On("GetChannel", "channel2").Return(&model.Channel{Id: "channel2", TeamId: "team1"}, nil)
+	api.On("HasPermissionToChannel", "gmid", mock.Anything, model.PermissionManageChannelRoles).Return(true)
+	api.On("HasPermissionToChannel", "userid", mock.Anything, model.PermissionManageChannelRoles).Return(false)
+	api.On("HasPermissionToTeam", "gmid", "team1", model.PermissionManageTeam).Return(true)
+	api.On("HasPermissionToTeam", "userid", "team1", model.PermissionManageTeam).Return(false)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, channelID, command string) (*model.CommandResponse, *model.AppError) {
+		posts = nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    userID,
+			ChannelId: channelID,
+			TeamId:    "team1",
+		})
+	}
+	roll := func(userID, channelID, query string) string {
+		_, err := run(userID, channelID, "/roll "+query)
+		if !assert.Nil(t, err, query) || !assert.Len(t, posts, 1, query) {
+			return ""
+		}
+		return posts[0].Message
+	}
+
+	// Only admins can change shared macros.
+	_, err := run("userid", "channel1", "/roll save channel @goblin.attack 5")
+	assert.NotNil(t, err)
+	_, err = run("userid", "channel1", "/roll save team @goblin.attack 5")
+	assert.NotNil(t, err)
+	resp, err := run("gmid", "channel1", "/roll save channel @goblin.attack 5")
+	assert.Nil(t, err)
+	assert.Equal(t, "Saved channel macro `@goblin.attack`: `5`", resp.Text)
+	_, err = run("gmid", "channel1", "/roll save team @goblin.attack 4")
+	assert.Nil(t, err)
+	_, err = run("gmid", "channel1", "/roll save team @goblin.damage 3")
+	assert.Nil(t, err)
+
+	// Lookup order is user, channel, team, built-in.
+	assert.Equal(t, "**User** rolls 5 = **5** @goblin.attack", roll("userid", "channel1", "@goblin.attack"))
+	assert.Equal(t, "**User** rolls 4 = **4** @goblin.attack", roll("userid", "channel2", "@goblin.attack"))
+	assert.Equal(t, "**User** rolls 3 = **3** @goblin.damage", roll("userid", "channel1", "@goblin.damage"))
+	_, err = run("userid", "channel1", "/roll save @goblin.attack 6")
+	assert.Nil(t, err)
+	assert.Equal(t, "**User** rolls 6 = **6** @goblin.attack", roll("userid", "channel1", "@goblin.attack"))
+	assert.Contains(t, roll("userid", "channel1", "@adv"), "advantage")
+	_, err = run("userid", "channel1", "/roll save @adv 7")
+	assert.Nil(t, err)
+	assert.Equal(t, "**User** rolls 7 = **7** @adv", roll("userid", "channel1", "@adv"))
+
+	resp, err = run("userid", "channel1", "/roll macros")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "|`@adv`|`7`|personal|")
+	assert.Contains(t, resp.Text, "|`@dis`|`d20d disadvantage`|built-in|")
+	assert.Contains(t, resp.Text, "|`@goblin.attack`|`6`|personal|")
+	assert.Contains(t, resp.Text, "|`@goblin.damage`|`3`|team|")
+	assert.NotContains(t, resp.Text, "`5`")
+
+	// Macros can be exported and imported as JSON.
+	resp, err = run("userid", "channel1", "/roll macros export team")
+	assert.Nil(t, err)
+	assert.Equal(t, "```json\n{\n  \"goblin.attack\": \"4\",\n  \"goblin.damage\": \"3\"\n}\n```", resp.Text)
+	_, err = run("userid", "channel2", "/roll macros import channel "+resp.Text)
+	assert.NotNil(t, err)
+	resp, err = run("gmid", "channel2", "/roll macros import channel "+resp.Text)
+	assert.Nil(t, err)
+	assert.Equal(t, "Imported 2 channel macros.", resp.Text)
+	resp, err = run("gmid", "channel2", "/roll macros export channel")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "\"goblin.damage\": \"3\"")
+	_, err = run("gmid", "channel2", `/roll macros import channel {"@orc": "1d6+"}`)
+	assert.NotNil(t, err)
+	_, err = run("gmid", "channel2", "/roll macros import channel not json")
+	assert.NotNil(t, err)
+
+	_, err = run("userid", "channel1", "/roll delete channel @goblin.attack")
+	assert.NotNil(t, err)
+	_, err = run("gmid", "channel1", "/roll delete channel @goblin.attack")
+	assert.Nil(t, err)
+}
@@ -129,54 +129,20 @@ func GetParser(c configuration) func(input string) (*Node, error) {
 			r.Result = makeNode(r.Token, []Result{}, Dice{n: n, x: x, l: l, h: h})
 		})
 
-		advdisDice = Seq(Regex("[Dd]"), diceSides, Regex("([AaDd])")).Map(func(r *Result) {
-			x, err := getNatural(r.Child[1])
-			if err != nil {
-				r.Result = err
+		macroRef = Regex("@[A-Za-z_][A-Za-z0-9_]*(\\.[A-Za-z0-9_]+)*").Map(func(r *Result) {
+			if len(r.Token) > 1+maxMacroNameLength {
+				r.Result = fmt.Errorf("macro name too long: %s", r.Token)
 				return
 			}
-
-			mode := strings.ToLower(r.Child[2].Token)
-			var l, h int
-			switch {
-			case mode == "a":
-				l, h = 1, 2
-			case mode == "d":
-				l, h = 0, 1
-			default:
-				r.Result = fmt.Errorf("invalid mode in advdisDice: %s", mode)
-				return
-			}
-			r.Token = r.Child[0].Token + r.Child[1].Token + r.Child[2].Token
-			r.Result = makeNode(r.Token, []Result{}, Dice{n: 2, x: x, l: l, h: h})
+			r.Result = makeNode(r.Token, []Result{}, MacroRef{name: strings.ToLower(r.Token[1:])})
 		})
 
-		stats = Regex("(?i)stats").Map(func(r *Result) {
-			oneStat := Node{
-				token: "4d6d1",
-				child: []Node{},
-				sp:    Dice{n: 4, x: 6, l: 1, h: 4},
-			}
-			r.Result = Node{
-				token: r.Token,
-				child: []Node{
-					oneStat,
-					oneStat,
-					oneStat,
-					oneStat,
-					oneStat,
-					oneStat,
-				},
-				sp: Stats{},
-			}
-		})
-
-		deathSave = Regex("(?i)death[ -]?save").Map(func(r *Result) {
-			r.Result = Node{
-				token: r.Token,
-				child: []Node{{token: "1d20", child: []Node{}, sp: Dice{n: 1, x: 20, l: 0, h: 1}}},
-				sp:    DeathSave{},
+		variable = Regex("\\$[A-Za-z_][A-Za-z0-9_]*").Map(func(r *Result) {
+			if len(r.Token) > 1+maxSheetValueNameLength {
+				r.Result = fmt.Errorf("value name too long: %s", r.Token)
+				return
 			}
+			r.Result = makeNode(r.Token, []Result{}, Variable{name: strings.ToLower(r.Token[1:])})
 		})
 
 		labeled = Seq(sum, Regex(" [^,\\(\\)+*×/%-]+")).Map(func(r *Result) {
@@ -206,14 +172,16 @@ func GetParser(c configuration) func(input string) (*Node, error) {
 		})
 	)
 
-	var y Parser
-	if c.EnableDnd5e {
-		value = Any(keepdropDice, advdisDice, simpleDice, oneDice, natural, groupExpr)
-		y = NoAutoWS(Any(commaList, stats, deathSave))
-	} else {
-		value = Any(keepdropDice, simpleDice, oneDice, natural, groupExpr)
-		y = NoAutoWS(commaList)
+	values := []Parserish{keepdropDice}
+	toplevel := []Parserish{commaList}
+	g := grammar{natural: natural, diceSides: diceSides}
+	for _, gs := range c.gameSystems() {
+		gsg := gs.grammar(g)
+		values = append(values, gsg.values...)
+		toplevel = append(toplevel, gsg.toplevel...)
 	}
+	value = Any(append(values, simpleDice, oneDice, natural, groupExpr, macroRef, variable)...)
+	y := NoAutoWS(Any(toplevel...))
 
 	return func(input string) (*Node, error) {
 		result, err := Run(y, input)
@@ -0,0 +1,84 @@
+package pd
+
+import (
+	"math"
+)
+
+// Chi-squared goodness-of-fit test
+
+// ChiSquaredTest tests observed counts against expected counts, returning the
+// chi-squared statistic and the p-value, i.e. the probability of a statistic at
+// least as large if the counts follow the expected distribution. The degrees of
+// freedom are the number of categories minus one.
+func ChiSquaredTest(observed []int, expected []float64) (float64, float64) {
+	if len(observed) != len(expected) || len(observed) < 2 {
+		return math.NaN(), math.NaN()
+	}
+	statistic := 0.0
+	for i, o := range observed {
+		d := float64(o) - expected[i]
+		statistic += d * d / expected[i]
+	}
+	return statistic, ChiSquaredPValue(statistic, len(observed)-1)
+}
+
+// ChiSquaredPValue returns the probability that a chi-squared distributed
+// variable with df degrees of freedom is at least the given statistic.
+func ChiSquaredPValue(statistic float64, df int) float64 {
+	if df < 1 || statistic < 0 || math.IsNaN(statistic) {
+		return math.NaN()
+	}
+	return upperRegularizedGamma(float64(df)/2, statistic/2)
+}
+
+// Return Q(a, x) = Γ(a, x) / Γ(a), using a series for x < a+1 and a continued
+// fraction otherwise, as in Numerical Recipes.
+func upperRegularizedGamma(a, x float64) float64 {
+	const (
+		maxIterations = 1000
+		epsilon       = 1e-15
+		tiny          = 1e-300
+	)
+	if x == 0 {
+		return 1
+	}
+	lgamma, _ := math.Lgamma(a)
+	prefactor := math.Exp(-x + a*math.Log(x) - lgamma)
+	if x < a+1 {
+		// P(a, x) = e^-x x^a / Γ(a) Σ x^n / (a (a+1) ... (a+n))
+		term := 1 / a
+		sum := term
+		for n := 1; n < maxIterations; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*epsilon {
+				break
+			}
+		}
+		return 1 - sum*prefactor
+	}
+	// Modified Lentz's method for the continued fraction of Q(a, x).
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1; n < maxIterations; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return h * prefactor
+}
@@ -202,6 +202,17 @@ func (pd PD) ExpectedValue() BR {
 	return ret
 }
 
+// Return the total probability of the outcomes for which the predicate holds.
+func (pd PD) ProbabilityOf(predicate func(BR) bool) BR {
+	ret := zero
+	for _, v := range pd.probMapOP {
+		if predicate(v.outcome) {
+			ret = ret.Plus(v.probability)
+		}
+	}
+	return ret
+}
+
 func LinearCombination(terms []LCTerm) PD {
 	ret := PD{make(probMapOP), false}
 	for _, term := range terms {
@@ -217,12 +228,8 @@ type LCTerm struct {
 	Coeff BR
 }
 
-// Return a string describing the average value of the distribution and the
-// probability of each outcome in a table.
-//
-// The options string is either "l" for allowing inline LaTeX, or "" otherwise.
-func (pd PD) Render(options string) string {
-	// Extract and sort the outcomes
+// Return the outcomes of the distribution, in increasing order.
+func (pd PD) Outcomes() []BR {
 	outcomes := make([]BR, 0, len(pd.probMapOP))
 	for _, v := range pd.probMapOP {
 		outcomes = append(outcomes, v.outcome)
@@ -230,6 +237,15 @@ func (pd PD) Render(options string) string {
 	sort.Slice(outcomes, func(i, j int) bool {
 		return outcomes[i].LessThan(outcomes[j])
 	})
+	return outcomes
+}
+
+// Return a string describing the average value of the distribution and the
+// probability of each outcome in a table.
+//
+// The options string is either "l" for allowing inline LaTeX, or "" otherwise.
+func (pd PD) Render(options string) string {
+	outcomes := pd.Outcomes()
 	// Render table
 	table := ""
 	cumulative := one
@@ -2,6 +2,7 @@ package pd_test
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"testing"
 
@@ -133,3 +134,47 @@ func TestDiceDrop(t *testing.T) {
 	assert.Equal(t, "29 319112237345/743008370688", d6_2.ExpectedValue().Render(""))
 	assert.Equal(t, "39", d6_3.ExpectedValue().Render(""))
 }
+
+// Test probability of outcomes matching a predicate.
+func TestProbabilityOf(t *testing.T) {
+	d6 := pd.Dice(1, 6, 0, 0)
+	assert.Equal(t, "1/2", d6.ProbabilityOf(func(o br.BR) bool { return n(4).LessThanOrEquals(o) }).String())
+	assert.Equal(t, "0", d6.ProbabilityOf(func(o br.BR) bool { return o.LessThan(br.One) }).String())
+	twoD6 := pd.Dice(2, 6, 0, 0)
+	assert.Equal(t, "1/6", twoD6.ProbabilityOf(func(o br.BR) bool { return o.Equals(n(7)) }).String())
+}
+
+func TestOutcomes(t *testing.T) {
+	outcomes := []string{}
+	for _, o := range pd.Dice(2, 3, 0, 0).Minus(pd.Constant(n(4))).Outcomes() {
+		outcomes = append(outcomes, o.String())
+	}
+	assert.Equal(t, []string{"-2", "-1", "0", "1", "2"}, outcomes)
+}
+
+// Test the chi-squared goodness-of-fit test against known values.
+func TestChiSquared(t *testing.T) {
+	for _, tc := range []struct {
+		statistic float64
+		df        int
+		p         float64
+	}{
+		{statistic: 0, df: 1, p: 1},
+		{statistic: 3.841458820694124, df: 1, p: 0.05},
+		{statistic: 2, df: 2, p: math.Exp(-1)},
+		{statistic: 30.14352720564616, df: 19, p: 0.05},
+		{statistic: 36.19086912927004, df: 19, p: 0.01},
+		{statistic: 5, df: 19, p: 0.999431},
+		{statistic: 150, df: 99, p: 0.000720},
+	} {
+		assert.InDelta(t, tc.p, pd.ChiSquaredPValue(tc.statistic, tc.df), 1e-5, "%v", tc)
+	}
+	assert.True(t, math.IsNaN(pd.ChiSquaredPValue(1, 0)))
+
+	statistic, p := pd.ChiSquaredTest([]int{10, 10, 10}, []float64{10, 10, 10})
+	assert.Equal(t, 0.0, statistic)
+	assert.InDelta(t, 1.0, p, 1e-12)
+	statistic, p = pd.ChiSquaredTest([]int{20, 0}, []float64{10, 10})
+	assert.Equal(t, 20.0, statistic)
+	assert.InDelta(t, 7.744e-6, p, 1e-8)
+}
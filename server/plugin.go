@@ -3,7 +3,7 @@ package main
 import (
 	_ "embed"
 	"fmt"
-	"math/rand"
+	"math/rand/v2"
 	"net/http"
 	"strings"
 	"sync"
@@ -21,9 +21,6 @@ const (
 //go:embed helptext.md
 var helpText string
 
-//go:embed helptext-dnd5e.md
-var helpTextDnd5e string
-
 // Plugin implements the interface expected by the Mattermost server to communicate between the server and plugin processes.
 type Plugin struct {
 	plugin.MattermostPlugin
@@ -35,15 +32,56 @@ type Plugin struct {
 	// setConfiguration for usage.
 	configuration *configuration
 
-	// function used to parse dice rolls
-	parser func(input string) (*Node, error)
+	// parsersLock synchronizes access to parsers.
+	parsersLock sync.Mutex
+
+	// parsers caches the function used to parse dice rolls for each combination of
+	// enabled game systems. Consult getParser for usage.
+	parsers map[string]func(input string) (*Node, error)
+
+	// initiativeLock synchronizes changes to the initiative trackers.
+	initiativeLock sync.Mutex
+
+	// deckLock synchronizes changes to the decks of cards.
+	deckLock sync.Mutex
+
+	// tablesLock synchronizes changes to the random tables.
+	tablesLock sync.Mutex
+
+	// contestLock synchronizes changes to the pending contests.
+	contestLock sync.Mutex
+
+	// requestLock synchronizes changes to the roll requests and requestTimers.
+	requestLock sync.Mutex
+
+	// requestTimers closes the open roll requests after their timeout, by post ID.
+	requestTimers map[string]*time.Timer
+
+	// inlineLock synchronizes access to inlineRolls.
+	inlineLock sync.Mutex
+
+	// inlineRolls are the inline rolls of the posts being posted, by token. Consult
+	// MessageWillBePosted for usage.
+	inlineRolls map[string]*pendingInlineRolls
+
+	// rngLock synchronizes access to pcg.
+	rngLock sync.Mutex
+
+	// pcg is the random source of rolls when the PCG generator is configured. Consult
+	// newRoller for usage.
+	pcg *rand.PCG
+
+	// webhooks sends roll events to the outgoing webhooks.
+	webhooks *webhookQueue
 
 	// BotId of the created bot account for dice rolling
 	diceBotID string
 }
 
 func (p *Plugin) OnActivate() error {
-	rand.Seed(time.Now().UnixNano())
+	p.webhooks = newWebhookQueue(maxWebhookQueue, p.API.LogWarn)
+	p.webhooks.start()
+	p.restoreRollRequests()
 
 	err := p.API.RegisterCommand(&model.Command{
 		Trigger:          trigger,
@@ -57,7 +95,7 @@ func (p *Plugin) OnActivate() error {
 		return err
 	}
 
-	return p.API.RegisterCommand(&model.Command{
+	err = p.API.RegisterCommand(&model.Command{
 		Trigger:          triggerAnalyze,
 		Description:      "Analyze dice roll expressions",
 		DisplayName:      "Dice roller ⚄",
@@ -65,15 +103,63 @@ func (p *Plugin) OnActivate() error {
 		AutoCompleteDesc: "Analyze dice roll expressions. ⚁ ⚄ Try /roll help for a list of possibilities.",
 		AutoCompleteHint: "(3d20+4)/2",
 	})
+	if err != nil {
+		return err
+	}
+
+	err = p.API.RegisterCommand(&model.Command{
+		Trigger:          triggerInit,
+		Description:      "Track the initiative order of a combat",
+		DisplayName:      "Dice roller ⚄",
+		AutoComplete:     true,
+		AutoCompleteDesc: "Track the initiative order of a combat. Try /init help for a list of possibilities.",
+		AutoCompleteHint: "[roll|add|next|remove|show|end]",
+	})
+	if err != nil {
+		return err
+	}
+
+	err = p.API.RegisterCommand(&model.Command{
+		Trigger:          triggerDeck,
+		Description:      "Draw cards from a deck",
+		DisplayName:      "Dice roller ⚄",
+		AutoComplete:     true,
+		AutoCompleteDesc: "Draw cards from the deck of the channel. Try /deck help for a list of possibilities.",
+		AutoCompleteHint: "[new|shuffle|draw|discard|peek|show]",
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.API.RegisterCommand(&model.Command{
+		Trigger:          triggerTable,
+		Description:      "Roll on random tables",
+		DisplayName:      "Dice roller ⚄",
+		AutoComplete:     true,
+		AutoCompleteDesc: "Roll on the random tables of the team. Try /table help for a list of possibilities.",
+		AutoCompleteHint: "[import|roll|show|list|delete]",
+	})
+}
+
+func (p *Plugin) OnDeactivate() error {
+	if p.webhooks != nil {
+		p.webhooks.stop()
+	}
+	p.stopRollRequestTimers()
+	return nil
 }
 
 func (p *Plugin) GetHelpMessage() *model.CommandResponse {
 	text := helpText
-	if p.getConfiguration().EnableDnd5e {
-		text += helpTextDnd5e
+	for _, gs := range p.getConfiguration().gameSystems() {
+		text += gs.helpText
 	}
 	text += "⚅ ⚂ Let's get rolling! ⚁ ⚄"
 
+	return ephemeralResponse(text)
+}
+
+func ephemeralResponse(text string) *model.CommandResponse {
 	props := map[string]interface{}{
 		"from_webhook": "true",
 	}
@@ -85,6 +171,25 @@ func (p *Plugin) GetHelpMessage() *model.CommandResponse {
 	}
 }
 
+// getParser returns the function used to parse dice rolls with the game systems
+// enabled in the given configuration, building it on first use.
+func (p *Plugin) getParser(c configuration) func(input string) (*Node, error) {
+	key := strings.Join(gameSystemIDs(c.gameSystems()), ",")
+
+	p.parsersLock.Lock()
+	defer p.parsersLock.Unlock()
+
+	if p.parsers == nil {
+		p.parsers = make(map[string]func(input string) (*Node, error))
+	}
+	parse, ok := p.parsers[key]
+	if !ok {
+		parse = GetParser(c)
+		p.parsers[key] = parse
+	}
+	return parse
+}
+
 // ExecuteCommand returns a post that displays the result of the dice rolls
 func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
 	if p.API == nil {
@@ -101,16 +206,74 @@ func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*mo
 			return p.GetHelpMessage(), nil
 		}
 
-		// Suppress lint error
-		// > G404: Use of weak random number generator (math/rand instead of crypto/rand) (gosec)
-		// because dice rolls don't need to be cryptographically secure.
-		//#nosec G404
-		roller := func(x int) int { return 1 + rand.Intn(x) }
-		post, generatePostError := p.generateDicePost(query, args.UserId, args.ChannelId, args.RootId, roller, p.parser)
+		subcommand, rest := splitFirstWord(query)
+		switch subcommand {
+		case "config":
+			return p.executeConfigCommand(args, rest)
+		case "reveal":
+			return p.executeRevealCommand(args, rest)
+		case "sheet":
+			return p.executeSheetCommand(args, rest)
+		case "history":
+			return p.executeHistoryCommand(args, rest)
+		case "verify":
+			return p.executeVerifyCommand(args, rest)
+		case "fair":
+			return p.executeFairSeedCommand(rest)
+		case "stats":
+			// Plain `/roll stats` is rolled by the DnD 5e module.
+			if who := strings.ToLower(rest); who == "me" || who == "channel" {
+				return p.executeLuckCommand(args, who)
+			}
+		}
+
+		conf, err := p.getEffectiveConfiguration(args.ChannelId)
+		if err != nil {
+			return nil, appError("Cannot load the channel configuration.", err)
+		}
+
+		switch subcommand {
+		case "secret":
+			return p.executeSecretRoll(args, rest, conf)
+		case "gm":
+			return p.executeGMRoll(args, rest, conf)
+		case "hidden":
+			return p.executeHiddenRoll(args, rest, conf)
+		case "save":
+			if _, ok := conf.gameSystemCommand(subcommand); !ok || isMacroSaveCommand(rest) {
+				return p.executeSaveMacroCommand(args, rest, conf)
+			}
+		case "delete":
+			return p.executeDeleteMacroCommand(args, rest)
+		case "macros":
+			return p.executeMacrosCommand(args, rest, conf)
+		case seedFlag:
+			return p.executeSeededRoll(args, rest, conf)
+		case nonceFlag:
+			return p.executeNonceRoll(args, rest, conf)
+		case "contest":
+			return p.executeContestCommand(args, rest, conf)
+		case "respond":
+			return p.executeRespondCommand(args, rest, conf)
+		case "request":
+			return p.executeRequestCommand(args, rest, conf)
+		}
+
+		if command, ok := conf.gameSystemCommand(subcommand); ok {
+			return p.executeGameSystemCommand(args, rest, command, conf)
+		}
+
+		roller, proof, err := p.publicRoller(conf, args.UserId, args.ChannelId, "")
+		if err != nil {
+			return nil, appError("Cannot load the server seed.", err)
+		}
+		post, rolled, generatePostError := p.generateDiceRoll(query, args.UserId, args.ChannelId, args.RootId, roller, conf)
 		if generatePostError != nil {
 			return nil, generatePostError
 		}
-		_, createPostError := p.API.CreatePost(post)
+		proof.addToPost(post)
+		addRollActions(post, query, conf)
+		_, createPostError := p.createRollPost(post, rolled, query, args.UserId)
 		if createPostError != nil {
 			return nil, createPostError
 		}
@@ -128,7 +291,22 @@ func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*mo
 			return p.GetHelpMessage(), nil
 		}
 
-		post, generatePostError := p.generateDiceAnalyzePost(query, args.UserId, args.ChannelId, args.RootId, p.parser)
+		conf, err := p.getEffectiveConfiguration(args.ChannelId)
+		if err != nil {
+			return nil, appError("Cannot load the channel configuration.", err)
+		}
+
+		subcommand, rest := splitFirstWord(query)
+		if subcommand == "secret" {
+			post, generatePostError := p.generateDiceAnalyzePost(rest, args.UserId, args.ChannelId, args.RootId, conf)
+			if generatePostError != nil {
+				return nil, generatePostError
+			}
+			p.API.SendEphemeralPost(args.UserId, post)
+			return &model.CommandResponse{}, nil
+		}
+
+		post, generatePostError := p.generateDiceAnalyzePost(query, args.UserId, args.ChannelId, args.RootId, conf)
 		if generatePostError != nil {
 			return nil, generatePostError
 		}
@@ -140,65 +318,134 @@ func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*mo
 		return &model.CommandResponse{}, nil
 	}
 
+	// Initiative tracker
+	cmd = "/" + triggerInit
+	if strings.HasPrefix(args.Command, cmd) {
+		query := strings.TrimSpace((strings.Replace(args.Command, cmd, "", 1)))
+		return p.executeInitiativeCommand(args, query)
+	}
+
+	// Decks of cards
+	cmd = "/" + triggerDeck
+	if strings.HasPrefix(args.Command, cmd) {
+		query := strings.TrimSpace((strings.Replace(args.Command, cmd, "", 1)))
+		return p.executeDeckCommand(args, query)
+	}
+
+	// Random tables
+	cmd = "/" + triggerTable
+	if strings.HasPrefix(args.Command, cmd) {
+		query := strings.TrimSpace((strings.Replace(args.Command, cmd, "", 1)))
+		return p.executeTableCommand(args, query)
+	}
+
 	return nil, appError("Expected trigger "+cmd+" but got "+args.Command, nil)
 }
 
-func (p *Plugin) generateDicePost(query, userID, channelID, rootID string, roller Roller, parse func(input string) (*Node, error)) (*model.Post, *model.AppError) {
-	// Get the user to display their name
-	user, userErr := p.API.GetUser(userID)
+func (p *Plugin) generateDicePost(query, userID, channelID, rootID string, roller Roller, conf configuration) (*model.Post, *model.AppError) {
+	post, _, err := p.generateDiceRoll(query, userID, channelID, rootID, roller, conf)
+	return post, err
+}
+
+// generateDiceRoll is like generateDicePost, and also returns the rolled expression.
+func (p *Plugin) generateDiceRoll(query, userID, channelID, rootID string, roller Roller, conf configuration) (*model.Post, *Node, *model.AppError) {
+	displayName, userErr := p.getDisplayName(userID)
 	if userErr != nil {
-		return nil, userErr
-	}
-	displayName := user.Nickname
-	if displayName == "" {
-		displayName = user.Username
+		return nil, nil, userErr
 	}
 
-	parsedNode, err := parse(query)
+	parsedNode, err := p.parseQuery(query, userID, channelID, conf)
 	if err != nil {
-		return nil, appError(fmt.Sprintf("%s: See `/roll help` for examples.", err.Error()), err)
+		return nil, nil, appError(fmt.Sprintf("%s: See `/roll help` for examples.", err.Error()), err)
 	}
 
-	rolledNode := parsedNode.roll(roller, *p.configuration)
-	renderResult := rolledNode.renderToplevel(ternaryStr(p.configuration.EnableLatex, "l", ""))
+	rolledNode := parsedNode.roll(roller, conf)
+	return p.newRollPost(displayName, query, channelID, rootID, rolledNode, conf), &rolledNode, nil
+}
+
+// newRollPost returns the post of the bot showing a rolled expression.
+func (p *Plugin) newRollPost(displayName, query, channelID, rootID string, rolled Node, conf configuration) *model.Post {
+	renderResult := rolled.renderToplevel(ternaryStr(conf.EnableLatex, "l", ""))
 
 	text := fmt.Sprintf("**%s** rolls %s", displayName, renderResult)
 
-	return &model.Post{
+	post := &model.Post{
 		UserId:    p.diceBotID,
 		ChannelId: channelID,
 		RootId:    rootID,
 		Message:   text,
-	}, nil
+	}
+	addStructuredProp(post, rollProp, newRollProps(query, rolled))
+	return post
 }
 
-func (p *Plugin) generateDiceAnalyzePost(query, userID, channelID, rootID string, parse func(input string) (*Node, error)) (*model.Post, *model.AppError) {
-	// Get the user to display their name
-	user, userErr := p.API.GetUser(userID)
-	if userErr != nil {
-		return nil, userErr
+// rollTotal makes a public roll of an expression with a single number total, like
+// the side of a contest, returning its post, the rolled expression and the total. The
+// kind of roll is used in error messages.
+func (p *Plugin) rollTotal(userID, channelID, rootID, expr, kind string, conf configuration) (*model.Post, *Node, BR, *model.AppError) {
+	roller, proof, err := p.publicRoller(conf, userID, channelID, "")
+	if err != nil {
+		return nil, nil, zero, appError("Cannot load the server seed.", err)
 	}
-	displayName := user.Nickname
-	if displayName == "" {
-		displayName = user.Username
+	post, rolled, appErr := p.generateDiceRoll(expr, userID, channelID, rootID, roller, conf)
+	if appErr != nil {
+		return nil, nil, zero, appErr
 	}
+	if _, ok := rolled.sp.(CommaList); ok && len(rolled.child) != 1 {
+		return nil, nil, zero, appError(kind+" are rolled with a single expression.", nil)
+	}
+	total := rolled.value()
+	if total.IsNaN() {
+		return nil, nil, zero, appError(kind+" are rolled with a number expression.", nil)
+	}
+	proof.addToPost(post)
+	return post, rolled, total, nil
+}
 
-	parsedNode, err := parse(query)
+func (p *Plugin) generateDiceAnalyzePost(query, userID, channelID, rootID string, conf configuration) (*model.Post, *model.AppError) {
+	post, _, err := p.generateDiceAnalysis(query, userID, channelID, rootID, conf)
+	return post, err
+}
+
+// generateDiceAnalysis is like generateDiceAnalyzePost, and also returns the parsed
+// expression.
+func (p *Plugin) generateDiceAnalysis(query, userID, channelID, rootID string, conf configuration) (*model.Post, *Node, *model.AppError) {
+	displayName, userErr := p.getDisplayName(userID)
+	if userErr != nil {
+		return nil, nil, userErr
+	}
+
+	parsedNode, err := p.parseQuery(query, userID, channelID, conf)
 	if err != nil {
-		return nil, appError(fmt.Sprintf("%s: See `/roll help` for examples.", err.Error()), err)
+		return nil, nil, appError(fmt.Sprintf("%s: See `/roll help` for examples.", err.Error()), err)
 	}
 
 	prob := parsedNode.prob()
-	table := prob.Render(ternaryStr(p.configuration.EnableLatex, "l", ""))
+	options := ternaryStr(conf.EnableLatex, "l", "")
+	table := prob.Render(options) + parsedNode.analyzeOutcomes(options)
 
 	text := fmt.Sprintf("**%s** analyzed roll `%s`:\n%s", displayName, query, table)
 
-	return &model.Post{
+	post := &model.Post{
 		UserId:    p.diceBotID,
 		ChannelId: channelID,
 		RootId:    rootID,
 		Message:   text,
-	}, nil
+	}
+	addStructuredProp(post, analysisProp, newAnalysisProps(query, *parsedNode, prob))
+	return post, parsedNode, nil
+}
+
+// getDisplayName returns the nickname of the user, or their username if they have no nickname.
+func (p *Plugin) getDisplayName(userID string) (string, *model.AppError) {
+	user, userErr := p.API.GetUser(userID)
+	if userErr != nil {
+		return "", userErr
+	}
+	if user.Nickname != "" {
+		return user.Nickname, nil
+	}
+	return user.Username, nil
 }
 
 func appError(message string, err error) *model.AppError {
@@ -209,6 +456,15 @@ func appError(message string, err error) *model.AppError {
 	return model.NewAppError("Dice Roller Plugin", message, nil, errorMessage, http.StatusBadRequest)
 }
 
+// Split the first word, in lower case, from the rest of the string.
+func splitFirstWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t\n"); i >= 0 {
+		return strings.ToLower(s[:i]), strings.TrimSpace(s[i:])
+	}
+	return strings.ToLower(s), ""
+}
+
 func ternaryStr(cond bool, a, b string) string {
 	if cond {
 		return a
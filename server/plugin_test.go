@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"strings"
 	"testing"
 
@@ -88,17 +89,99 @@ func initTestPlugin() (*Plugin, *plugintest.API) {
 	api.On("UnregisterCommand", mock.Anything, mock.Anything).Return(nil)
 	api.On("GetUser", mock.Anything).Return(&model.User{
 		Id:       "userid",
+		Username: "user",
 		Nickname: "User",
 	}, (*model.AppError)(nil))
+	kv := map[string][]byte{}
+	api.On("KVGet", mock.Anything).Return(func(key string) []byte {
+		return kv[key]
+	}, (*model.AppError)(nil))
+	api.On("KVSet", mock.Anything, mock.Anything).Return(func(key string, value []byte) *model.AppError {
+		kv[key] = value
+		return nil
+	})
+	api.On("KVSetWithExpiry", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, value []byte, _ int64) *model.AppError {
+		kv[key] = value
+		return nil
+	})
+	api.On("KVDelete", mock.Anything).Return(func(key string) *model.AppError {
+		delete(kv, key)
+		return nil
+	})
+	api.On("KVCompareAndSet", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, oldValue, newValue []byte) bool {
+		current, ok := kv[key]
+		if (oldValue == nil && ok) || (oldValue != nil && string(current) != string(oldValue)) {
+			return false
+		}
+		kv[key] = newValue
+		return true
+	}, (*model.AppError)(nil))
+	api.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) bool {
+		current, ok := kv[key]
+		if options.Atomic && ((options.OldValue == nil && ok) || (options.OldValue != nil && string(current) != string(options.OldValue))) {
+			return false
+		}
+		kv[key] = value
+		return true
+	}, (*model.AppError)(nil))
 
 	p := Plugin{
 		configuration: &configuration{
-			EnableDnd5e: true,
-			EnableLatex: false,
+			EnableDnd5e:        true,
+			EnableLatex:        false,
+			EnableCritMessages: true,
 		},
 	}
-	p.parser = GetParser(*p.configuration)
 	p.SetAPI(api)
 
 	return &p, api
 }
+
+// testPostStore keeps the posts of a test plugin in memory.
+type testPostStore struct {
+	// The posts created since the test last cleared it.
+	posts []*model.Post
+	// All the posts, as last updated.
+	all []*model.Post
+	// The last updated post.
+	updated *model.Post
+}
+
+func (s *testPostStore) find(postID string) int {
+	for i, post := range s.all {
+		if post.Id == postID {
+			return i
+		}
+	}
+	return -1
+}
+
+// mockPostStore mocks CreatePost, GetPost and UpdatePost with a post store.
+func mockPostStore(api *plugintest.API) *testPostStore {
+	s := &testPostStore{}
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		post.Id = model.NewId()
+		s.posts = append(s.posts, post)
+		s.all = append(s.all, post)
+		return post
+	}, nil)
+	api.On("GetPost", mock.AnythingOfType("string")).Return(func(postID string) *model.Post {
+		if i := s.find(postID); i >= 0 {
+			return s.all[i].Clone()
+		}
+		return nil
+	}, func(postID string) *model.AppError {
+		if s.find(postID) < 0 {
+			return model.NewAppError("GetPost", "not found", nil, "", http.StatusNotFound)
+		}
+		return nil
+	})
+	api.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		if i := s.find(post.Id); i >= 0 {
+			s.all[i] = post
+		}
+		s.updated = post
+		return post
+	}, nil)
+	return s
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/client"
+)
+
+// Structured results in post props, for integrations: `dice_roll` on roll posts and
+// `dice_analysis` on analysis posts.
+
+const (
+	rollProp     = "dice_roll"
+	analysisProp = "dice_analysis"
+)
+
+type rollProps struct {
+	Expression string `json:"expression"`
+	// The expression with macros and values expanded, e.g. "2d20k1+3".
+	Canonical string    `json:"canonical"`
+	Dice      []dieProp `json:"dice"`
+	// Result of each labeled expression, in order.
+	Subtotals []subtotalProp `json:"subtotals"`
+	// Result of each comma separated expression, and their total if there is only one,
+	// as rational number strings.
+	Totals []string `json:"totals"`
+	Total  string   `json:"total,omitempty"`
+}
+
+type dieProp struct {
+	// The kind of dice, e.g. "d20" or "dF".
+	Dice   string `json:"dice"`
+	Result int    `json:"result"`
+	// False for dice dropped by keep/drop.
+	Kept bool `json:"kept"`
+}
+
+type subtotalProp struct {
+	Label string `json:"label"`
+	Total string `json:"total"`
+}
+
+type analysisProps struct {
+	Expression    string               `json:"expression"`
+	Canonical     string               `json:"canonical"`
+	ExpectedValue string               `json:"expected_value"`
+	Probabilities []client.Probability `json:"probabilities"`
+}
+
+// Return the canonical form of an expression.
+func canonicalForm(n Node) string {
+	join := func(ops []string) string {
+		ret := ""
+		for i, c := range n.child {
+			op := ops[i]
+			switch op {
+			case "×":
+				op = "*"
+			case "÷":
+				op = "//"
+			}
+			ret += op + canonicalForm(c)
+		}
+		return ret
+	}
+	switch sp := n.sp.(type) {
+	case Natural:
+		return fmt.Sprintf("%d", sp.n)
+	case Variable:
+		return fmt.Sprintf("%d", sp.n)
+	case Dice:
+		ret := fmt.Sprintf("%dd%d", sp.n, sp.x)
+		switch {
+		case sp.l == 0 && sp.h == sp.n:
+		case sp.h == sp.n:
+			ret += fmt.Sprintf("k%d", sp.n-sp.l)
+		case sp.l == 0:
+			ret += fmt.Sprintf("kl%d", sp.h)
+		}
+		return ret
+	case Sum:
+		return join(sp.ops)
+	case Prod:
+		return join(sp.ops)
+	case GroupExpr:
+		return "(" + canonicalForm(n.child[0]) + ")"
+	case Labeled:
+		return canonicalForm(n.child[0]) + " " + sp.label
+	case MacroRef:
+		return canonicalForm(n.child[0])
+	case CommaList:
+		items := make([]string, len(n.child))
+		for i, c := range n.child {
+			items[i] = canonicalForm(c)
+		}
+		return strings.Join(items, ", ")
+	default:
+		return strings.ToLower(strings.Join(strings.Fields(n.token), ""))
+	}
+}
+
+// Return every die rolled in an expression, in order.
+func collectDieProps(n Node) []dieProp {
+	ret := []dieProp{}
+	if reporter, ok := n.sp.(diceReporter); ok {
+		record := reporter.rolledDice()
+		dice, isDice := n.sp.(Dice)
+		for i, result := range record.Results {
+			ret = append(ret, dieProp{Dice: record.Dice, Result: result, Kept: !isDice || dice.rolls[i].use})
+		}
+	}
+	for _, c := range n.child {
+		ret = append(ret, collectDieProps(c)...)
+	}
+	return ret
+}
+
+func collectSubtotals(n Node) []subtotalProp {
+	ret := []subtotalProp{}
+	if sp, ok := n.sp.(Labeled); ok {
+		ret = append(ret, subtotalProp{Label: sp.label, Total: n.value().String()})
+	}
+	for _, c := range n.child {
+		ret = append(ret, collectSubtotals(c)...)
+	}
+	return ret
+}
+
+func newRollProps(expression string, rolled Node) rollProps {
+	props := rollProps{
+		Expression: expression,
+		Canonical:  canonicalForm(rolled),
+		Dice:       collectDieProps(rolled),
+		Subtotals:  collectSubtotals(rolled),
+		Totals:     collectTotals(rolled),
+	}
+	if len(props.Totals) == 1 {
+		props.Total = props.Totals[0]
+	}
+	return props
+}
+
+func newAnalysisProps(expression string, parsed Node, prob PD) analysisProps {
+	return analysisProps{
+		Expression:    expression,
+		Canonical:     canonicalForm(parsed),
+		ExpectedValue: prob.ExpectedValue().String(),
+		Probabilities: newAPIProbabilities(prob),
+	}
+}
+
+// addStructuredProp adds a value to the props of a post, as plain JSON values so that
+// it goes through the plugin RPC.
+func addStructuredProp(post *model.Post, key string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return
+	}
+	post.AddProp(key, value)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/client"
+)
+
+// Return a roller giving the given results in order.
+func fixedRoller(results ...int) Roller {
+	i := 0
+	return func(x int) int {
+		ret := results[i%len(results)]
+		i++
+		return ret
+	}
+}
+
+func decodeProp(t *testing.T, post *model.Post, key string, v interface{}) {
+	data, err := json.Marshal(post.GetProp(key))
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(data, v))
+}
+
+func TestCanonicalForm(t *testing.T) {
+	p, _ := initTestPlugin()
+	conf := *p.getConfiguration()
+	testCases := []struct {
+		expression string
+		canonical  string
+	}{
+		{"1D20+5", "1d20+5"},
+		{"4d6k3, 3d4dl1, 2d20kl1", "4d6k3, 3d4k2, 2d20kl1"},
+		{"(2d6+3)×2÷4 damage", "(2d6+3)*2//4 damage"},
+		{"d20a+2", "2d20k1+2"},
+		{"d%-4d6dh1", "1d100-4d6kl3"},
+		{"stats", "stats"},
+	}
+	for _, testCase := range testCases {
+		parsed, err := p.parseQuery(testCase.expression, "userid", "channelid", conf)
+		if assert.Nil(t, err, testCase.expression) {
+			assert.Equal(t, testCase.canonical, canonicalForm(*parsed), testCase.expression)
+		}
+	}
+}
+
+func TestRollProps(t *testing.T) {
+	p, _ := initTestPlugin()
+	conf := *p.getConfiguration()
+
+	post, _, appErr := p.generateDiceRoll("(3d6k2+1 fire)//2, d4 cold", "userid", "channelid", "", fixedRoller(5, 2, 6, 3), conf)
+	assert.Nil(t, appErr)
+	props := rollProps{}
+	decodeProp(t, post, rollProp, &props)
+	assert.Equal(t, rollProps{
+		Expression: "(3d6k2+1 fire)//2, d4 cold",
+		Canonical:  "(3d6k2+1 fire)//2, 1d4 cold",
+		Dice: []dieProp{
+			{Dice: "d6", Result: 5, Kept: true},
+			{Dice: "d6", Result: 2, Kept: false},
+			{Dice: "d6", Result: 6, Kept: true},
+			{Dice: "d4", Result: 3, Kept: true},
+		},
+		Subtotals: []subtotalProp{{Label: "fire", Total: "12"}, {Label: "cold", Total: "3"}},
+		Totals:    []string{"6", "3"},
+	}, props)
+
+	post, _, appErr = p.generateDiceRoll("d20+1//3", "userid", "channelid", "", fixedRoller(10), conf)
+	assert.Nil(t, appErr)
+	props = rollProps{}
+	decodeProp(t, post, rollProp, &props)
+	assert.Equal(t, "31/3", props.Total)
+	assert.Equal(t, []string{"31/3"}, props.Totals)
+	assert.Equal(t, []subtotalProp{}, props.Subtotals)
+}
+
+func TestAnalysisProps(t *testing.T) {
+	p, _ := initTestPlugin()
+	conf := *p.getConfiguration()
+
+	post, appErr := p.generateDiceAnalyzePost("1D2+1", "userid", "channelid", "", conf)
+	assert.Nil(t, appErr)
+	props := analysisProps{}
+	decodeProp(t, post, analysisProp, &props)
+	assert.Equal(t, analysisProps{
+		Expression:    "1D2+1",
+		Canonical:     "1d2+1",
+		ExpectedValue: "5/2",
+		Probabilities: []client.Probability{
+			{Outcome: "2", Probability: "1/2", AtLeast: "1"},
+			{Outcome: "3", Probability: "1/2", AtLeast: "1/2"},
+		},
+	}, props)
+}
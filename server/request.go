@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/br"
+)
+
+// Roll requests: the GM asks several users for the same roll, e.g. "everyone roll
+// perception". Each user rolls with a button, with their own character sheet, and the
+// results are collected in the request post until it closes.
+
+// rollRequest is an open roll request, stored as JSON in the plugin KV store under the
+// ID of its post.
+type rollRequest struct {
+	RequesterID string `json:"requester_id"`
+	ChannelID   string `json:"channel_id"`
+	// The thread of the request, if any.
+	RootID     string `json:"root_id,omitempty"`
+	Expression string `json:"expression"`
+	// The difficulty class, if any: rolls pass when their total is at least the DC.
+	DC    int  `json:"dc,omitempty"`
+	HasDC bool `json:"has_dc,omitempty"`
+	// The users asked to roll, or nobody if everyone in the channel can roll.
+	Users   []rollRequestUser   `json:"users,omitempty"`
+	Results []rollRequestResult `json:"results"`
+	// When the request closes, in milliseconds since the epoch.
+	Closes int64 `json:"closes"`
+}
+
+type rollRequestUser struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type rollRequestResult struct {
+	rollRequestUser
+	// The total, as a rational number string.
+	Total string `json:"total"`
+}
+
+const (
+	actionRequestRoll  = "request_roll"
+	actionRequestClose = "request_close"
+
+	maxRequestUsers = 20
+
+	// Holds the post IDs of the open requests, so that their timers can be restored
+	// when the plugin starts.
+	openRollRequestsKey        = "requests_open"
+	maxOpenRollRequestsRetries = 5
+)
+
+// Requests close after 10 minutes. Their KV entry is kept longer, so that a request
+// that should have closed while the plugin was stopped can still be closed with its
+// results when it starts again.
+var (
+	rollRequestTimeout = 10 * time.Minute
+	rollRequestExpiry  = 24 * time.Hour
+
+	rollRequestDCRegex = regexp.MustCompile(`(?i)\s+dc\s*(-?\d+)$`)
+)
+
+func rollRequestKey(postID string) string {
+	return "request_" + postID
+}
+
+func (p *Plugin) getRollRequest(postID string) (*rollRequest, error) {
+	data, appErr := p.API.KVGet(rollRequestKey(postID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load roll request")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	request := &rollRequest{}
+	if err := json.Unmarshal(data, request); err != nil {
+		return nil, errors.Wrap(err, "failed to decode roll request")
+	}
+	return request, nil
+}
+
+func (p *Plugin) setRollRequest(postID string, request *rollRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode roll request")
+	}
+	if appErr := p.API.KVSetWithExpiry(rollRequestKey(postID), data, int64(rollRequestExpiry.Seconds())); appErr != nil {
+		return errors.Wrap(appErr, "failed to save roll request")
+	}
+	return nil
+}
+
+func (p *Plugin) getOpenRollRequests() ([]byte, []string, error) {
+	postIDs := []string{}
+	data, appErr := p.API.KVGet(openRollRequestsKey)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to load the open roll requests")
+	}
+	if data == nil {
+		return nil, postIDs, nil
+	}
+	if err := json.Unmarshal(data, &postIDs); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode the open roll requests")
+	}
+	return data, postIDs, nil
+}
+
+// setRollRequestOpen adds the post ID of a request to the open requests, or removes it.
+// Concurrent changes are retried.
+func (p *Plugin) setRollRequestOpen(postID string, open bool) error {
+	for i := 0; i < maxOpenRollRequestsRetries; i++ {
+		oldData, postIDs, err := p.getOpenRollRequests()
+		if err != nil {
+			return err
+		}
+		newIDs := []string{}
+		for _, id := range postIDs {
+			if id != postID {
+				newIDs = append(newIDs, id)
+			}
+		}
+		if open {
+			newIDs = append(newIDs, postID)
+		} else if len(newIDs) == len(postIDs) {
+			return nil
+		}
+		newData, err := json.Marshal(newIDs)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode the open roll requests")
+		}
+		ok, appErr := p.API.KVCompareAndSet(openRollRequestsKey, oldData, newData)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to save the open roll requests")
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errors.New("failed to save the open roll requests: too many concurrent changes")
+}
+
+// Return the result of a user, or nil if they did not roll yet.
+func (r *rollRequest) result(userID string) *rollRequestResult {
+	for i := range r.Results {
+		if r.Results[i].ID == userID {
+			return &r.Results[i]
+		}
+	}
+	return nil
+}
+
+// Return whether a user is asked to roll.
+func (r *rollRequest) isAsked(userID string) bool {
+	if len(r.Users) == 0 {
+		return true
+	}
+	for _, user := range r.Users {
+		if user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the outcome of a total: Passed or Failed against the DC, or nothing without a
+// DC.
+func (r *rollRequest) outcome(total string) string {
+	if !r.HasDC {
+		return ""
+	}
+	return ternaryStr(br.FromString(total).LessThan(itobr(r.DC)), "Failed", "Passed")
+}
+
+// render returns the message of the request post, with the results so far.
+func (r *rollRequest) render(requester string, closed bool) string {
+	target := "everyone in the channel"
+	if len(r.Users) > 0 {
+		names := make([]string, len(r.Users))
+		for i, user := range r.Users {
+			names[i] = user.Name
+		}
+		target = strings.Join(names, ", ")
+	}
+	text := fmt.Sprintf("**%s** requests a roll of `%s`", requester, r.Expression)
+	if r.HasDC {
+		text += fmt.Sprintf(" against DC %d", r.DC)
+	}
+	text += " from " + target + "."
+
+	rows := []string{}
+	passed, failed := 0, 0
+	addRow := func(name, total, outcome string) {
+		row := "|" + name + "|" + total + "|"
+		if r.HasDC {
+			row += outcome + "|"
+		}
+		rows = append(rows, row)
+	}
+	for _, result := range r.Results {
+		outcome := r.outcome(result.Total)
+		switch outcome {
+		case "Passed":
+			passed++
+		case "Failed":
+			failed++
+		}
+		addRow(result.Name, "**"+br.FromString(result.Total).Render("")+"**", outcome)
+	}
+	for _, user := range r.Users {
+		if r.result(user.ID) == nil {
+			addRow(user.Name, ternaryStr(closed, "No roll", "Waiting"), "")
+		}
+	}
+	if len(rows) > 0 {
+		header := "\n\n|Player|Total|"
+		separator := "\n|-|-:|"
+		if r.HasDC {
+			header += "Result|"
+			separator += ":-:|"
+		}
+		text += header + separator + "\n" + strings.Join(rows, "\n")
+	}
+
+	switch {
+	case !closed:
+		text += fmt.Sprintf("\n\n*Roll with the button below. The request closes at %s UTC.*", time.UnixMilli(r.Closes).UTC().Format("15:04"))
+	case r.HasDC:
+		text += fmt.Sprintf("\n\n*Closed: %d passed, %d failed.*", passed, failed)
+	default:
+		text += fmt.Sprintf("\n\n*Closed: %d rolled.*", len(r.Results))
+	}
+	return text
+}
+
+// parseRollRequest parses the arguments of `/roll request`: the users, then the
+// expression and an optional DC.
+func (p *Plugin) parseRollRequest(args *model.CommandArgs, query string, conf configuration) (*rollRequest, *model.AppError) {
+	usage := appError("Usage: `/roll request @user1 @user2... <expression> [dc <number>]` or `/roll request @all <expression> [dc <number>]`, e.g. `/roll request @all 1d20+$perception dc 15`.", nil)
+	request := &rollRequest{RequesterID: args.UserId, ChannelID: args.ChannelId, RootID: args.RootId, Results: []rollRequestResult{}}
+	everyone := false
+	rest := query
+	for {
+		word, after := splitFirstWord(rest)
+		if !strings.HasPrefix(word, "@") {
+			break
+		}
+		rest = after
+		switch word {
+		case "@all", "@channel", "@here":
+			everyone = true
+			continue
+		}
+		user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(word, "@"))
+		if appErr != nil {
+			return nil, appError(fmt.Sprintf("Cannot find user `%s`.", word), appErr)
+		}
+		if user.IsBot || !p.API.HasPermissionToChannel(user.Id, args.ChannelId, model.PermissionCreatePost) {
+			return nil, appError(fmt.Sprintf("%s cannot roll in this channel.", word), nil)
+		}
+		if len(request.Users) > 0 && request.isAsked(user.Id) {
+			// Listed twice.
+			continue
+		}
+		if len(request.Users) == maxRequestUsers {
+			return nil, appError(fmt.Sprintf("A request can list up to %d users: Use `@all` to ask everyone.", maxRequestUsers), nil)
+		}
+		request.Users = append(request.Users, rollRequestUser{ID: user.Id, Name: "@" + user.Username})
+	}
+	if everyone {
+		request.Users = nil
+	} else if len(request.Users) == 0 {
+		return nil, usage
+	}
+
+	if m := rollRequestDCRegex.FindStringSubmatch(rest); m != nil {
+		dc, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, appError(fmt.Sprintf("Invalid DC `%s`.", m[1]), err)
+		}
+		request.DC, request.HasDC = dc, true
+		rest = strings.TrimSpace(rest[:len(rest)-len(m[0])])
+	}
+	if rest == "" {
+		return nil, usage
+	}
+	// Check the expression now; values and macros are looked up for each user when
+	// they roll.
+	parsed, err := p.getParser(conf)(rest)
+	if err != nil {
+		return nil, appError(fmt.Sprintf("%s: See `/roll help` for examples.", err.Error()), err)
+	}
+	if _, ok := parsed.sp.(CommaList); ok && len(parsed.child) != 1 {
+		return nil, appError("Roll requests are rolled with a single expression.", nil)
+	}
+	request.Expression = rest
+	return request, nil
+}
+
+// executeRequestCommand handles `/roll request <users> <expression> [dc <number>]`: it
+// posts the request, which closes after a timeout.
+func (p *Plugin) executeRequestCommand(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	request, appErr := p.parseRollRequest(args, query, conf)
+	if appErr != nil {
+		return nil, appErr
+	}
+	requester, appErr := p.getDisplayName(args.UserId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	request.Closes = time.Now().Add(rollRequestTimeout).UnixMilli()
+
+	post := &model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: args.ChannelId,
+		RootId:    args.RootId,
+		Message:   request.render(requester, false),
+	}
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{{Actions: []*model.PostAction{
+		newPostAction(actionRequestRoll, "Roll"),
+		newPostAction(actionRequestClose, "Close"),
+	}}})
+
+	// Hold the lock until the request is saved, so that clicks wait for it.
+	p.requestLock.Lock()
+	defer p.requestLock.Unlock()
+	created, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if err := p.setRollRequest(created.Id, request); err != nil {
+		// Nobody can roll: close the post.
+		created.Message = request.render(requester, true)
+		created.DelProp("attachments")
+		if _, appErr := p.API.UpdatePost(created); appErr != nil {
+			p.API.LogWarn("Cannot close a roll request.", "error", appErr.Error())
+		}
+		return nil, appError("Cannot save the roll request.", err)
+	}
+	if err := p.setRollRequestOpen(created.Id, true); err != nil {
+		// The request still closes with its timer, unless the plugin restarts first.
+		p.API.LogWarn("Cannot save the open roll requests.", "error", err.Error())
+	}
+	p.scheduleRollRequestClose(created.Id, rollRequestTimeout)
+	return &model.CommandResponse{}, nil
+}
+
+// scheduleRollRequestClose closes a request after some time. The caller must hold
+// requestLock.
+func (p *Plugin) scheduleRollRequestClose(postID string, after time.Duration) {
+	if p.requestTimers == nil {
+		p.requestTimers = make(map[string]*time.Timer)
+	}
+	p.requestTimers[postID] = time.AfterFunc(after, func() {
+		p.requestLock.Lock()
+		defer p.requestLock.Unlock()
+		if err := p.closeRollRequest(postID); err != nil {
+			p.API.LogWarn("Cannot close a roll request.", "error", err.Error())
+		}
+	})
+}
+
+// restoreRollRequests closes the open requests that should have closed while the
+// plugin was stopped, and schedules the closing of the others.
+func (p *Plugin) restoreRollRequests() {
+	p.requestLock.Lock()
+	defer p.requestLock.Unlock()
+	_, postIDs, err := p.getOpenRollRequests()
+	if err != nil {
+		p.API.LogWarn("Cannot load the open roll requests.", "error", err.Error())
+		return
+	}
+	for _, postID := range postIDs {
+		request, err := p.getRollRequest(postID)
+		if err != nil {
+			p.API.LogWarn("Cannot load a roll request.", "error", err.Error())
+			continue
+		}
+		if request == nil {
+			// The request expired with its results: only remove the buttons.
+			if post, appErr := p.API.GetPost(postID); appErr == nil {
+				post.DelProp("attachments")
+				post.Message += "\n\n*This request expired.*"
+				if _, appErr = p.API.UpdatePost(post); appErr != nil {
+					p.API.LogWarn("Cannot close a roll request.", "error", appErr.Error())
+				}
+			}
+			if err = p.setRollRequestOpen(postID, false); err != nil {
+				p.API.LogWarn("Cannot save the open roll requests.", "error", err.Error())
+			}
+			continue
+		}
+		if remaining := time.Until(time.UnixMilli(request.Closes)); remaining > 0 {
+			p.scheduleRollRequestClose(postID, remaining)
+			continue
+		}
+		if err = p.closeRollRequest(postID); err != nil {
+			p.API.LogWarn("Cannot close a roll request.", "error", err.Error())
+		}
+	}
+}
+
+// executeRequestAction handles a click on a button of a request post: rolling for the
+// user, or closing the request.
+func (p *Plugin) executeRequestAction(userID, postID, action string) *model.AppError {
+	p.requestLock.Lock()
+	defer p.requestLock.Unlock()
+
+	request, err := p.getRollRequest(postID)
+	if err != nil {
+		return appError("Cannot load the roll request.", err)
+	}
+	if request == nil {
+		return appError("This roll request is closed.", nil)
+	}
+	if time.Now().UnixMilli() >= request.Closes {
+		// The timer was lost, e.g. with a plugin restart.
+		if err = p.closeRollRequest(postID); err != nil {
+			return appError("Cannot close the roll request.", err)
+		}
+		return appError("This roll request is closed.", nil)
+	}
+
+	if action == actionRequestClose {
+		isGM, err := p.isChannelGM(userID, request.ChannelID)
+		if err != nil {
+			return appError("Cannot load the channel configuration.", err)
+		}
+		if userID != request.RequesterID && !isGM {
+			return appError("Only the requester or the GM can close this request.", nil)
+		}
+		if err = p.closeRollRequest(postID); err != nil {
+			return appError("Cannot close the roll request.", err)
+		}
+		return nil
+	}
+
+	if !request.isAsked(userID) || userID == p.diceBotID {
+		return appError("This roll is not requested from you.", nil)
+	}
+	if !p.API.HasPermissionToChannel(userID, request.ChannelID, model.PermissionCreatePost) {
+		return appError("You cannot post in this channel.", nil)
+	}
+	if request.result(userID) != nil {
+		return appError("You already rolled for this request.", nil)
+	}
+	conf, err := p.getEffectiveConfiguration(request.ChannelID)
+	if err != nil {
+		return appError("Cannot load the channel configuration.", err)
+	}
+	name, appErr := p.getDisplayName(userID)
+	if appErr != nil {
+		return appErr
+	}
+	rootID := request.RootID
+	if rootID == "" {
+		rootID = postID
+	}
+	post, rolled, total, appErr := p.rollTotal(userID, request.ChannelID, rootID, request.Expression, "Roll requests", conf)
+	if appErr != nil {
+		return appErr
+	}
+	if outcome := request.outcome(total.String()); outcome != "" {
+		post.Message += fmt.Sprintf(" against DC %d: **%s**", request.DC, outcome)
+	}
+	if _, appErr = p.createRollPost(post, rolled, request.Expression, userID); appErr != nil {
+		return appErr
+	}
+
+	user := rollRequestUser{ID: userID, Name: name}
+	for _, asked := range request.Users {
+		if asked.ID == userID {
+			user = asked
+		}
+	}
+	request.Results = append(request.Results, rollRequestResult{rollRequestUser: user, Total: total.String()})
+	if err = p.setRollRequest(postID, request); err != nil {
+		return appError("Cannot save the roll request.", err)
+	}
+	if len(request.Users) > 0 && len(request.Results) == len(request.Users) {
+		// Everyone rolled.
+		if err = p.closeRollRequest(postID); err != nil {
+			return appError("Cannot close the roll request.", err)
+		}
+		return nil
+	}
+	return p.updateRollRequestPost(postID, request, false)
+}
+
+// updateRollRequestPost shows the results of a request in its post, removing the
+// buttons once it is closed.
+func (p *Plugin) updateRollRequestPost(postID string, request *rollRequest, closed bool) *model.AppError {
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		return appError("Cannot find the roll request.", appErr)
+	}
+	requester, appErr := p.getDisplayName(request.RequesterID)
+	if appErr != nil {
+		return appErr
+	}
+	post.Message = request.render(requester, closed)
+	if closed {
+		post.DelProp("attachments")
+	}
+	_, appErr = p.API.UpdatePost(post)
+	return appErr
+}
+
+// closeRollRequest closes a request, if it is still open. The caller must hold
+// requestLock.
+func (p *Plugin) closeRollRequest(postID string) error {
+	if timer, ok := p.requestTimers[postID]; ok {
+		timer.Stop()
+		delete(p.requestTimers, postID)
+	}
+	request, err := p.getRollRequest(postID)
+	if err != nil || request == nil {
+		return err
+	}
+	if appErr := p.API.KVDelete(rollRequestKey(postID)); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete roll request")
+	}
+	if err = p.setRollRequestOpen(postID, false); err != nil {
+		p.API.LogWarn("Cannot save the open roll requests.", "error", err.Error())
+	}
+	if appErr := p.updateRollRequestPost(postID, request, true); appErr != nil {
+		return errors.Wrap(appErr, "failed to update roll request post")
+	}
+	return nil
+}
+
+// stopRollRequestTimers stops the timers closing the requests. The requests are closed
+// when the plugin starts again, or on the next click.
+func (p *Plugin) stopRollRequestTimers() {
+	p.requestLock.Lock()
+	defer p.requestLock.Unlock()
+	for postID, timer := range p.requestTimers {
+		timer.Stop()
+		delete(p.requestTimers, postID)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRollRequests(t *testing.T) {
+	p, api := initTestPlugin()
+	store := mockPostStore(api)
+	api.On("GetUserByUsername", "bob").Return(&model.User{Id: "bobid", Username: "bob"}, nil)
+	api.On("GetUserByUsername", "alice").Return(&model.User{Id: "aliceid", Username: "alice"}, nil)
+	api.On("GetUserByUsername", "nobody").Return(nil, model.NewAppError("GetUserByUsername", "not found", nil, "", http.StatusNotFound))
+	api.On("HasPermissionToChannel", "gm", "channel1", model.PermissionManageChannelRoles).Return(true)
+	api.On("HasPermissionToChannel", "readonly", "channel1", model.PermissionCreatePost).Return(false)
+	api.On("HasPermissionToChannel", mock.Anything, "channel1", model.PermissionCreatePost).Return(true)
+	api.On("HasPermissionToChannel", mock.Anything, mock.Anything, mock.Anything).Return(false)
+	assert.Nil(t, p.OnActivate())
+	defer func() { assert.Nil(t, p.OnDeactivate()) }()
+
+	run := func(userID, command string) (*model.CommandResponse, *model.AppError) {
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: command, UserId: userID, ChannelId: "channel1"})
+	}
+	click := func(userID, postID, action string) string {
+		body, _ := json.Marshal(&model.PostActionIntegrationRequest{PostId: postID})
+		r := httptest.NewRequest(http.MethodPost, "/actions/"+action, bytes.NewReader(body))
+		r.Header.Set("Mattermost-User-Id", userID)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(&plugin.Context{}, w, r)
+		response := &model.PostActionIntegrationResponse{}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(response))
+		return response.EphemeralText
+	}
+	_, err := run("bobid", "/roll sheet set perception 6")
+	assert.Nil(t, err)
+	_, err = run("aliceid", "/roll sheet set perception 2")
+	assert.Nil(t, err)
+
+	_, err = run("gm", "/roll request @bob @alice 10+$perception DC 15")
+	assert.Nil(t, err)
+	if !assert.Len(t, store.posts, 1) {
+		return
+	}
+	request := store.posts[0]
+	assert.Contains(t, request.Message, "**User** requests a roll of `10+$perception` against DC 15 from @bob, @alice.\n\n|Player|Total|Result|\n|-|-:|:-:|\n|@bob|Waiting||\n|@alice|Waiting||\n\n*Roll with the button below.")
+	if assert.Len(t, request.Attachments(), 1) {
+		assert.Equal(t, "Roll", request.Attachments()[0].Actions[0].Name)
+	}
+
+	// Only the listed users roll, once.
+	assert.Equal(t, "This roll is not requested from you.", click("otheruser", request.Id, actionRequestRoll))
+	assert.Equal(t, "", click("bobid", request.Id, actionRequestRoll))
+	assert.Equal(t, "You already rolled for this request.", click("bobid", request.Id, actionRequestRoll))
+	if assert.Len(t, store.posts, 2) {
+		assert.Equal(t, "**User** rolls 10+perception(6) = **16** against DC 15: **Passed**", store.posts[1].Message)
+		assert.Equal(t, request.Id, store.posts[1].RootId)
+	}
+	if assert.NotNil(t, store.updated) {
+		assert.Contains(t, store.updated.Message, "|@bob|**16**|Passed|\n|@alice|Waiting||")
+		assert.Len(t, store.updated.Attachments(), 1)
+	}
+
+	// The request closes once everyone rolled.
+	assert.Equal(t, "", click("aliceid", request.Id, actionRequestRoll))
+	if assert.NotNil(t, store.updated) {
+		assert.Contains(t, store.updated.Message, "|@bob|**16**|Passed|\n|@alice|**12**|Failed|\n\n*Closed: 1 passed, 1 failed.*")
+		assert.Empty(t, store.updated.Attachments())
+	}
+	records, _ := p.getRollHistory("channel1")
+	assert.Len(t, records, 2)
+	assert.Equal(t, "This roll request is closed.", click("aliceid", request.Id, actionRequestRoll))
+
+	// Everyone can roll on a request to @all, and only the requester or the GM can
+	// close it.
+	store.posts = nil
+	_, err = run("bobid", "/roll request @all 10+$perception")
+	assert.Nil(t, err)
+	request = store.posts[0]
+	assert.Contains(t, request.Message, "**User** requests a roll of `10+$perception` from everyone in the channel.\n\n*Roll")
+	assert.Equal(t, "You cannot post in this channel.", click("readonly", request.Id, actionRequestRoll))
+	assert.Equal(t, "", click("aliceid", request.Id, actionRequestRoll))
+	assert.Equal(t, "Only the requester or the GM can close this request.", click("aliceid", request.Id, actionRequestClose))
+	assert.Equal(t, "", click("gm", request.Id, actionRequestClose))
+	assert.Contains(t, store.updated.Message, "|Player|Total|\n|-|-:|\n|User|**12**|\n\n*Closed: 1 rolled.*")
+
+	// A request past its timeout is closed on the next click.
+	store.posts = nil
+	_, err = run("gm", "/roll request @bob @alice 1d20 dc 10")
+	assert.Nil(t, err)
+	request = store.posts[0]
+	stored, _ := p.getRollRequest(request.Id)
+	stored.Closes = 0
+	assert.Nil(t, p.setRollRequest(request.Id, stored))
+	assert.Equal(t, "This roll request is closed.", click("bobid", request.Id, actionRequestRoll))
+	assert.Contains(t, store.updated.Message, "|@bob|No roll||\n|@alice|No roll||\n\n*Closed: 0 passed, 0 failed.*")
+	assert.Len(t, store.posts, 1)
+
+	// After a restart, the requests past their timeout are closed, and the others are
+	// closed on time.
+	store.posts = nil
+	_, err = run("gm", "/roll request @bob 1d20")
+	assert.Nil(t, err)
+	_, err = run("gm", "/roll request @alice 1d20")
+	assert.Nil(t, err)
+	_, err = run("gm", "/roll request @all 1d20")
+	assert.Nil(t, err)
+	past, future, expired := store.posts[0].Id, store.posts[1].Id, store.posts[2].Id
+	assert.Nil(t, p.OnDeactivate())
+	stored, _ = p.getRollRequest(past)
+	stored.Closes = 0
+	assert.Nil(t, p.setRollRequest(past, stored))
+	assert.Nil(t, api.KVDelete(rollRequestKey(expired)))
+	assert.Nil(t, p.OnActivate())
+	closed := store.all[store.find(past)]
+	assert.Contains(t, closed.Message, "|@bob|No roll|\n\n*Closed: 0 rolled.*")
+	assert.Empty(t, closed.Attachments())
+	closed = store.all[store.find(expired)]
+	assert.Contains(t, closed.Message, "*Roll with the button below.")
+	assert.Contains(t, closed.Message, "\n\n*This request expired.*")
+	assert.Empty(t, closed.Attachments())
+	assert.Contains(t, p.requestTimers, future)
+	assert.Len(t, p.requestTimers, 1)
+	_, open, _ := p.getOpenRollRequests()
+	assert.Equal(t, []string{future}, open)
+
+	for _, command := range []string{
+		"/roll request 1d20",
+		"/roll request @bob",
+		"/roll request @bob dc 15",
+		"/roll request @nobody 1d20",
+		"/roll request @all 1d20 +",
+		"/roll request @all 1d20, 1d20",
+	} {
+		_, err = run("gm", command)
+		assert.NotNil(t, err, command)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Random number generators for rolls: a PCG source of the plugin seeded from
+// crypto/rand, crypto/rand itself, or a PCG source with a given seed for reproducible
+// rolls.
+
+const (
+	rngPCG    = "pcg"
+	rngCrypto = "crypto"
+
+	seedFlag = "--seed"
+)
+
+// uniformRoll returns a roll in [1, x] from uniform 64 bit values, using rejection
+// sampling so that every result is equally likely.
+func uniformRoll(next func() uint64, x int) int {
+	n := uint64(x)
+	// Values below 2^64 mod n would make the lowest results more likely.
+	threshold := -n % n
+	for {
+		if v := next(); v >= threshold {
+			return int(v%n) + 1
+		}
+	}
+}
+
+func cryptoUint64() uint64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %s", err))
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// newRoller returns the function used to roll dice, as chosen in the configuration.
+func (p *Plugin) newRoller() Roller {
+	if p.getConfiguration().RNG == rngCrypto {
+		return func(x int) int { return uniformRoll(cryptoUint64, x) }
+	}
+	return func(x int) int {
+		p.rngLock.Lock()
+		defer p.rngLock.Unlock()
+		if p.pcg == nil {
+			p.pcg = rand.NewPCG(cryptoUint64(), cryptoUint64())
+		}
+		return uniformRoll(p.pcg.Uint64, x)
+	}
+}
+
+// seededRoller returns a roller giving the same rolls for the same seed.
+func seededRoller(seed uint64) Roller {
+	pcg := rand.NewPCG(seed, seed)
+	return func(x int) int { return uniformRoll(pcg.Uint64, x) }
+}
+
+// parseSeed parses the seed following `--seed`, if any, returning the seed and the
+// rest of the query. Without a number, a random seed is chosen.
+func parseSeed(query string) (uint64, string, error) {
+	word, rest := splitFirstWord(query)
+	if word == "" {
+		return 0, "", fmt.Errorf("missing roll expression after %s", seedFlag)
+	}
+	seed, err := strconv.ParseUint(word, 10, 64)
+	if err != nil {
+		if strings.IndexFunc(word, func(r rune) bool { return r < '0' || r > '9' }) == -1 {
+			return 0, "", fmt.Errorf("seed too large: %s", word)
+		}
+		return cryptoUint64() % 1000000, strings.TrimSpace(query), nil
+	}
+	if rest == "" {
+		return 0, "", fmt.Errorf("missing roll expression after %s %s", seedFlag, word)
+	}
+	return seed, rest, nil
+}
+
+// executeSeededRoll rolls `/roll --seed [seed] expression` with a reproducible roller,
+// printing the seed so that the roll can be repeated. Anyone can search for a seed that
+// rolls well, so seeded rolls are kept out of the history, the webhooks and the props
+// read by integrations, have no buttons, and are refused in channels with fair rolls.
+func (p *Plugin) executeSeededRoll(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	if conf.EnableFairRolls {
+		return nil, appError(fmt.Sprintf("Seeded rolls are disabled in this channel, as its rolls are provably fair. Use `/roll %s <nonce> <expression>` instead.", nonceFlag), nil)
+	}
+	seed, query, err := parseSeed(query)
+	if err != nil {
+		return nil, appError(fmt.Sprintf("%s. Try `/roll %s 42 3d6`.", err.Error(), seedFlag), err)
+	}
+	post, _, appErr := p.generateDiceRoll(query, args.UserId, args.ChannelId, args.RootId, seededRoller(seed), conf)
+	if appErr != nil {
+		return nil, appErr
+	}
+	post.DelProp(rollProp)
+	post.Message += fmt.Sprintf("\n*Rolled with `%s %d`: not a real roll, anyone can repeat it.*", seedFlag, seed)
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		return nil, appErr
+	}
+	return &model.CommandResponse{}, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestUniformRoll(t *testing.T) {
+	values := []uint64{0, 5}
+	next := func() uint64 {
+		v := values[0]
+		values = values[1:]
+		return v
+	}
+	// 0 is below 2^64 mod 3 = 1, so it is rejected.
+	assert.Equal(t, 3, uniformRoll(next, 3))
+	assert.Empty(t, values)
+
+	values = []uint64{^uint64(0)}
+	assert.Equal(t, 16, uniformRoll(next, 20))
+}
+
+func TestRollers(t *testing.T) {
+	first, second := seededRoller(42), seededRoller(42)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, first(20), second(20))
+	}
+
+	for _, rng := range []string{"", rngPCG, rngCrypto} {
+		p, _ := initTestPlugin()
+		p.configuration.RNG = rng
+		roller := p.newRoller()
+		for i := 0; i < 1000; i++ {
+			roll := roller(6)
+			assert.True(t, roll >= 1 && roll <= 6, rng)
+		}
+	}
+}
+
+func TestParseSeed(t *testing.T) {
+	seed, query, err := parseSeed("42 3d6+1")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), seed)
+	assert.Equal(t, "3d6+1", query)
+
+	seed, query, err = parseSeed("3d6 fire")
+	assert.Nil(t, err)
+	assert.Less(t, seed, uint64(1000000))
+	assert.Equal(t, "3d6 fire", query)
+
+	for _, input := range []string{"", "42", "99999999999999999999999 d6"} {
+		_, _, err = parseSeed(input)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestSeededRollCommand(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	})
+	assert.Nil(t, p.OnActivate())
+
+	for i := 0; i < 2; i++ {
+		_, err := p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: "/roll --seed 42 10d20", UserId: "userid"})
+		assert.Nil(t, err)
+	}
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, posts[0].Message, posts[1].Message)
+		assert.Contains(t, posts[0].Message, "*Rolled with `--seed 42`: not a real roll, anyone can repeat it.*")
+		// Seeded rolls cannot pass for real rolls.
+		assert.Nil(t, posts[0].GetProp(rollExpressionProp))
+		assert.Nil(t, posts[0].GetProp(rollProp))
+		assert.Empty(t, posts[0].Attachments())
+	}
+	records, _ := p.getRollHistory("")
+	assert.Empty(t, records)
+
+	_, err := p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: "/roll --seed 42", UserId: "userid"})
+	assert.NotNil(t, err)
+
+	p.configuration.EnableFairRolls = true
+	_, err = p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: "/roll --seed 42 1d20", UserId: "userid"})
+	assert.NotNil(t, err)
+	assert.Len(t, posts, 2)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// executeSecretRoll handles `/roll secret ...`: only the caller sees the result, and the
+// channel only sees that a secret roll happened.
+func (p *Plugin) executeSecretRoll(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	post, generatePostError := p.generateDicePost(query, args.UserId, args.ChannelId, args.RootId, p.newRoller(), conf)
+	if generatePostError != nil {
+		return nil, generatePostError
+	}
+	p.API.SendEphemeralPost(args.UserId, post)
+
+	if err := p.createHiddenRollNotice(args, "made a secret roll."); err != nil {
+		return nil, err
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// executeGMRoll handles `/roll gm ...`: the result is sent to the channel's GM as a
+// direct message, as well as to the caller, and the channel only sees that a roll for
+// the GM happened.
+func (p *Plugin) executeGMRoll(args *model.CommandArgs, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	cc, err := p.getChannelConfig(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the channel configuration.", err)
+	}
+	if cc.GMUserID == "" {
+		return nil, appError("No GM is set for this channel: A channel admin can set one with `/roll config gm @username`.", nil)
+	}
+
+	post, generatePostError := p.generateDicePost(query, args.UserId, args.ChannelId, args.RootId, p.newRoller(), conf)
+	if generatePostError != nil {
+		return nil, generatePostError
+	}
+
+	channel, appErr := p.API.GetChannel(args.ChannelId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	dm, appErr := p.API.GetDirectChannel(p.diceBotID, cc.GMUserID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if _, appErr = p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: dm.Id,
+		Message:   fmt.Sprintf("In ~%s: %s", channel.Name, post.Message),
+	}); appErr != nil {
+		return nil, appErr
+	}
+	p.API.SendEphemeralPost(args.UserId, post)
+
+	if err := p.createHiddenRollNotice(args, "made a secret roll for the GM."); err != nil {
+		return nil, err
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// createHiddenRollNotice tells the channel that a roll happened without showing it.
+func (p *Plugin) createHiddenRollNotice(args *model.CommandArgs, event string) *model.AppError {
+	displayName, appErr := p.getDisplayName(args.UserId)
+	if appErr != nil {
+		return appErr
+	}
+	_, appErr = p.API.CreatePost(&model.Post{
+		UserId:    p.diceBotID,
+		ChannelId: args.ChannelId,
+		RootId:    args.RootId,
+		Message:   fmt.Sprintf("**%s** %s", displayName, event),
+	})
+	return appErr
+}
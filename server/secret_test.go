@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSecretRolls(t *testing.T) {
+	p, api := initTestPlugin()
+	p.diceBotID = "botid"
+	var posts, ephemeralPosts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	})
+	api.On("SendEphemeralPost", "userid", mock.AnythingOfType("*model.Post")).Return(nil).Run(func(args mock.Arguments) {
+		ephemeralPosts = append(ephemeralPosts, args.Get(1).(*model.Post))
+	})
+	api.On("HasPermissionToChannel", "userid", "channel1", model.PermissionManageChannelRoles).Return(true)
+	api.On("GetUserByUsername", "gamemaster").Return(&model.User{Id: "gmid", Username: "gamemaster"}, nil)
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Name: "campaign"}, nil)
+	api.On("GetDirectChannel", "botid", "gmid").Return(&model.Channel{Id: "dmid"}, nil)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(command string) (*model.CommandResponse, *model.AppError) {
+		posts, ephemeralPosts = nil, nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    "userid",
+			ChannelId: "channel1",
+		})
+	}
+
+	// Secret rolls are only shown to the caller.
+	_, err := run("/roll secret 2+3")
+	assert.Nil(t, err)
+	assert.Len(t, ephemeralPosts, 1)
+	assert.Equal(t, "**User** rolls 2+3 = **5**", ephemeralPosts[0].Message)
+	assert.Equal(t, "channel1", ephemeralPosts[0].ChannelId)
+	assert.Len(t, posts, 1)
+	assert.Equal(t, "**User** made a secret roll.", posts[0].Message)
+
+	_, err = run("/roll secret nonsense")
+	assert.NotNil(t, err)
+	assert.Empty(t, posts)
+
+	// GM rolls need a GM.
+	_, err = run("/roll gm 2+3")
+	assert.NotNil(t, err)
+	_, err = run("/roll config gm @gamemaster")
+	assert.Nil(t, err)
+
+	_, err = run("/roll gm 2+3")
+	assert.Nil(t, err)
+	assert.Len(t, ephemeralPosts, 1)
+	assert.Equal(t, "**User** rolls 2+3 = **5**", ephemeralPosts[0].Message)
+	assert.Len(t, posts, 2)
+	assert.Equal(t, "dmid", posts[0].ChannelId)
+	assert.Equal(t, "In ~campaign: **User** rolls 2+3 = **5**", posts[0].Message)
+	assert.Equal(t, "channel1", posts[1].ChannelId)
+	assert.Equal(t, "**User** made a secret roll for the GM.", posts[1].Message)
+
+	// Analysis can stay private too.
+	_, err = run("/analyzeroll secret 1d2")
+	assert.Nil(t, err)
+	assert.Empty(t, posts)
+	assert.Len(t, ephemeralPosts, 1)
+	assert.Contains(t, ephemeralPosts[0].Message, "**User** analyzed roll `1d2`:")
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/moussetc/mattermost-plugin-dice-roller/server/pd"
+)
+
+// Character sheets: named values of a character, referenced as `$name` in any roll
+// expression.
+
+// Types
+type Variable struct {
+	name string // lower case name, without the $
+	n    int    // set when resolved against a character sheet
+}
+
+const (
+	maxSheetValueNameLength = 32
+	maxSheetValueCount      = 100
+	maxSheetValue           = 1000
+	maxSheetCount           = 10
+	maxSheetNameLength      = 32
+)
+
+var (
+	sheetValueNameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	sheetNameRegex      = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// Roller
+func (sp Variable) roll(_ Node, _ Roller) NodeSpecialization { return sp }
+
+// Evaluate
+func (sp Variable) value(_ Node) BR { return itobr(sp.n) }
+
+// Render
+// A value renders with its name, e.g. "dex(3)".
+func (sp Variable) render(_ Node, _ string, rr int, _ bool, options string) (string, string, string) {
+	return fmt.Sprintf("%s(%d)", sp.name, sp.n), renderNumber(itobr(sp.n), rr, options), ""
+}
+
+// roll comment
+func (sp Variable) rollComment(_ Node, _ configuration) string { return ROLL_COMMENT_NOTHING }
+
+// Probability distributions
+func (sp Variable) prob(n Node) PD { return pd.Constant(n.value()) }
+
+// Storage
+// The character sheets of a user, stored as JSON in the plugin KV store.
+type characterSheets struct {
+	// Key of the sheet used for `$name` values, if any.
+	Active string                     `json:"active,omitempty"`
+	Sheets map[string]*characterSheet `json:"sheets,omitempty"`
+}
+
+type characterSheet struct {
+	Name   string         `json:"name"`
+	Values map[string]int `json:"values"`
+}
+
+func sheetsKey(userID string) string {
+	return "sheets_" + userID
+}
+
+func (p *Plugin) getCharacterSheets(userID string) (*characterSheets, error) {
+	sheets := &characterSheets{}
+	data, appErr := p.API.KVGet(sheetsKey(userID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load character sheets")
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, sheets); err != nil {
+			return nil, errors.Wrap(err, "failed to decode character sheets")
+		}
+	}
+	if sheets.Sheets == nil {
+		sheets.Sheets = map[string]*characterSheet{}
+	}
+	return sheets, nil
+}
+
+func (p *Plugin) setCharacterSheets(userID string, sheets *characterSheets) error {
+	data, err := json.Marshal(sheets)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode character sheets")
+	}
+	if appErr := p.API.KVSet(sheetsKey(userID), data); appErr != nil {
+		return errors.Wrap(appErr, "failed to save character sheets")
+	}
+	return nil
+}
+
+// Return the active sheet, or nil if there is none.
+func (s *characterSheets) active() *characterSheet {
+	return s.Sheets[s.Active]
+}
+
+// variableLookup returns a function finding values on the user's active sheet. The
+// sheets are only loaded when a value is looked up.
+func (p *Plugin) variableLookup(userID string) func(name string) (int, bool, error) {
+	var sheet *characterSheet
+	return func(name string) (int, bool, error) {
+		if sheet == nil {
+			sheets, err := p.getCharacterSheets(userID)
+			if err != nil {
+				return 0, false, err
+			}
+			if sheet = sheets.active(); sheet == nil {
+				return 0, false, fmt.Errorf("no character sheet: Use `/roll sheet set <name> <value>` to create one")
+			}
+		}
+		value, ok := sheet.Values[name]
+		return value, ok, nil
+	}
+}
+
+// Parse the name of a sheet, returning the key to store it under.
+func parseSheetName(s string) (string, error) {
+	if !sheetNameRegex.MatchString(s) || len(s) > maxSheetNameLength {
+		return "", fmt.Errorf("invalid sheet name `%s`: Use up to %d letters, digits and `_.-`", s, maxSheetNameLength)
+	}
+	return strings.ToLower(s), nil
+}
+
+// Check a value to put on a sheet, returning its name in lower case.
+func validateSheetValue(name string, value int) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "$"))
+	if !sheetValueNameRegex.MatchString(name) || len(name) > maxSheetValueNameLength {
+		return "", fmt.Errorf("invalid value name `%s`: Use up to %d letters, digits and underscores", name, maxSheetValueNameLength)
+	}
+	if value > maxSheetValue || value < -maxSheetValue {
+		return "", fmt.Errorf("value of `%s` too large: %d", name, value)
+	}
+	return name, nil
+}
+
+// Commands
+// executeSheetCommand handles `/roll sheet ...`.
+func (p *Plugin) executeSheetCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	sheets, err := p.getCharacterSheets(args.UserId)
+	if err != nil {
+		return nil, appError("Cannot load your character sheets.", err)
+	}
+
+	action, rest := splitFirstWord(query)
+	fields := strings.Fields(rest)
+	switch {
+	case action == "" || action == "show":
+		sheet := sheets.active()
+		if sheet == nil {
+			return ephemeralResponse("You have no character sheet. Use `/roll sheet set <name> <value>` to create one."), nil
+		}
+		return ephemeralResponse(renderCharacterSheet(sheet)), nil
+	case action == "list":
+		return ephemeralResponse(renderCharacterSheetList(sheets)), nil
+	case action == "export":
+		sheet := sheets.active()
+		if sheet == nil {
+			return nil, appError("You have no character sheet to export.", nil)
+		}
+		data, err := json.MarshalIndent(sheet, "", "  ")
+		if err != nil {
+			return nil, appError("Cannot encode your character sheet.", err)
+		}
+		return ephemeralResponse("```json\n" + string(data) + "\n```"), nil
+	case action == "set" && len(fields) == 2:
+		value, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, appError(fmt.Sprintf("Expected a whole number but got `%s`.", fields[1]), err)
+		}
+		name, err := validateSheetValue(fields[0], value)
+		if err != nil {
+			return nil, appError(err.Error()+".", err)
+		}
+		sheet := sheets.active()
+		if sheet == nil {
+			if _, ok := sheets.Sheets["default"]; !ok && len(sheets.Sheets) >= maxSheetCount {
+				return nil, appError("You have no active character sheet: Use `/roll sheet use <sheet>` to choose one.", nil)
+			}
+			if _, ok := sheets.Sheets["default"]; !ok {
+				sheets.Sheets["default"] = &characterSheet{Name: "default", Values: map[string]int{}}
+			}
+			sheets.Active = "default"
+			sheet = sheets.active()
+		}
+		if _, ok := sheet.Values[name]; !ok && len(sheet.Values) >= maxSheetValueCount {
+			return nil, appError(fmt.Sprintf("A character sheet cannot have more than %d values.", maxSheetValueCount), nil)
+		}
+		sheet.Values[name] = value
+	case action == "unset" && len(fields) == 1:
+		sheet := sheets.active()
+		name := strings.ToLower(strings.TrimPrefix(fields[0], "$"))
+		if sheet == nil {
+			return nil, appError("You have no character sheet.", nil)
+		}
+		if _, ok := sheet.Values[name]; !ok {
+			return nil, appError(fmt.Sprintf("Your character sheet has no value `%s`.", name), nil)
+		}
+		delete(sheet.Values, name)
+	case (action == "new" || action == "use" || action == "delete") && len(fields) == 1:
+		key, err := parseSheetName(fields[0])
+		if err != nil {
+			return nil, appError(err.Error()+".", err)
+		}
+		_, exists := sheets.Sheets[key]
+		switch {
+		case action == "new" && exists:
+			return nil, appError(fmt.Sprintf("You already have a character sheet `%s`.", fields[0]), nil)
+		case action == "new" && len(sheets.Sheets) >= maxSheetCount:
+			return nil, appError(fmt.Sprintf("You cannot have more than %d character sheets.", maxSheetCount), nil)
+		case action == "new":
+			sheets.Sheets[key] = &characterSheet{Name: fields[0], Values: map[string]int{}}
+			sheets.Active = key
+		case !exists:
+			return nil, appError(fmt.Sprintf("You have no character sheet `%s`.", fields[0]), nil)
+		case action == "use":
+			sheets.Active = key
+		default:
+			delete(sheets.Sheets, key)
+			if sheets.Active == key {
+				sheets.Active = ""
+			}
+		}
+	case action == "import" && rest != "":
+		if appErr := importCharacterSheet(sheets, rest); appErr != nil {
+			return nil, appErr
+		}
+	default:
+		return nil, appError("Usage: `/roll sheet [show|list|export|set <name> <value>|unset <name>|new <sheet>|use <sheet>|delete <sheet>|import <json>]`.", nil)
+	}
+
+	if err := p.setCharacterSheets(args.UserId, sheets); err != nil {
+		return nil, appError("Cannot save your character sheets.", err)
+	}
+	if sheet := sheets.active(); sheet != nil {
+		return ephemeralResponse(renderCharacterSheet(sheet)), nil
+	}
+	return ephemeralResponse(renderCharacterSheetList(sheets)), nil
+}
+
+// importCharacterSheet adds a sheet given as JSON, as exported by `/roll sheet export`,
+// and makes it the active sheet. It replaces any sheet with the same name.
+func importCharacterSheet(sheets *characterSheets, text string) *model.AppError {
+	text = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(text), "```json"), "```"))
+	imported := &characterSheet{}
+	if err := json.Unmarshal([]byte(text), imported); err != nil {
+		return appError("Expected a JSON object like `{\"name\": \"Aria\", \"values\": {\"dex\": 3}}`.", err)
+	}
+	if imported.Name == "" {
+		imported.Name = "default"
+	}
+	key, err := parseSheetName(imported.Name)
+	if err != nil {
+		return appError(err.Error()+".", err)
+	}
+	if _, ok := sheets.Sheets[key]; !ok && len(sheets.Sheets) >= maxSheetCount {
+		return appError(fmt.Sprintf("You cannot have more than %d character sheets.", maxSheetCount), nil)
+	}
+	if len(imported.Values) > maxSheetValueCount {
+		return appError(fmt.Sprintf("A character sheet cannot have more than %d values.", maxSheetValueCount), nil)
+	}
+	values := map[string]int{}
+	for name, value := range imported.Values {
+		name, err := validateSheetValue(name, value)
+		if err != nil {
+			return appError(err.Error()+".", err)
+		}
+		values[name] = value
+	}
+	imported.Values = values
+	sheets.Sheets[key] = imported
+	sheets.Active = key
+	return nil
+}
+
+func renderCharacterSheet(sheet *characterSheet) string {
+	if len(sheet.Values) == 0 {
+		return fmt.Sprintf("Character sheet **%s** has no values. Use `/roll sheet set <name> <value>` to add one.", sheet.Name)
+	}
+	names := make([]string, 0, len(sheet.Values))
+	for name := range sheet.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	text := fmt.Sprintf("Character sheet **%s**:\n\n|Value|Number|\n|-|-|", sheet.Name)
+	for _, name := range names {
+		text += fmt.Sprintf("\n|`$%s`|%d|", name, sheet.Values[name])
+	}
+	return text
+}
+
+func renderCharacterSheetList(sheets *characterSheets) string {
+	if len(sheets.Sheets) == 0 {
+		return "You have no character sheet. Use `/roll sheet set <name> <value>` to create one."
+	}
+	keys := make([]string, 0, len(sheets.Sheets))
+	for key := range sheets.Sheets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	text := "Your character sheets:"
+	for _, key := range keys {
+		text += fmt.Sprintf("\n- %s%s", sheets.Sheets[key].Name, ternaryStr(key == sheets.Active, " (active)", ""))
+	}
+	return text
+}
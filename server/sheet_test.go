@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCharacterSheets(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	})
+	api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", TeamId: "team1"}, nil)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, command string) (*model.CommandResponse, *model.AppError) {
+		posts = nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+			Command:   command,
+			UserId:    userID,
+			ChannelId: "channel1",
+		})
+	}
+	roll := func(query string) string {
+		_, err := run("userid", "/roll "+query)
+		if !assert.Nil(t, err, query) || !assert.Len(t, posts, 1, query) {
+			return ""
+		}
+		return posts[0].Message
+	}
+
+	_, err := run("userid", "/roll 2+$dex")
+	assert.NotNil(t, err)
+	resp, err := run("userid", "/roll sheet")
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "You have no character sheet.")
+
+	resp, err = run("userid", "/roll sheet set DEX 3")
+	assert.Nil(t, err)
+	assert.Equal(t, "Character sheet **default**:\n\n|Value|Number|\n|-|-|\n|`$dex`|3|", resp.Text)
+	_, err = run("userid", "/roll sheet set prof +2")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll sheet set str -1")
+	assert.Nil(t, err)
+
+	assert.Equal(t, "**User** rolls 10+dex(3)+prof(2) = **15**", roll("10+$dex+$Prof"))
+	assert.Equal(t, "**User** rolls str(-1) = **-1**", roll("$str"))
+	assert.Equal(t, "**User** rolls (5+dex(3))+3 = **11**\n- *5+dex(3) =* ***8*** *attack*", roll("(5+$dex attack)+3"))
+	_, err = run("userid", "/roll $wis")
+	assert.NotNil(t, err)
+	_, err = run("otheruser", "/roll $dex")
+	assert.NotNil(t, err)
+
+	// Macros can use sheet values.
+	_, err = run("userid", "/roll save @hit 10+$dex")
+	assert.Nil(t, err)
+	assert.Equal(t, "**User** rolls 10+dex(3) = **13** @hit", roll("@hit"))
+
+	// Several sheets, one active at a time.
+	_, err = run("userid", "/roll sheet new Aria")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll $dex")
+	assert.NotNil(t, err)
+	resp, err = run("userid", `/roll sheet import {"name": "Aria", "values": {"DEX": 4, "wis": 1}}`)
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Text, "Character sheet **Aria**:")
+	assert.Equal(t, "**User** rolls dex(4) = **4**", roll("$dex"))
+	resp, err = run("userid", "/roll sheet list")
+	assert.Nil(t, err)
+	assert.Equal(t, "Your character sheets:\n- Aria (active)\n- default", resp.Text)
+	resp, err = run("userid", "/roll sheet export")
+	assert.Nil(t, err)
+	assert.Equal(t, "```json\n{\n  \"name\": \"Aria\",\n  \"values\": {\n    \"dex\": 4,\n    \"wis\": 1\n  }\n}\n```", resp.Text)
+	_, err = run("userid", "/roll sheet use default")
+	assert.Nil(t, err)
+	assert.Equal(t, "**User** rolls dex(3) = **3**", roll("$dex"))
+
+	_, err = run("userid", "/roll sheet unset dex")
+	assert.Nil(t, err)
+	_, err = run("userid", "/roll $dex")
+	assert.NotNil(t, err)
+	_, err = run("userid", "/roll sheet delete aria")
+	assert.Nil(t, err)
+	resp, err = run("userid", "/roll sheet list")
+	assert.Nil(t, err)
+	assert.Equal(t, "Your character sheets:\n- default (active)", resp.Text)
+
+	for _, command := range []string{
+		"/roll sheet set dex three",
+		"/roll sheet set 1dex 3",
+		"/roll sheet set dex 100000",
+		"/roll sheet unset wis",
+		"/roll sheet use aria",
+		"/roll sheet new default",
+		"/roll sheet import {\"values\": [1]}",
+		"/roll sheet frobnicate",
+	} {
+		_, err = run("userid", command)
+		assert.NotNil(t, err, command)
+	}
+}
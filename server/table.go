@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const triggerTable string = "table"
+
+// randomTable is a random table of a team: a roll expression and an entry for each of
+// its results. Tables are stored per team in the plugin KV store.
+type randomTable struct {
+	Name string `json:"name"`
+	// The roll expression, e.g. "1d6", "2d6" or "d66".
+	Dice      string       `json:"dice"`
+	Entries   []tableEntry `json:"entries"`
+	CreatorID string       `json:"creator_id"`
+}
+
+// A table entry, for the rolls from Low to High.
+type tableEntry struct {
+	Low  int    `json:"low"`
+	High int    `json:"high"`
+	Text string `json:"text"`
+}
+
+// Tables of a team, by lower case name.
+type tableLibrary map[string]*randomTable
+
+const (
+	maxTableNameLength  = 32
+	maxTableEntries     = 200
+	maxTableEntryLength = 500
+	maxTableCount       = 100
+	// Maximum number of tables rolled inside each other.
+	maxTableDepth = 5
+	// Maximum number of tables rolled in one `/table roll`.
+	maxTableRolls = 50
+	// d66: a d6 for the tens and a d6 for the units.
+	d66Expression = "1d6*10+1d6"
+)
+
+var (
+	tableNameRegex  = regexp.MustCompile(`^[a-z0-9_][a-z0-9_.-]*$`)
+	tableRangeRegex = regexp.MustCompile(`^(\d+)(?:\s*[-–]\s*(\d+))?$`)
+	tableDiceRegex  = regexp.MustCompile(`(?i)^\d*d(\d+|%)$`)
+	// A reference to another table in an entry, like `{table:loot}`.
+	tableRefRegex       = regexp.MustCompile(`(?i)\{table:([a-z0-9_][a-z0-9_.-]*)\}`)
+	tableSeparatorRegex = regexp.MustCompile(`^:?-+:?$`)
+)
+
+func (e tableEntry) rangeString() string {
+	if e.Low == e.High {
+		return strconv.Itoa(e.Low)
+	}
+	return fmt.Sprintf("%d-%d", e.Low, e.High)
+}
+
+func (e tableEntry) contains(v BR) bool {
+	return itobr(e.Low).LessThanOrEquals(v) && v.LessThanOrEquals(itobr(e.High))
+}
+
+// Return the roll expression of a table's dice.
+func tableDiceExpression(dice string) string {
+	if strings.EqualFold(dice, "d66") {
+		return d66Expression
+	}
+	return dice
+}
+
+// parseTableRange parses a range like "1-3" or "4". "00" stands for 100, as on d100
+// tables.
+func parseTableRange(s string) (int, int, bool) {
+	m := tableRangeRegex.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0, false
+	}
+	bound := func(s string) int {
+		if s == "00" {
+			return 100
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	low, high := bound(m[1]), bound(m[1])
+	if m[2] != "" {
+		high = bound(m[2])
+	}
+	if low < 0 || high < low {
+		return 0, 0, false
+	}
+	return low, high, true
+}
+
+// parseTableRows reads the rows of a table, as a markdown table or as CSV, with the
+// range of each entry in the first column. It returns the first cell of the header
+// row, if any, and the entries.
+func parseTableRows(content string) (string, []tableEntry, error) {
+	header := ""
+	entries := []tableEntry{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var cells []string
+		if strings.HasPrefix(line, "|") {
+			cells = strings.Split(strings.Trim(line, "|"), "|")
+		} else {
+			reader := csv.NewReader(strings.NewReader(line))
+			reader.LazyQuotes = true
+			reader.TrimLeadingSpace = true
+			record, err := reader.Read()
+			if err != nil {
+				return "", nil, fmt.Errorf("cannot read line `%s`", line)
+			}
+			cells = record
+		}
+		texts := []string{}
+		separator := true
+		for i, cell := range cells {
+			cell = strings.TrimSpace(cell)
+			cells[i] = cell
+			separator = separator && tableSeparatorRegex.MatchString(cell)
+			if i > 0 && cell != "" {
+				texts = append(texts, cell)
+			}
+		}
+		if separator {
+			continue
+		}
+		low, high, ok := parseTableRange(cells[0])
+		if !ok {
+			if len(entries) == 0 && header == "" {
+				header = cells[0]
+				continue
+			}
+			return "", nil, fmt.Errorf("expected a roll or a range like `1-3` but got `%s`", cells[0])
+		}
+		text := strings.Join(texts, ", ")
+		if text == "" {
+			return "", nil, fmt.Errorf("the entry for %s is empty", cells[0])
+		}
+		if len(text) > maxTableEntryLength {
+			return "", nil, fmt.Errorf("an entry can be at most %d characters long", maxTableEntryLength)
+		}
+		entries = append(entries, tableEntry{Low: low, High: high, Text: text})
+	}
+	if len(entries) == 0 {
+		return "", nil, errors.New("the table has no entries: put one entry per line, like `1-3, Goblins` or `| 1-3 | Goblins |`")
+	}
+	if len(entries) > maxTableEntries {
+		return "", nil, fmt.Errorf("a table can have at most %d entries", maxTableEntries)
+	}
+	return header, entries, nil
+}
+
+// inferTableDice guesses the dice of a table from its ranges: a d66 for entries from
+// 11 to 66 using only the digits 1 to 6, a single die for entries starting at 1, or
+// several identical dice otherwise, e.g. 2d6 for entries from 2 to 12.
+func inferTableDice(entries []tableEntry) (string, error) {
+	low, high := entries[0].Low, entries[0].High
+	d66 := true
+	isD66 := func(n int) bool { return n/10 >= 1 && n/10 <= 6 && n%10 >= 1 && n%10 <= 6 }
+	for _, e := range entries {
+		low, high = min(low, e.Low), max(high, e.High)
+		d66 = d66 && isD66(e.Low) && isD66(e.High)
+	}
+	switch {
+	case d66 && low == 11 && high == 66:
+		return "d66", nil
+	case low == 1:
+		return fmt.Sprintf("1d%d", high), nil
+	case low > 1 && high%low == 0 && high > low:
+		return fmt.Sprintf("%dd%d", low, high/low), nil
+	}
+	return "", fmt.Errorf("cannot guess the dice of a table from %d to %d: give them after the name, like `/table import <name> 2d6`", low, high)
+}
+
+// newRandomTable parses and checks a table: every result of its dice must have exactly
+// one entry.
+func (p *Plugin) newRandomTable(name, dice, content string, conf configuration) (*randomTable, error) {
+	header, entries, err := parseTableRows(content)
+	if err != nil {
+		return nil, err
+	}
+	if dice == "" && tableDiceRegex.MatchString(header) {
+		dice = strings.ToLower(header)
+	}
+	if dice == "" {
+		if dice, err = inferTableDice(entries); err != nil {
+			return nil, err
+		}
+	}
+	table := &randomTable{Name: name, Dice: dice, Entries: entries}
+	prob, err := p.tableProb(table, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Low < entries[j].Low })
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Low <= entries[i-1].High {
+			return nil, fmt.Errorf("the entries for %s and %s overlap", entries[i-1].rangeString(), entries[i].rangeString())
+		}
+	}
+	for _, outcome := range prob.Outcomes() {
+		if prob.Get(outcome).Equals(zero) {
+			continue
+		}
+		if table.find(outcome) == nil {
+			return nil, fmt.Errorf("there is no entry for a roll of %s on %s", outcome.String(), dice)
+		}
+	}
+	for _, e := range entries {
+		if prob.ProbabilityOf(e.contains).Equals(zero) {
+			return nil, fmt.Errorf("the entry for %s can never be rolled on %s", e.rangeString(), dice)
+		}
+	}
+	return table, nil
+}
+
+// Return the probability distribution of the dice of a table.
+func (p *Plugin) tableProb(t *randomTable, conf configuration) (PD, error) {
+	parsed, err := p.getParser(conf)(tableDiceExpression(t.Dice))
+	if err != nil {
+		return PD{}, fmt.Errorf("invalid dice `%s`: %s", t.Dice, err.Error())
+	}
+	return parsed.prob(), nil
+}
+
+func (t *randomTable) find(v BR) *tableEntry {
+	for i, e := range t.Entries {
+		if e.contains(v) {
+			return &t.Entries[i]
+		}
+	}
+	return nil
+}
+
+func (t *randomTable) entryCount() string {
+	return fmt.Sprintf("%d %s", len(t.Entries), ternaryStr(len(t.Entries) == 1, "entry", "entries"))
+}
+
+// Render a table with the chance of each entry.
+func (t *randomTable) render(prob PD) string {
+	text := fmt.Sprintf("**%s** (%s)\n\n|%s|Entry|Chance|\n|:-:|-|-:|", t.Name, t.Dice, t.Dice)
+	for _, e := range t.Entries {
+		chance := prob.ProbabilityOf(e.contains).Float64() * 100
+		text += fmt.Sprintf("\n|%s|%s|%.1f%%|", e.rangeString(), e.Text, chance)
+	}
+	return text
+}
+
+func tablesKey(teamID string) string {
+	return "tables_" + teamID
+}
+
+func (p *Plugin) getTables(teamID string) (tableLibrary, error) {
+	tables := tableLibrary{}
+	data, appErr := p.API.KVGet(tablesKey(teamID))
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to load tables")
+	}
+	if data == nil {
+		return tables, nil
+	}
+	if err := json.Unmarshal(data, &tables); err != nil {
+		return nil, errors.Wrap(err, "failed to decode tables")
+	}
+	return tables, nil
+}
+
+func (p *Plugin) setTables(teamID string, tables tableLibrary) error {
+	data, err := json.Marshal(tables)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode tables")
+	}
+	if appErr := p.API.KVSet(tablesKey(teamID), data); appErr != nil {
+		return errors.Wrap(appErr, "failed to save tables")
+	}
+	return nil
+}
+
+// tableRoller rolls on tables, following the references of entries to other tables.
+type tableRoller struct {
+	p         *Plugin
+	tables    tableLibrary
+	roller    Roller
+	conf      configuration
+	userID    string
+	channelID string
+	rolls     int
+	// The rolls on referenced tables, in order.
+	details []string
+}
+
+// lookup returns the text of the entry of a rolled table, with its references to other
+// tables and its inline rolls rolled.
+func (r *tableRoller) lookup(t *randomTable, rolled Node, depth int) (string, error) {
+	entry := t.find(rolled.value())
+	if entry == nil {
+		return "", fmt.Errorf("table %s has no entry for %s", t.Name, rolled.value().String())
+	}
+	var err error
+	text := tableRefRegex.ReplaceAllStringFunc(entry.Text, func(match string) string {
+		if err != nil {
+			return match
+		}
+		var nested string
+		nested, err = r.rollNested(strings.ToLower(tableRefRegex.FindStringSubmatch(match)[1]), depth+1)
+		return nested
+	})
+	if err != nil {
+		return "", err
+	}
+	text, _, err = r.p.rollInline(text, r.userID, r.channelID, func() (Roller, *fairRoll, error) {
+		return r.roller, nil, nil
+	}, r.conf)
+	return text, err
+}
+
+// rollNested rolls on a table referenced by an entry, adding the roll to the details.
+func (r *tableRoller) rollNested(name string, depth int) (string, error) {
+	t, ok := r.tables[name]
+	if !ok {
+		return "", fmt.Errorf("no table `%s`", name)
+	}
+	if depth > maxTableDepth {
+		return "", fmt.Errorf("tables can only refer to each other %d levels deep", maxTableDepth)
+	}
+	if r.rolls++; r.rolls > maxTableRolls {
+		return "", fmt.Errorf("a roll can use at most %d tables", maxTableRolls)
+	}
+	parsed, err := r.p.getParser(r.conf)(tableDiceExpression(t.Dice))
+	if err != nil {
+		return "", err
+	}
+	rolled := parsed.roll(r.roller, r.conf)
+	i := len(r.details)
+	r.details = append(r.details, "")
+	text, err := r.lookup(t, rolled, depth)
+	if err != nil {
+		return "", err
+	}
+	r.details[i] = fmt.Sprintf("↳ **%s** %s: %s", t.Name, rolled.renderToplevel(ternaryStr(r.conf.EnableLatex, "l", "")), text)
+	return text, nil
+}
+
+// executeTableCommand handles the `/table` command.
+func (p *Plugin) executeTableCommand(args *model.CommandArgs, query string) (*model.CommandResponse, *model.AppError) {
+	subcommand, rest := splitFirstWord(query)
+	if subcommand == "" || subcommand == "help" {
+		return ephemeralResponse(tableHelpText), nil
+	}
+	if args.TeamId == "" {
+		return nil, appError("There are no tables outside of teams.", nil)
+	}
+
+	conf, err := p.getEffectiveConfiguration(args.ChannelId)
+	if err != nil {
+		return nil, appError("Cannot load the channel configuration.", err)
+	}
+
+	p.tablesLock.Lock()
+	defer p.tablesLock.Unlock()
+
+	tables, err := p.getTables(args.TeamId)
+	if err != nil {
+		return nil, appError("Cannot load the tables of this team.", err)
+	}
+
+	switch subcommand {
+	case "import":
+		return p.importTable(args, tables, rest, conf)
+	case "roll":
+		return p.rollTable(args, tables, strings.ToLower(strings.TrimSpace(rest)), conf)
+	case "show":
+		name := strings.ToLower(strings.TrimSpace(rest))
+		t, ok := tables[name]
+		if !ok {
+			return nil, appError(fmt.Sprintf("There is no table `%s`: See `/table list`.", name), nil)
+		}
+		prob, err := p.tableProb(t, conf)
+		if err != nil {
+			return nil, appError(fmt.Sprintf("%s.", err.Error()), err)
+		}
+		return ephemeralResponse(t.render(prob)), nil
+	case "list":
+		if len(tables) == 0 {
+			return ephemeralResponse("There are no tables in this team: Use `/table import <name>` to add one."), nil
+		}
+		names := make([]string, 0, len(tables))
+		for name := range tables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		text := "Tables of this team:"
+		for _, name := range names {
+			text += fmt.Sprintf("\n- `%s` (%s, %s)", name, tables[name].Dice, tables[name].entryCount())
+		}
+		return ephemeralResponse(text), nil
+	case "delete":
+		name := strings.ToLower(strings.TrimSpace(rest))
+		t, ok := tables[name]
+		if !ok {
+			return nil, appError(fmt.Sprintf("There is no table `%s`.", name), nil)
+		}
+		if appErr := p.checkTablePermission(args, t); appErr != nil {
+			return nil, appErr
+		}
+		delete(tables, name)
+		if err := p.setTables(args.TeamId, tables); err != nil {
+			return nil, appError("Cannot save the tables.", err)
+		}
+		return ephemeralResponse(fmt.Sprintf("Deleted table `%s`.", name)), nil
+	default:
+		return nil, appError("Usage: `/table [import <name> [dice]|roll <name>|show <name>|list|delete <name>]`.", nil)
+	}
+}
+
+// checkTablePermission checks that the user can replace or delete a table: only its
+// creator and team admins can.
+func (p *Plugin) checkTablePermission(args *model.CommandArgs, t *randomTable) *model.AppError {
+	if t.CreatorID != args.UserId && !p.API.HasPermissionToTeam(args.UserId, args.TeamId, model.PermissionManageTeam) {
+		return appError(fmt.Sprintf("Only its creator and team admins can change table `%s`.", t.Name), nil)
+	}
+	return nil
+}
+
+// importTable handles `/table import <name> [dice]` followed by the rows of the table
+// on the next lines.
+func (p *Plugin) importTable(args *model.CommandArgs, tables tableLibrary, query string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	firstLine, content, _ := strings.Cut(query, "\n")
+	fields := strings.Fields(firstLine)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, appError("Usage: `/table import <name> [dice]`, followed by one entry per line, like `1-3, Goblins` or `| 1-3 | Goblins |`.", nil)
+	}
+	name := strings.ToLower(fields[0])
+	if !tableNameRegex.MatchString(name) || len(name) > maxTableNameLength {
+		return nil, appError(fmt.Sprintf("Invalid table name `%s`: Use up to %d letters, digits, underscores, dots and dashes.", fields[0], maxTableNameLength), nil)
+	}
+	dice := ""
+	if len(fields) == 2 {
+		dice = strings.ToLower(fields[1])
+	}
+	if old, ok := tables[name]; ok {
+		if appErr := p.checkTablePermission(args, old); appErr != nil {
+			return nil, appErr
+		}
+	} else if len(tables) >= maxTableCount {
+		return nil, appError(fmt.Sprintf("A team can have at most %d tables.", maxTableCount), nil)
+	}
+	t, err := p.newRandomTable(name, dice, content, conf)
+	if err != nil {
+		return nil, appError(fmt.Sprintf("Cannot import table `%s`: %s.", name, err.Error()), err)
+	}
+	t.CreatorID = args.UserId
+	tables[name] = t
+	if err := p.setTables(args.TeamId, tables); err != nil {
+		return nil, appError("Cannot save the tables.", err)
+	}
+	return ephemeralResponse(fmt.Sprintf("Imported table `%s` (%s, %s). Roll on it with `/table roll %s`.", name, t.Dice, t.entryCount(), name)), nil
+}
+
+// rollTable handles `/table roll <name>`: it rolls the dice of the table and posts the
+// entry rolled, rolling on the tables it refers to.
+func (p *Plugin) rollTable(args *model.CommandArgs, tables tableLibrary, name string, conf configuration) (*model.CommandResponse, *model.AppError) {
+	t, ok := tables[name]
+	if !ok {
+		return nil, appError(fmt.Sprintf("There is no table `%s`: See `/table list`.", name), nil)
+	}
+	roller, proof, err := p.publicRoller(conf, args.UserId, args.ChannelId, "")
+	if err != nil {
+		return nil, appError("Cannot load the server seed.", err)
+	}
+	expr := tableDiceExpression(t.Dice)
+	post, rolled, appErr := p.generateDiceRoll(expr, args.UserId, args.ChannelId, args.RootId, roller, conf)
+	if appErr != nil {
+		return nil, appErr
+	}
+	r := &tableRoller{p: p, tables: tables, roller: roller, conf: conf, userID: args.UserId, channelID: args.ChannelId, rolls: 1}
+	text, err := r.lookup(t, *rolled, 1)
+	if err != nil {
+		return nil, appError(fmt.Sprintf("Cannot roll on table `%s`: %s.", name, err.Error()), err)
+	}
+	post.Message += fmt.Sprintf("\n**%s**: %s", t.Name, text)
+	for _, detail := range r.details {
+		post.Message += "\n" + detail
+	}
+	proof.addToPost(post)
+	if _, appErr := p.createRollPost(post, rolled, expr, args.UserId); appErr != nil {
+		return nil, appErr
+	}
+	return &model.CommandResponse{}, nil
+}
+
+const tableHelpText = "Use `/table` to roll on the random tables of this team:\n" +
+	"- `/table import <name> [dice]` adds a table, with one entry per line after the command, as CSV (`1-3, Goblins`) or as a markdown table (`| 1-3 | Goblins |`).\n" +
+	"  The dice are guessed from the ranges if not given, or taken from the header of the first column, like `d66` or `2d6`.\n" +
+	"- `/table roll <name>` rolls on a table. Entries can refer to other tables with `{table:<name>}`, and hold rolls like `[[2d6]]`.\n" +
+	"- `/table show <name>` shows a table with the chance of each entry.\n" +
+	"- `/table list` lists the tables, and `/table delete <name>` deletes one."
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseTableRows(t *testing.T) {
+	header, entries, err := parseTableRows("| d6 | Encounter | Number |\n|:-:|---|--|\n| 1-3 | Goblins | 2d4 |\n| 4 | Orc | 1 |\n|5–6|Nothing||\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "d6", header)
+	assert.Equal(t, []tableEntry{{1, 3, "Goblins, 2d4"}, {4, 4, "Orc, 1"}, {5, 6, "Nothing"}}, entries)
+
+	header, entries, err = parseTableRows("1-2, \"Sword, rusty\"\n3,Shield\n\n04-00,Nothing")
+	assert.Nil(t, err)
+	assert.Equal(t, "", header)
+	assert.Equal(t, []tableEntry{{1, 2, "Sword, rusty"}, {3, 3, "Shield"}, {4, 100, "Nothing"}}, entries)
+
+	for _, content := range []string{"", "Roll, Entry", "1-3, Goblins\nfour, Orc", "1-3,", "3-1, Goblins"} {
+		_, _, err = parseTableRows(content)
+		assert.NotNil(t, err, content)
+	}
+}
+
+func TestInferTableDice(t *testing.T) {
+	for dice, entries := range map[string][]tableEntry{
+		"1d6":   {{1, 3, "a"}, {4, 6, "b"}},
+		"1d100": {{1, 50, "a"}, {51, 100, "b"}},
+		"2d6":   {{2, 6, "a"}, {7, 7, "b"}, {8, 12, "c"}},
+		"3d6":   {{3, 18, "a"}},
+		"d66":   {{11, 36, "a"}, {41, 66, "b"}},
+	} {
+		inferred, err := inferTableDice(entries)
+		assert.Nil(t, err, dice)
+		assert.Equal(t, dice, inferred)
+	}
+	_, err := inferTableDice([]tableEntry{{3, 7, "a"}})
+	assert.NotNil(t, err)
+}
+
+func TestNewRandomTable(t *testing.T) {
+	p, _ := initTestPlugin()
+	conf := *p.getConfiguration()
+
+	table, err := p.newRandomTable("loot", "", "4-6, Gold\n1-3, Nothing", conf)
+	assert.Nil(t, err)
+	assert.Equal(t, "1d6", table.Dice)
+	assert.Equal(t, []tableEntry{{1, 3, "Nothing"}, {4, 6, "Gold"}}, table.Entries)
+	prob, _ := p.tableProb(table, conf)
+	assert.Equal(t, "**loot** (1d6)\n\n|1d6|Entry|Chance|\n|:-:|-|-:|\n|1-3|Nothing|50.0%|\n|4-6|Gold|50.0%|", table.render(prob))
+
+	// The header gives the dice, and d66 rolls a d6 for the tens and one for the units.
+	table, err = p.newRandomTable("d66", "", "| D66 | Event |\n|-|-|\n| 11-16 | Rain |\n| 21-66 | Sun |", conf)
+	assert.Nil(t, err)
+	assert.Equal(t, "d66", table.Dice)
+	prob, _ = p.tableProb(table, conf)
+	assert.Contains(t, table.render(prob), "|11-16|Rain|16.7%|\n|21-66|Sun|83.3%|")
+
+	// 2d6 makes 7 more likely.
+	table, err = p.newRandomTable("weather", "", "2-6, Rain\n7, Fog\n8-12, Sun", conf)
+	assert.Nil(t, err)
+	prob, _ = p.tableProb(table, conf)
+	assert.Contains(t, table.render(prob), "|7|Fog|16.7%|")
+
+	for _, testCase := range []struct {
+		dice, content string
+	}{
+		{"", "1-3, a\n5-6, b"},       // 4 is missing
+		{"", "1-4, a\n4-6, b"},       // overlap
+		{"1d4", "1-4, a\n5-6, b"},    // 5-6 cannot be rolled
+		{"1d8", "1-4, a\n5-6, b"},    // 7-8 are missing
+		{"hahaha", "1-4, a\n5-6, b"}, // invalid dice
+	} {
+		_, err = p.newRandomTable("bad", testCase.dice, testCase.content, conf)
+		assert.NotNil(t, err, testCase.content)
+	}
+}
+
+func TestTableCommand(t *testing.T) {
+	p, api := initTestPlugin()
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		posts = append(posts, post)
+		return post
+	}, nil)
+	api.On("HasPermissionToTeam", "admin", "team1", model.PermissionManageTeam).Return(true)
+	api.On("HasPermissionToTeam", mock.Anything, mock.Anything, mock.Anything).Return(false)
+	assert.Nil(t, p.OnActivate())
+
+	run := func(userID, command string) (*model.CommandResponse, *model.AppError) {
+		posts = nil
+		return p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: command, UserId: userID, ChannelId: "channel1", TeamId: "team1"})
+	}
+
+	response, err := run("userid", "/table import encounters\n1-5, [[2+1]] goblins with {table:Loot}\n6, Nothing")
+	assert.Nil(t, err)
+	assert.Equal(t, "Imported table `encounters` (1d6, 2 entries). Roll on it with `/table roll encounters`.", response.Text)
+	_, err = run("userid", "/table import loot 1d2\n1-2, a {table:gems}")
+	assert.Nil(t, err)
+	_, err = run("userid", "/table import gems\n| Roll | Gem |\n|--|--|\n| 1 | ruby |")
+	assert.Nil(t, err)
+
+	// Only the creator and team admins can replace or delete a table.
+	_, err = run("otheruser", "/table import gems\n1, diamond")
+	assert.NotNil(t, err)
+	_, err = run("otheruser", "/table delete gems")
+	assert.NotNil(t, err)
+	_, err = run("admin", "/table import gems\n1, emerald")
+	assert.Nil(t, err)
+
+	response, err = run("userid", "/table list")
+	assert.Nil(t, err)
+	assert.Equal(t, "Tables of this team:\n- `encounters` (1d6, 2 entries)\n- `gems` (1d1, 1 entry)\n- `loot` (1d2, 1 entry)", response.Text)
+
+	for i := 0; i < 20; i++ {
+		_, err = run("userid", "/table roll encounters")
+		assert.Nil(t, err)
+		if !assert.Len(t, posts, 1) {
+			continue
+		}
+		if m := regexp.MustCompile(`^\*\*User\*\* rolls 1d6 = \*\*(\d)\*\*\n\*\*encounters\*\*: (.*)$`).FindStringSubmatch(posts[0].Message); m != nil {
+			assert.Equal(t, "6", m[1])
+			assert.Equal(t, "Nothing", m[2])
+			continue
+		}
+		assert.Regexp(t, regexp.MustCompile("^\\*\\*User\\*\\* rolls 1d6 = \\*\\*[1-5]\\*\\*\n"+
+			"\\*\\*encounters\\*\\*: `2\\+1` = \\*\\*3\\*\\* goblins with a emerald\n"+
+			"↳ \\*\\*loot\\*\\* 1d2 = \\*\\*[12]\\*\\*: a emerald\n"+
+			"↳ \\*\\*gems\\*\\* 1d1 = \\*\\*1\\*\\*: emerald$"), posts[0].Message)
+	}
+
+	// Tables referring to each other in a loop.
+	_, err = run("userid", "/table import ping 1d1\n1, {table:pong}")
+	assert.Nil(t, err)
+	_, err = run("userid", "/table import pong 1d1\n1, {table:ping}")
+	assert.Nil(t, err)
+	for _, command := range []string{"/table roll ping", "/table roll nope", "/table import Bad/Name\n1, a", "/table import empty", "/table flip"} {
+		_, err = run("userid", command)
+		assert.NotNil(t, err, command)
+	}
+
+	_, err = run("userid", "/table delete ping")
+	assert.Nil(t, err)
+	_, err = run("userid", "/table roll pong")
+	assert.NotNil(t, err)
+
+	_, err = p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: "/table list", UserId: "userid", ChannelId: "dm"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// Outgoing webhooks: each public roll is POSTed as JSON to the webhook URLs of the
+// plugin settings, from a bounded queue so that rolling never waits for them.
+
+const (
+	maxWebhookQueue    = 100
+	maxWebhookAttempts = 4
+	webhookTimeout     = 10 * time.Second
+	// Delay before the first retry, doubled at each retry.
+	webhookBackoff = time.Second
+
+	webhookSignatureHeader = "X-Dice-Roller-Signature"
+	webhookEventHeader     = "X-Dice-Roller-Event"
+	webhookDeliveryHeader  = "X-Dice-Roller-Delivery"
+)
+
+type webhookPayload struct {
+	Event     string `json:"event"`
+	ChannelID string `json:"channel_id"`
+	UserID    string `json:"user_id"`
+	PostID    string `json:"post_id"`
+	// Milliseconds since the epoch.
+	Timestamp int64 `json:"timestamp"`
+	// The roll post message, in Markdown.
+	Text string    `json:"text"`
+	Roll rollProps `json:"roll"`
+}
+
+// Return the webhook URLs of a channel. Each line of the setting is either a URL, for
+// all channels, or a channel ID and a URL.
+func (c *configuration) webhookURLs(channelID string) []string {
+	ret := []string{}
+	for _, line := range strings.Split(c.WebhookURLs, "\n") {
+		target, err := parseWebhookLine(line)
+		if err == nil && target.url != "" && (target.channelID == "" || target.channelID == channelID) {
+			ret = append(ret, target.url)
+		}
+	}
+	return ret
+}
+
+type webhookTarget struct {
+	channelID string
+	url       string
+}
+
+func parseWebhookLine(line string) (webhookTarget, error) {
+	fields := strings.Fields(line)
+	target := webhookTarget{}
+	switch len(fields) {
+	case 0:
+		return target, nil
+	case 1:
+		target.url = fields[0]
+	case 2:
+		target.channelID, target.url = fields[0], fields[1]
+	default:
+		return target, errors.Errorf("expected a URL, or a channel ID and a URL, but got %q", line)
+	}
+	u, err := url.Parse(target.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return target, errors.Errorf("invalid webhook URL %q", target.url)
+	}
+	return target, nil
+}
+
+// validateWebhookURLs returns an error for each invalid line of the setting.
+func (c *configuration) validateWebhookURLs() []error {
+	errs := []error{}
+	for _, line := range strings.Split(c.WebhookURLs, "\n") {
+		if _, err := parseWebhookLine(line); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Return the signature of a webhook body: the hex encoded HMAC-SHA256 with the secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookDelivery struct {
+	url    string
+	secret string
+	event  string
+	body   []byte
+}
+
+// webhookQueue sends webhook deliveries in order, from a single worker goroutine.
+type webhookQueue struct {
+	deliveries chan webhookDelivery
+	done       chan struct{}
+	wg         sync.WaitGroup
+	client     *http.Client
+	backoff    time.Duration
+	logWarn    func(msg string, keyValuePairs ...interface{})
+}
+
+func newWebhookQueue(size int, logWarn func(msg string, keyValuePairs ...interface{})) *webhookQueue {
+	return &webhookQueue{
+		deliveries: make(chan webhookDelivery, size),
+		done:       make(chan struct{}),
+		client:     &http.Client{Timeout: webhookTimeout},
+		backoff:    webhookBackoff,
+		logWarn:    logWarn,
+	}
+}
+
+func (q *webhookQueue) start() {
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		for {
+			select {
+			case <-q.done:
+				return
+			case d := <-q.deliveries:
+				if err := q.deliver(d); err != nil {
+					q.logWarn("Failed to send roll webhook.", "url", d.url, "error", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// stop stops the worker, dropping the deliveries left in the queue.
+func (q *webhookQueue) stop() {
+	close(q.done)
+	q.wg.Wait()
+}
+
+// enqueue adds a delivery to the queue, or drops it if the queue is full. It never
+// blocks.
+func (q *webhookQueue) enqueue(d webhookDelivery) bool {
+	select {
+	case q.deliveries <- d:
+		return true
+	default:
+		q.logWarn("Roll webhook queue full, dropping a delivery.", "url", d.url)
+		return false
+	}
+}
+
+// deliver sends a delivery, retrying with exponential backoff on network errors,
+// server errors and rate limiting.
+func (q *webhookQueue) deliver(d webhookDelivery) error {
+	id := model.NewId()
+	backoff := q.backoff
+	var err error
+	for attempt := 1; attempt <= maxWebhookAttempts; attempt++ {
+		var retry bool
+		if retry, err = q.post(d, id); err == nil || !retry {
+			return err
+		}
+		if attempt < maxWebhookAttempts {
+			select {
+			case <-q.done:
+				return err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// post sends a delivery once, returning whether it may be retried if it failed.
+func (q *webhookQueue) post(d webhookDelivery, id string) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.event)
+	req.Header.Set(webhookDeliveryHeader, id)
+	if d.secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(d.secret, d.body))
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "failed to send webhook")
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, errors.Errorf("webhook failed with status %d", resp.StatusCode)
+	default:
+		return false, errors.Errorf("webhook failed with status %d", resp.StatusCode)
+	}
+}
+
+// notifyRollWebhooks queues a roll event for the webhooks of the roll's channel.
+func (p *Plugin) notifyRollWebhooks(post *model.Post, rolled *Node, expression, userID string) {
+	conf := p.getConfiguration()
+	urls := conf.webhookURLs(post.ChannelId)
+	if len(urls) == 0 || p.webhooks == nil {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{
+		Event:     "roll",
+		ChannelID: post.ChannelId,
+		UserID:    userID,
+		PostID:    post.Id,
+		Timestamp: model.GetMillis(),
+		Text:      post.Message,
+		Roll:      newRollProps(expression, *rolled),
+	})
+	if err != nil {
+		return
+	}
+	for _, u := range urls {
+		p.webhooks.enqueue(webhookDelivery{url: u, secret: conf.WebhookSecret, event: "roll", body: body})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// Start a webhook server answering with the given statuses in turn, then 200.
+func newWebhookServer(statuses ...int) (*httptest.Server, chan webhookRequest) {
+	requests := make(chan webhookRequest, 10)
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		lock.Unlock()
+		w.WriteHeader(status)
+		requests <- webhookRequest{header: r.Header, body: body}
+	}))
+	return server, requests
+}
+
+func receiveWebhook(t *testing.T, requests chan webhookRequest) *webhookRequest {
+	select {
+	case r := <-requests:
+		return &r
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for a webhook")
+		return nil
+	}
+}
+
+func assertNoWebhook(t *testing.T, requests chan webhookRequest) {
+	select {
+	case r := <-requests:
+		t.Errorf("Unexpected webhook: %s", r.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookURLs(t *testing.T) {
+	c := &configuration{WebhookURLs: "https://example.com/all\n\n  channel1   http://localhost:8080/one  \nchannel2 https://example.com/two\nftp://example.com\na b c\nnot a url"}
+	assert.Equal(t, []string{"https://example.com/all", "http://localhost:8080/one"}, c.webhookURLs("channel1"))
+	assert.Equal(t, []string{"https://example.com/all"}, c.webhookURLs("channel3"))
+	assert.Len(t, c.validateWebhookURLs(), 3)
+	assert.Equal(t, []string{}, (&configuration{}).webhookURLs("channel1"))
+}
+
+func TestWebhookQueue(t *testing.T) {
+	server, requests := newWebhookServer(http.StatusInternalServerError, http.StatusTooManyRequests)
+	defer server.Close()
+	var warnings int32
+	logWarn := func(string, ...interface{}) { atomic.AddInt32(&warnings, 1) }
+	q := newWebhookQueue(2, logWarn)
+	q.backoff = time.Millisecond
+	q.start()
+
+	body := []byte(`{"event":"roll"}`)
+	assert.True(t, q.enqueue(webhookDelivery{url: server.URL, secret: "s3cret", event: "roll", body: body}))
+	first := receiveWebhook(t, requests)
+	second := receiveWebhook(t, requests)
+	third := receiveWebhook(t, requests)
+	if first != nil && second != nil && third != nil {
+		assert.Equal(t, body, third.body)
+		assert.Equal(t, "application/json", third.header.Get("Content-Type"))
+		assert.Equal(t, "roll", third.header.Get(webhookEventHeader))
+		assert.Equal(t, webhookSignature("s3cret", body), third.header.Get(webhookSignatureHeader))
+		assert.Equal(t, first.header.Get(webhookDeliveryHeader), third.header.Get(webhookDeliveryHeader))
+	}
+	assertNoWebhook(t, requests)
+	q.stop()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&warnings))
+
+	// Client errors are not retried, and there is no signature without a secret.
+	server2, requests2 := newWebhookServer(http.StatusBadRequest)
+	defer server2.Close()
+	q = newWebhookQueue(2, logWarn)
+	q.backoff = time.Millisecond
+	q.start()
+	assert.True(t, q.enqueue(webhookDelivery{url: server2.URL, event: "roll", body: body}))
+	if r := receiveWebhook(t, requests2); r != nil {
+		assert.Equal(t, "", r.header.Get(webhookSignatureHeader))
+	}
+	assertNoWebhook(t, requests2)
+	q.stop()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&warnings))
+
+	// A full queue drops deliveries instead of blocking.
+	q = newWebhookQueue(2, logWarn)
+	assert.True(t, q.enqueue(webhookDelivery{url: server.URL}))
+	assert.True(t, q.enqueue(webhookDelivery{url: server.URL}))
+	assert.False(t, q.enqueue(webhookDelivery{url: server.URL}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&warnings))
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// RFC 4231, test case 2
+	assert.Equal(t, "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843", webhookSignature("Jefe", []byte("what do ya want for nothing?")))
+}
+
+func TestRollWebhooks(t *testing.T) {
+	server, requests := newWebhookServer()
+	defer server.Close()
+	p, api := initTestPlugin()
+	p.configuration.WebhookURLs = "channel1 " + server.URL
+	p.configuration.WebhookSecret = "s3cret"
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(func(post *model.Post) *model.Post {
+		post.Id = "postid"
+		return post
+	}, nil)
+	api.On("SendEphemeralPost", mock.Anything, mock.AnythingOfType("*model.Post")).Return(nil)
+	api.On("GetChannel", mock.Anything).Return(&model.Channel{Id: "channel1", Name: "campaign"}, nil)
+	assert.Nil(t, p.OnActivate())
+	defer func() { assert.Nil(t, p.OnDeactivate()) }()
+
+	run := func(command, channelID string) {
+		_, appErr := p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{Command: command, UserId: "userid", ChannelId: channelID})
+		assert.Nil(t, appErr, command)
+	}
+
+	run("/roll 2+3 fire", "channel1")
+	if r := receiveWebhook(t, requests); r != nil {
+		assert.Equal(t, webhookSignature("s3cret", r.body), r.header.Get(webhookSignatureHeader))
+		payload := webhookPayload{}
+		assert.Nil(t, json.Unmarshal(r.body, &payload))
+		assert.NotZero(t, payload.Timestamp)
+		payload.Timestamp = 0
+		assert.Equal(t, webhookPayload{
+			Event:     "roll",
+			ChannelID: "channel1",
+			UserID:    "userid",
+			PostID:    "postid",
+			Text:      "**User** rolls 2+3 = **5** fire",
+			Roll: rollProps{
+				Expression: "2+3 fire",
+				Canonical:  "2+3 fire",
+				Dice:       []dieProp{},
+				Subtotals:  []subtotalProp{{Label: "fire", Total: "5"}},
+				Totals:     []string{"5"},
+				Total:      "5",
+			},
+		}, payload)
+	}
+
+	// Only public rolls of the configured channel are sent.
+	run("/roll 2+3", "channel2")
+	run("/roll secret 2+3", "channel1")
+	assertNoWebhook(t, requests)
+}